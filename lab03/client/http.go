@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BufCap    = 2048
+	MaxLine   = 64 << 10
+	userAgent = "lab03-client/1.0"
+	crlf      = "\r\n"
+)
+
+var errTooManyRedirects = errors.New("too many redirects")
+
+type Client struct {
+	Follow       bool
+	MaxRedirects int
+	Verbose      bool
+	Timeout      time.Duration
+	TLSConfig    *tls.Config
+}
+
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+// Response body is already stripped of its transfer coding and gzip
+// content coding, ContentLength is -1 when the length is unknown.
+type Response struct {
+	Proto         string
+	Status        int
+	Reason        string
+	Header        textproto.MIMEHeader
+	ContentLength int64
+	Body          io.Reader
+
+	conn       net.Conn
+	gz         *gzip.Reader
+	untilClose bool
+}
+
+// Do sends req and follows redirects when the client is asked to.
+func (c *Client) Do(req *Request) (*Response, error) {
+	for hops := 0; ; hops++ {
+		resp, err := c.roundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		location := resp.Header.Get("Location")
+		if !c.Follow || !isRedirect(resp.Status) || location == "" {
+			return resp, nil
+		}
+		if err := resp.Close(); err != nil {
+			log.Printf("Failed to close connection: %s", err.Error())
+		}
+		if hops >= c.MaxRedirects {
+			return nil, fmt.Errorf("%w after %d hops", errTooManyRedirects, hops)
+		}
+
+		next, err := req.URL.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("bad Location %q: %w", location, err)
+		}
+		if next.Scheme != "http" && next.Scheme != "https" {
+			return nil, fmt.Errorf("redirect to unsupported scheme %q", next.Scheme)
+		}
+		if c.Verbose {
+			log.Printf("Following %d to %s", resp.Status, next)
+		}
+		req = req.redirect(next, resp.Status)
+	}
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
+
+// redirect builds the follow-up request: 303, and 301/302 after a POST,
+// switch to GET without a body, 307/308 repeat the request as is.
+func (r *Request) redirect(next *url.URL, status int) *Request {
+	out := &Request{Method: r.Method, URL: next, Header: make(textproto.MIMEHeader), Body: r.Body}
+	for k, v := range r.Header {
+		out.Header[k] = v
+	}
+	if status == 303 && r.Method != "HEAD" || (status == 301 || status == 302) && r.Method == "POST" {
+		out.Method = "GET"
+		out.Body = nil
+		out.Header.Del("Content-Type")
+	}
+	// credentials are not sent to another host
+	if next.Host != r.URL.Host {
+		out.Header.Del("Authorization")
+		out.Header.Del("Cookie")
+	}
+	out.Header.Del("Host")
+	return out
+}
+
+func (c *Client) dial(u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	if u.Scheme == "https" {
+		config := c.TLSConfig.Clone()
+		config.ServerName = u.Hostname()
+		return tls.DialWithDialer(dialer, "tcp", host, config)
+	}
+	return dialer.Dial("tcp", host)
+}
+
+func (c *Client) roundTrip(req *Request) (*Response, error) {
+	conn, err := c.dial(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	conn = &timeoutConn{Conn: conn, timeout: c.Timeout}
+
+	w := bufio.NewWriterSize(conn, BufCap)
+	if err := writeRequest(w, req, false); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	resp, err := readResponse(bufio.NewReaderSize(conn, BufCap), req.Method)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	resp.conn = conn
+	if c.Verbose {
+		log.Printf("> %s %s", req.Method, req.URL)
+		for k, v := range requestHeader(req, false) {
+			log.Printf("> %s: %s", k, strings.Join(v, ", "))
+		}
+		log.Printf("< %s %d %s", resp.Proto, resp.Status, resp.Reason)
+		for k, v := range resp.Header {
+			log.Printf("< %s: %s", k, strings.Join(v, ", "))
+		}
+	}
+	return resp, nil
+}
+
+func (r *Response) Close() error {
+	if r.gz != nil {
+		_ = r.gz.Close()
+	}
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+func (r *Response) writeHead(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s %d %s"+crlf, r.Proto, r.Status, r.Reason); err != nil {
+		return err
+	}
+	for k, values := range r.Header {
+		for _, v := range values {
+			if _, err := fmt.Fprintf(w, "%s: %s"+crlf, k, v); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, crlf)
+	return err
+}
+
+func requestHeader(req *Request, keepAlive bool) textproto.MIMEHeader {
+	header := make(textproto.MIMEHeader)
+	header.Set("Host", req.URL.Host)
+	header.Set("User-Agent", userAgent)
+	header.Set("Accept", "*/*")
+	if !keepAlive {
+		header.Set("Connection", "close")
+	}
+	for k, v := range req.Header {
+		header[k] = v
+	}
+	if req.Body != nil || req.Method == "POST" || req.Method == "PUT" {
+		header.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+	return header
+}
+
+func writeRequest(w *bufio.Writer, req *Request, keepAlive bool) error {
+	if _, err := fmt.Fprintf(w, "%s %s HTTP/1.1"+crlf, req.Method, req.URL.RequestURI()); err != nil {
+		return err
+	}
+	for k, values := range requestHeader(req, keepAlive) {
+		for _, v := range values {
+			if _, err := fmt.Fprintf(w, "%s: %s"+crlf, k, v); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := w.WriteString(crlf); err != nil {
+		return err
+	}
+	_, err := w.Write(req.Body)
+	return err
+}
+
+// readResponse parses a status line and headers and sets up the body
+// reader, interim 1xx responses are skipped.
+func readResponse(r *bufio.Reader, method string) (*Response, error) {
+	tp := textproto.NewReader(r)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := parseStatusLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Header, err = tp.ReadMIMEHeader(); err != nil {
+			return nil, fmt.Errorf("malformed headers: %w", err)
+		}
+		if resp.Status >= 100 && resp.Status < 200 && resp.Status != 101 {
+			continue
+		}
+		if err := resp.setupBody(r, method); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+func parseStatusLine(line string) (*Response, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 3 {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	resp := &Response{Proto: parts[0], Status: status, ContentLength: -1}
+	if len(parts) == 3 {
+		resp.Reason = parts[2]
+	}
+	return resp, nil
+}
+
+func (r *Response) setupBody(br *bufio.Reader, method string) error {
+	if method == "HEAD" || r.Status < 200 || r.Status == 204 || r.Status == 304 {
+		r.Body = strings.NewReader("")
+		r.ContentLength = 0
+		return nil
+	}
+
+	if te := r.Header.Get("Transfer-Encoding"); te != "" {
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return fmt.Errorf("unsupported transfer coding %q", te)
+		}
+		r.Body = &chunkedReader{r: br}
+	} else if cl := r.Header.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("malformed Content-Length %q", cl)
+		}
+		r.ContentLength = n
+		r.Body = &exactReader{r: io.LimitReader(br, n), left: n}
+	} else {
+		r.Body = br
+		r.untilClose = true
+	}
+
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return fmt.Errorf("bad gzip body: %w", err)
+		}
+		r.gz = gz
+		r.Body = gz
+		// the decoded length is not known in advance
+		r.ContentLength = -1
+	}
+	return nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > MaxLine {
+			return "", fmt.Errorf("line longer than %d bytes", MaxLine)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(line), crlf), nil
+	}
+}
+
+// chunkedReader decodes the chunked transfer coding, trailers are skipped.
+type chunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		line, err := readLine(c.r)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("malformed chunk size %q", line)
+		}
+		if n == 0 {
+			for {
+				trailer, err := readLine(c.r)
+				if err != nil {
+					return 0, unexpectedEOF(err)
+				}
+				if trailer == "" {
+					break
+				}
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = n
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err != nil {
+		return n, unexpectedEOF(err)
+	}
+	if c.left == 0 {
+		if line, err := readLine(c.r); err != nil {
+			return n, unexpectedEOF(err)
+		} else if line != "" {
+			return n, errors.New("missing CRLF after chunk")
+		}
+	}
+	return n, nil
+}
+
+// exactReader reports a connection closed before Content-Length bytes.
+type exactReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.left -= int64(n)
+	if err == io.EOF && e.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// timeoutConn applies the timeout to every read, so a slow but steady
+// download is not cut off.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// histogram bucket upper bounds in milliseconds, the last bucket is open
+var bucketBounds = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+type LoadConfig struct {
+	Workers   int
+	Requests  int
+	Duration  time.Duration
+	KeepAlive bool
+}
+
+type LoadReport struct {
+	Target         string            `json:"target"`
+	Workers        int               `json:"workers"`
+	KeepAlive      bool              `json:"keep_alive"`
+	Requests       int               `json:"requests"`
+	Completed      int               `json:"completed"`
+	Failed         int               `json:"failed"`
+	Errors         int               `json:"errors"`
+	ErrorKinds     map[string]int    `json:"error_kinds,omitempty"`
+	Statuses       map[int]int       `json:"statuses"`
+	Connections    int               `json:"connections"`
+	Bytes          int64             `json:"bytes"`
+	Elapsed        float64           `json:"elapsed_seconds"`
+	RequestsPerSec float64           `json:"requests_per_second"`
+	BytesPerSec    float64           `json:"bytes_per_second"`
+	Latency        LatencyStats      `json:"latency_ms"`
+	Histogram      []HistogramBucket `json:"histogram"`
+}
+
+type LatencyStats struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+type HistogramBucket struct {
+	UpTo  float64 `json:"le_ms"` // +Inf is encoded as 0
+	Count int     `json:"count"`
+}
+
+// loadTest hands out request indexes to the workers until the request
+// count is reached or the deadline passes.
+type loadTest struct {
+	client   *Client
+	config   LoadConfig
+	requests []*Request
+	issued   int64
+	deadline time.Time
+}
+
+// workerResult is owned by one worker, results are merged at the end.
+type workerResult struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    map[string]int
+	bytes     int64
+	conns     int
+}
+
+// clientConn is a connection kept open between requests of a worker.
+type clientConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// loadPaths splits a comma-separated list, @file reads one path per line.
+func loadPaths(spec string) ([]string, error) {
+	raw := spec
+	sep := ","
+	if strings.HasPrefix(spec, "@") {
+		data, err := os.ReadFile(spec[1:])
+		if err != nil {
+			return nil, err
+		}
+		raw, sep = string(data), "\n"
+	}
+	var paths []string
+	for _, p := range strings.Split(raw, sep) {
+		if p = strings.TrimSpace(p); p != "" && !strings.HasPrefix(p, "#") {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no paths given")
+	}
+	return paths, nil
+}
+
+func runLoad(client *Client, base *Request, paths []string, config LoadConfig, asJSON bool) int {
+	requests := []*Request{base}
+	if len(paths) > 0 {
+		requests = requests[:0]
+		for _, p := range paths {
+			u, err := base.URL.Parse(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid path %q: %s\n", p, err.Error())
+				return exitFailure
+			}
+			req := *base
+			req.URL = u
+			requests = append(requests, &req)
+		}
+	}
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.Requests <= 0 && config.Duration <= 0 {
+		config.Duration = 10 * time.Second
+	}
+
+	l := &loadTest{client: client, config: config, requests: requests}
+	start := time.Now()
+	if config.Duration > 0 {
+		l.deadline = start.Add(config.Duration)
+	}
+
+	results := make([]*workerResult, config.Workers)
+	var wg sync.WaitGroup
+	for i := range results {
+		results[i] = &workerResult{statuses: make(map[int]int), errors: make(map[string]int)}
+		wg.Add(1)
+		go func(res *workerResult) {
+			defer wg.Done()
+			l.worker(res)
+		}(results[i])
+	}
+	wg.Wait()
+
+	report := newLoadReport(base.URL, config, results, time.Since(start))
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write report: %s\n", err.Error())
+			return exitFailure
+		}
+	} else {
+		report.print(os.Stdout)
+	}
+	if report.Completed == 0 {
+		return exitFailure
+	}
+	return exitOk
+}
+
+func (l *loadTest) next() (int, bool) {
+	if !l.deadline.IsZero() && !time.Now().Before(l.deadline) {
+		return 0, false
+	}
+	i := atomic.AddInt64(&l.issued, 1) - 1
+	if l.config.Requests > 0 && i >= int64(l.config.Requests) {
+		return 0, false
+	}
+	return int(i), true
+}
+
+func (l *loadTest) worker(res *workerResult) {
+	var cc *clientConn
+	defer func() {
+		if cc != nil {
+			_ = cc.conn.Close()
+		}
+	}()
+
+	for {
+		i, ok := l.next()
+		if !ok {
+			return
+		}
+		req := l.requests[i%len(l.requests)]
+
+		start := time.Now()
+		if cc == nil {
+			conn, err := l.client.dial(req.URL)
+			if err != nil {
+				res.errors[errorKind(err)]++
+				continue
+			}
+			conn = &timeoutConn{Conn: conn, timeout: l.client.Timeout}
+			cc = &clientConn{conn: conn, r: bufio.NewReaderSize(conn, BufCap), w: bufio.NewWriterSize(conn, BufCap)}
+			res.conns++
+		}
+
+		status, n, reuse, err := cc.do(req, l.config.KeepAlive)
+		if err != nil {
+			res.errors[errorKind(err)]++
+			_ = cc.conn.Close()
+			cc = nil
+			continue
+		}
+		res.latencies = append(res.latencies, time.Since(start))
+		res.statuses[status]++
+		res.bytes += n
+		if !reuse {
+			_ = cc.conn.Close()
+			cc = nil
+		}
+	}
+}
+
+// do sends one request and drains the response, reuse reports whether the
+// connection can carry the next request.
+func (cc *clientConn) do(req *Request, keepAlive bool) (status int, n int64, reuse bool, err error) {
+	if err = writeRequest(cc.w, req, keepAlive); err != nil {
+		return
+	}
+	if err = cc.w.Flush(); err != nil {
+		return
+	}
+	resp, err := readResponse(cc.r, req.Method)
+	if err != nil {
+		return
+	}
+	if n, err = io.Copy(io.Discard, resp.Body); err != nil {
+		return
+	}
+	if resp.gz != nil {
+		_ = resp.gz.Close()
+	}
+	reuse = keepAlive && resp.keepAlive()
+	return resp.Status, n, reuse, nil
+}
+
+// keepAlive tells whether the server left the connection open, a body
+// delimited by connection close never does.
+func (r *Response) keepAlive() bool {
+	if r.untilClose {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, opt := range strings.Split(v, ",") {
+			opt = strings.TrimSpace(opt)
+			if strings.EqualFold(opt, "close") {
+				return false
+			}
+			if strings.EqualFold(opt, "keep-alive") {
+				return true
+			}
+		}
+	}
+	return r.Proto == "HTTP/1.1"
+}
+
+func errorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "closed"
+	}
+	return "other"
+}
+
+func newLoadReport(target *url.URL, config LoadConfig, results []*workerResult, elapsed time.Duration) *LoadReport {
+	report := &LoadReport{
+		Target:     target.String(),
+		Workers:    config.Workers,
+		KeepAlive:  config.KeepAlive,
+		ErrorKinds: make(map[string]int),
+		Statuses:   make(map[int]int),
+		Elapsed:    elapsed.Seconds(),
+	}
+
+	var latencies []time.Duration
+	for _, res := range results {
+		latencies = append(latencies, res.latencies...)
+		for status, count := range res.statuses {
+			report.Statuses[status] += count
+			if status >= 400 {
+				report.Failed += count
+			}
+		}
+		for kind, count := range res.errors {
+			report.ErrorKinds[kind] += count
+			report.Errors += count
+		}
+		report.Bytes += res.bytes
+		report.Connections += res.conns
+	}
+	report.Completed = len(latencies)
+	report.Requests = report.Completed + report.Errors
+	if report.Elapsed > 0 {
+		report.RequestsPerSec = float64(report.Completed) / report.Elapsed
+		report.BytesPerSec = float64(report.Bytes) / report.Elapsed
+	}
+
+	report.Histogram = make([]HistogramBucket, len(bucketBounds)+1)
+	for i, bound := range bucketBounds {
+		report.Histogram[i].UpTo = bound
+	}
+	if len(latencies) == 0 {
+		return report
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, d := range latencies {
+		sum += d
+		ms := millis(d)
+		i := sort.SearchFloat64s(bucketBounds, ms)
+		report.Histogram[i].Count++
+	}
+	report.Latency = LatencyStats{
+		Min:  millis(latencies[0]),
+		Mean: millis(sum / time.Duration(len(latencies))),
+		P50:  millis(percentile(latencies, 50)),
+		P90:  millis(percentile(latencies, 90)),
+		P99:  millis(percentile(latencies, 99)),
+		Max:  millis(latencies[len(latencies)-1]),
+	}
+	return report
+}
+
+// percentile uses the nearest-rank method on sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *LoadReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Target:       %s\n", r.Target)
+	fmt.Fprintf(w, "Workers:      %d (keep-alive %v, %d connections)\n", r.Workers, r.KeepAlive, r.Connections)
+	fmt.Fprintf(w, "Requests:     %d completed, %d failed (4xx/5xx), %d errors in %.2fs\n",
+		r.Completed, r.Failed, r.Errors, r.Elapsed)
+	fmt.Fprintf(w, "Throughput:   %.1f req/s, %s/s\n", r.RequestsPerSec, formatSize(int64(r.BytesPerSec)))
+
+	codes := make([]int, 0, len(r.Statuses))
+	for code := range r.Statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  status %d:  %d\n", code, r.Statuses[code])
+	}
+	for kind, count := range r.ErrorKinds {
+		fmt.Fprintf(w, "  error %s:  %d\n", kind, count)
+	}
+	if r.Completed == 0 {
+		return
+	}
+
+	l := r.Latency
+	fmt.Fprintf(w, "Latency (ms): min %.2f, mean %.2f, p50 %.2f, p90 %.2f, p99 %.2f, max %.2f\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.Max)
+	peak := 0
+	for _, b := range r.Histogram {
+		if b.Count > peak {
+			peak = b.Count
+		}
+	}
+	for i, b := range r.Histogram {
+		label := fmt.Sprintf("<= %g ms", b.UpTo)
+		if i == len(r.Histogram)-1 {
+			label = fmt.Sprintf(">  %g ms", bucketBounds[len(bucketBounds)-1])
+		}
+		fmt.Fprintf(w, "  %-10s %7d %s\n", label, b.Count, strings.Repeat("#", b.Count*40/peak))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer is a test server that counts the connections it accepts.
+func countingServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *int64) {
+	var accepted int64
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&accepted, 1)
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts, &accepted
+}
+
+func TestLoadConnections(t *testing.T) {
+	const requests = 10
+	tests := []struct {
+		name      string
+		keepAlive bool
+		close     bool
+		want      int64
+	}{
+		{name: "keep-alive", keepAlive: true, want: 1},
+		{name: "no keep-alive", keepAlive: false, want: requests},
+		{name: "server closes", keepAlive: true, close: true, want: requests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, accepted := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.close {
+					w.Header().Set("Connection", "close")
+				}
+				_, _ = w.Write([]byte("hello"))
+			})
+			u, err := url.Parse(ts.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l := &loadTest{
+				client:   &Client{Timeout: 5 * time.Second},
+				config:   LoadConfig{Workers: 1, Requests: requests, KeepAlive: tt.keepAlive},
+				requests: []*Request{{Method: "GET", URL: u, Header: make(textproto.MIMEHeader)}},
+			}
+			res := &workerResult{statuses: make(map[int]int), errors: make(map[string]int)}
+			l.worker(res)
+
+			if res.statuses[200] != requests || len(res.errors) != 0 {
+				t.Fatalf("statuses %v, errors %v", res.statuses, res.errors)
+			}
+			if res.bytes != requests*int64(len("hello")) {
+				t.Errorf("read %d bytes", res.bytes)
+			}
+			if got := atomic.LoadInt64(accepted); got != tt.want {
+				t.Errorf("server accepted %d connections, want %d", got, tt.want)
+			}
+			if int64(res.conns) != tt.want {
+				t.Errorf("worker opened %d connections, want %d", res.conns, tt.want)
+			}
+		})
+	}
+}
@@ -1,50 +1,232 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// exit codes, a response is reported by its status class
+const (
+	exitOk          = 0
+	exitFailure     = 1
+	exitTooManyHops = 3
+	exitClientError = 4
+	exitServerError = 5
+)
+
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	if !strings.Contains(v, ":") {
+		return fmt.Errorf("header %q is not \"Name: value\"", v)
+	}
+	*h = append(*h, v)
+	return nil
+}
+
 func main() {
 	addrFlag := flag.String("h", "localhost", "http service address")
 	portFlag := flag.Int("p", 8080, "server port")
 	fileFlag := flag.String("f", "./", "file path")
+	methodFlag := flag.String("X", "GET", "request method")
+	var headers headerFlags
+	flag.Var(&headers, "H", "extra request header \"Name: value\", may be repeated")
+	dataFlag := flag.String("d", "", "request body, @file reads it from a file")
+	followFlag := flag.Bool("L", false, "follow redirects")
+	maxRedirsFlag := flag.Int("max-redirs", 10, "maximum number of redirects to follow")
+	outFlag := flag.String("o", "", "write the body to a file instead of stdout")
+	includeFlag := flag.Bool("i", false, "include the status line and headers in the output")
+	verboseFlag := flag.Bool("v", false, "print request and response headers to stderr")
+	silentFlag := flag.Bool("s", false, "do not show download progress")
+	compressedFlag := flag.Bool("compressed", false, "ask for a gzip response")
+	insecureFlag := flag.Bool("k", false, "skip TLS certificate verification")
+	timeoutFlag := flag.Duration("timeout", 30*time.Second, "connect and read timeout")
+	loadFlag := flag.Bool("load", false, "load-test the server instead of a single request")
+	workersFlag := flag.Int("c", 10, "load test: concurrent workers")
+	requestsFlag := flag.Int("n", 0, "load test: total requests, 0 to run for -duration")
+	durationFlag := flag.Duration("duration", 0, "load test: run time (default 10s without -n)")
+	pathsFlag := flag.String("paths", "", "load test: comma-separated paths or @file with one per line")
+	keepAliveFlag := flag.Bool("keepalive", true, "load test: reuse connections when the server allows")
+	jsonFlag := flag.Bool("json", false, "load test: print the report as JSON")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [url]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(), "\nExit status: 0 for 1xx-3xx, 4 for 4xx, 5 for 5xx, "+
+			"3 when the redirect limit is hit, 1 on other errors.")
+	}
 	flag.Parse()
-	if flag.NArg() != 0 {
+	if flag.NArg() > 1 {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitFailure)
 	}
 
-	runClient(*addrFlag, *portFlag, *fileFlag)
+	var target *url.URL
+	var err error
+	if flag.NArg() == 1 {
+		target, err = url.Parse(flag.Arg(0))
+		if err == nil && target.Scheme != "http" && target.Scheme != "https" {
+			err = fmt.Errorf("unsupported scheme %q", target.Scheme)
+		}
+	} else {
+		target = &url.URL{
+			Scheme: "http",
+			Host:   fmt.Sprintf("%s:%d", *addrFlag, *portFlag),
+			Path:   path.Clean("/" + *fileFlag),
+		}
+	}
+	if err != nil {
+		log.Fatalf("Invalid url: %s", err.Error())
+	}
+
+	req := &Request{Method: strings.ToUpper(*methodFlag), URL: target, Header: make(textproto.MIMEHeader)}
+	for _, h := range headers {
+		i := strings.IndexByte(h, ':')
+		req.Header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	if *dataFlag != "" {
+		if req.Body, err = readData(*dataFlag); err != nil {
+			log.Fatalf("Failed to read request body: %s", err.Error())
+		}
+		if req.Method == "GET" && !flagSet("X") {
+			req.Method = "POST"
+		}
+	}
+	if *compressedFlag && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	client := &Client{
+		Follow:       *followFlag,
+		MaxRedirects: *maxRedirsFlag,
+		Verbose:      *verboseFlag,
+		Timeout:      *timeoutFlag,
+		TLSConfig:    &tls.Config{InsecureSkipVerify: *insecureFlag},
+	}
+	if *loadFlag {
+		var paths []string
+		if *pathsFlag != "" {
+			if paths, err = loadPaths(*pathsFlag); err != nil {
+				log.Fatalf("Failed to read paths: %s", err.Error())
+			}
+		}
+		config := LoadConfig{
+			Workers:   *workersFlag,
+			Requests:  *requestsFlag,
+			Duration:  *durationFlag,
+			KeepAlive: *keepAliveFlag,
+		}
+		os.Exit(runLoad(client, req, paths, config, *jsonFlag))
+	}
+	os.Exit(runClient(client, req, *outFlag, *includeFlag, !*silentFlag))
+}
+
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-func runClient(host string, port int, filename string) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+func readData(data string) ([]byte, error) {
+	if strings.HasPrefix(data, "@") {
+		return os.ReadFile(data[1:])
+	}
+	return []byte(data), nil
+}
+
+func runClient(client *Client, req *Request, outName string, include, progress bool) int {
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("Failed to connect to server: %s", err.Error())
+		log.Printf("Request failed: %s", err.Error())
+		if errors.Is(err, errTooManyRedirects) {
+			return exitTooManyHops
+		}
+		return exitFailure
 	}
-	defer func(conn net.Conn) {
-		err := conn.Close()
+	defer func(resp *Response) {
+		if err := resp.Close(); err != nil {
+			log.Printf("Failed to close connection: %s", err.Error())
+		}
+	}(resp)
+
+	out := io.Writer(os.Stdout)
+	if outName != "" && outName != "-" {
+		file, err := os.Create(outName)
 		if err != nil {
-			log.Fatalf("Failed to close connection: %s", err.Error())
+			log.Printf("Failed to create output file: %s", err.Error())
+			return exitFailure
 		}
-	}(conn)
+		defer func(file *os.File) {
+			if err := file.Close(); err != nil {
+				log.Printf("Failed to close output file: %s", err.Error())
+			}
+		}(file)
+		out = file
+	} else {
+		progress = false
+	}
 
-	request := fmt.Sprintf("GET /%s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", filename, host)
-	_, err = conn.Write([]byte(request))
-	if err != nil {
-		log.Fatalf("Failed to send request: %s", err.Error())
+	w := bufio.NewWriter(out)
+	if include {
+		if err := resp.writeHead(w); err != nil {
+			log.Printf("Failed to write output: %s", err.Error())
+			return exitFailure
+		}
 	}
 
-	response, err := io.ReadAll(conn)
-	if err != nil {
-		log.Fatalf("Failed to read response: %s", err.Error())
+	body := resp.Body
+	if progress {
+		p := newProgress(os.Stderr, resp.ContentLength)
+		defer p.finish()
+		body = io.TeeReader(body, p)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Failed to read response: %s", err.Error())
+		return exitFailure
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("Failed to write output: %s", err.Error())
+		return exitFailure
 	}
+	return exitCode(resp.Status)
+}
 
-	fmt.Println(string(response))
+func exitCode(status int) int {
+	switch {
+	case status >= 500:
+		return exitServerError
+	case status >= 400:
+		return exitClientError
+	}
+	return exitOk
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + " MiB"
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', 1, 64) + " KiB"
+	}
+	return strconv.FormatInt(n, 10) + " B"
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const progressInterval = 100 * time.Millisecond
+
+// progress draws a single updating line with the downloaded size, the
+// percentage when the total is known, and the average rate.
+type progress struct {
+	out   io.Writer
+	total int64
+	done  int64
+	start time.Time
+	last  time.Time
+	width int
+}
+
+func newProgress(out io.Writer, total int64) *progress {
+	return &progress{out: out, total: total, start: time.Now()}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.draw(now)
+	}
+	return len(b), nil
+}
+
+func (p *progress) draw(now time.Time) {
+	line := formatSize(p.done)
+	if p.total > 0 {
+		line = fmt.Sprintf("%s / %s %3d%%", line, formatSize(p.total), p.done*100/p.total)
+	}
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		line += fmt.Sprintf("  %s/s", formatSize(int64(float64(p.done)/elapsed)))
+	}
+	// pad over the remains of a longer previous line
+	pad := p.width - len(line)
+	p.width = len(line)
+	if pad < 0 {
+		pad = 0
+	}
+	_, _ = fmt.Fprintf(p.out, "\r%s%s", line, strings.Repeat(" ", pad))
+}
+
+func (p *progress) finish() {
+	p.draw(time.Now())
+	_, _ = fmt.Fprintln(p.out)
+}
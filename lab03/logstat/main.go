@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Entry struct {
+	Path     string
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+	HasTime  bool
+}
+
+type jsonEntry struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// common/combined log line, the trailing duration in microseconds is written
+// by the lab03 server in timed format
+var clfLine = regexp.MustCompile(
+	`^(\S+) \S+ \S+ \[[^\]]+\] "((?:[^"\\]|\\.)*)" (\d{3}) (\S+)(?: "(?:[^"\\]|\\.)*" "(?:[^"\\]|\\.)*")?(?: (\d+))?\s*$`)
+
+func main() {
+	filesFlag := flag.String("f", "access.log", "comma-separated access log files")
+	topFlag := flag.Int("n", 10, "number of top paths to show")
+
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var entries []Entry
+	skipped := 0
+	for _, name := range strings.Split(*filesFlag, ",") {
+		parsed, bad, err := readLog(name)
+		if err != nil {
+			log.Fatalf("Error reading %s: %s", name, err.Error())
+		}
+		entries = append(entries, parsed...)
+		skipped += bad
+	}
+
+	printSummary(entries, skipped, *topFlag)
+}
+
+func readLog(name string) ([]Entry, int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func(file *os.File) {
+		if err := file.Close(); err != nil {
+			log.Printf("Error closing %s: %s", name, err.Error())
+		}
+	}(file)
+
+	var entries []Entry
+	skipped := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		entry, ok := parseLine(line)
+		if !ok {
+			skipped++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, skipped, scanner.Err()
+}
+
+func parseLine(line string) (Entry, bool) {
+	if strings.HasPrefix(line, "{") {
+		var je jsonEntry
+		if err := json.Unmarshal([]byte(line), &je); err != nil {
+			return Entry{}, false
+		}
+		return Entry{
+			Path:     stripQuery(je.Path),
+			Status:   je.Status,
+			Bytes:    je.Bytes,
+			Duration: time.Duration(je.DurationMs * float64(time.Millisecond)),
+			HasTime:  true,
+		}, true
+	}
+
+	m := clfLine.FindStringSubmatch(line)
+	if m == nil {
+		return Entry{}, false
+	}
+	entry := Entry{Path: "-"}
+	if parts := strings.Split(m[2], " "); len(parts) == 3 {
+		entry.Path = stripQuery(parts[1])
+	}
+	entry.Status, _ = strconv.Atoi(m[3])
+	if m[4] != "-" {
+		entry.Bytes, _ = strconv.ParseInt(m[4], 10, 64)
+	}
+	if m[5] != "" {
+		us, _ := strconv.ParseInt(m[5], 10, 64)
+		entry.Duration = time.Duration(us) * time.Microsecond
+		entry.HasTime = true
+	}
+	return entry, true
+}
+
+func stripQuery(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+func printSummary(entries []Entry, skipped, top int) {
+	var totalBytes int64
+	paths := make(map[string]int)
+	statuses := make(map[int]int)
+	var durations []time.Duration
+
+	for _, e := range entries {
+		totalBytes += e.Bytes
+		paths[e.Path]++
+		statuses[e.Status]++
+		if e.HasTime {
+			durations = append(durations, e.Duration)
+		}
+	}
+
+	fmt.Printf("Requests: %d, bytes sent: %d, unparsed lines: %d\n", len(entries), totalBytes, skipped)
+	if len(entries) == 0 {
+		return
+	}
+
+	fmt.Println("\nStatus distribution:")
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("  %d  %7d  %6.2f%%\n", code, statuses[code], percent(statuses[code], len(entries)))
+	}
+
+	fmt.Printf("\nTop %d paths:\n", top)
+	names := make([]string, 0, len(paths))
+	for p := range paths {
+		names = append(names, p)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if paths[names[i]] != paths[names[j]] {
+			return paths[names[i]] > paths[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	for i, p := range names {
+		if i == top {
+			break
+		}
+		fmt.Printf("  %7d  %s\n", paths[p], p)
+	}
+
+	fmt.Println("\nLatency:")
+	if len(durations) == 0 {
+		fmt.Println("  no durations in log (use timed or json format)")
+		return
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	fmt.Printf("  p50 %v  p90 %v  p99 %v  max %v\n",
+		percentile(durations, 50), percentile(durations, 90),
+		percentile(durations, 99), durations[len(durations)-1])
+}
+
+func percent(n, total int) float64 {
+	return float64(n) / float64(total) * 100
+}
+
+// percentile uses the nearest-rank method on sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
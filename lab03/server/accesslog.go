@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogFormat int
+
+const (
+	CommonLog LogFormat = iota
+	CombinedLog
+	// TimedLog is the Combined Log Format followed by the duration in
+	// microseconds, which standard parsers of the combined format reject
+	TimedLog
+	JSONLog
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+var accessLog *AccessLogger
+
+type AccessEntry struct {
+	Remote    string        `json:"remote"`
+	Time      time.Time     `json:"time"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Proto     string        `json:"proto"`
+	Host      string        `json:"host,omitempty"`
+	Status    int           `json:"status"`
+	Bytes     int           `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+type AccessLogger struct {
+	format LogFormat
+	mu     sync.Mutex
+	out    io.Writer
+}
+
+func parseLogFormat(s string) (LogFormat, error) {
+	switch s {
+	case "common", "clf":
+		return CommonLog, nil
+	case "combined":
+		return CombinedLog, nil
+	case "timed":
+		return TimedLog, nil
+	case "json":
+		return JSONLog, nil
+	default:
+		return 0, fmt.Errorf("unknown log format %q", s)
+	}
+}
+
+func NewAccessLogger(out io.Writer, format LogFormat) *AccessLogger {
+	return &AccessLogger{format: format, out: out}
+}
+
+func newAccessEntry(req *Request, remote string, start time.Time) AccessEntry {
+	entry := AccessEntry{Remote: remote, Time: start, Method: "-", Path: "-", Proto: "-"}
+	if h, _, err := net.SplitHostPort(remote); err == nil {
+		entry.Remote = h
+	}
+	if req != nil {
+		entry.Method = req.Method
+		entry.Path = req.Target
+		entry.Proto = req.Proto
+		entry.Host = req.Host
+		entry.Referer = req.Header.Get("Referer")
+		entry.UserAgent = req.Header.Get("User-Agent")
+	}
+	return entry
+}
+
+func (l *AccessLogger) Log(entry AccessEntry) {
+	var line string
+	switch l.format {
+	case JSONLog:
+		line = l.jsonLine(entry)
+	case CombinedLog:
+		line = l.combinedLine(entry)
+	case TimedLog:
+		line = fmt.Sprintf("%s %d", l.combinedLine(entry), entry.Duration.Microseconds())
+	default:
+		line = l.commonLine(entry)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.out, line+"\n"); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing access log - %s\n", err.Error())
+	}
+}
+
+func (l *AccessLogger) commonLine(e AccessEntry) string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.Itoa(e.Bytes)
+	}
+	request := "-"
+	if e.Method != "-" {
+		request = fmt.Sprintf("%s %s %s", e.Method, e.Path, e.Proto)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s",
+		e.Remote, e.Time.Format(clfTimeFormat), quoteField(request), e.Status, size)
+}
+
+func (l *AccessLogger) combinedLine(e AccessEntry) string {
+	return fmt.Sprintf("%s %s %s", l.commonLine(e), quoteField(e.Referer), quoteField(e.UserAgent))
+}
+
+func (l *AccessLogger) jsonLine(e AccessEntry) string {
+	raw, err := json.Marshal(struct {
+		AccessEntry
+		DurationMs float64 `json:"duration_ms"`
+	}{e, float64(e.Duration.Microseconds()) / 1000})
+	if err != nil {
+		return "{}"
+	}
+	return string(raw)
+}
+
+func quoteField(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// RotatingFile is an append-only log file that is renamed to name.1 when it
+// grows over maxSize, older copies shift up to name.<backups>.
+type RotatingFile struct {
+	name    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenRotatingFile(name string, maxSize int64, backups int) (*RotatingFile, error) {
+	rf := &RotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		rotateErr = rf.rotate()
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate reopens the log file even when the backups could not be shifted,
+// the log then goes on in the same file and the rotation is retried on the
+// next write.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	if errors.Is(err, os.ErrClosed) {
+		// left closed by a rotation that could not reopen the file
+		err = nil
+	}
+	if serr := rf.shift(); err == nil {
+		err = serr
+	}
+	if oerr := rf.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (rf *RotatingFile) shift() error {
+	if rf.backups > 0 {
+		for i := rf.backups - 1; i > 0; i-- {
+			from := fmt.Sprintf("%s.%d", rf.name, i)
+			if _, err := os.Stat(from); err == nil {
+				if err := os.Rename(from, fmt.Sprintf("%s.%d", rf.name, i+1)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.Rename(rf.name, rf.name+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.name); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxCacheEntry   = 16 << 20
+	heuristicMaxAge = 24 * time.Hour
+)
+
+// DiskCache stores origin responses as <key>.meta (JSON) and <key>.body
+// files, the key is the SHA-256 of the absolute URL.
+type DiskCache struct {
+	dir string
+}
+
+type CacheEntry struct {
+	URL          string               `json:"url"`
+	Status       int                  `json:"status"`
+	Header       textproto.MIMEHeader `json:"header"`
+	StoredAt     time.Time            `json:"stored_at"`
+	Expires      time.Time            `json:"expires"`
+	ETag         string               `json:"etag,omitempty"`
+	LastModified string               `json:"last_modified,omitempty"`
+	NoCache      bool                 `json:"no_cache,omitempty"`
+
+	Body []byte `json:"-"`
+}
+
+type cacheControl map[string]string
+
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+func (c *DiskCache) path(url, ext string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+ext)
+}
+
+func (c *DiskCache) Load(url string) (*CacheEntry, bool) {
+	raw, err := os.ReadFile(c.path(url, ".meta"))
+	if err != nil {
+		return nil, false
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil || entry.URL != url {
+		return nil, false
+	}
+	if entry.Body, err = os.ReadFile(c.path(url, ".body")); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Store writes the body before the metadata, each through a temporary file
+// and a rename, so a reader never sees a half-written entry.
+func (c *DiskCache) Store(entry *CacheEntry) error {
+	if err := writeFileAtomic(c.path(entry.URL, ".body"), entry.Body); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(entry.URL, ".meta"), raw)
+}
+
+func (c *DiskCache) Delete(url string) {
+	_ = os.Remove(c.path(url, ".meta"))
+	_ = os.Remove(c.path(url, ".body"))
+}
+
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func parseCacheControl(values []string) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range values {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func isCacheableStatus(status int) bool {
+	switch status {
+	case 200, 203, 300, 301, 404, 410:
+		return true
+	}
+	return false
+}
+
+// newCacheEntry decides whether resp may be stored for a shared cache and
+// computes its freshness lifetime, it returns nil for uncacheable responses.
+func newCacheEntry(url string, req *Request, resp *Response, body []byte) *CacheEntry {
+	if req.Method != "GET" || !isCacheableStatus(resp.Status) {
+		return nil
+	}
+	reqCC := parseCacheControl(req.Header.Values("Cache-Control"))
+	cc := parseCacheControl(resp.Header.Values("Cache-Control"))
+	if reqCC.has("no-store") || cc.has("no-store") || cc.has("private") {
+		return nil
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") {
+		return nil
+	}
+	if resp.Header.Get("Vary") != "" || resp.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	now := time.Now()
+	entry := &CacheEntry{
+		URL:          url,
+		Status:       resp.Status,
+		Header:       cloneHeader(resp.Header),
+		StoredAt:     now,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		NoCache:      cc.has("no-cache") || cc.has("must-revalidate") && !cc.has("max-age"),
+		Body:         body,
+	}
+	entry.Header.Del("Set-Cookie")
+	entry.Expires = now.Add(freshnessLifetime(resp.Header, cc, now))
+
+	if !entry.Expires.After(now) && entry.ETag == "" && entry.LastModified == "" {
+		return nil
+	}
+	return entry
+}
+
+func freshnessLifetime(header textproto.MIMEHeader, cc cacheControl, now time.Time) time.Duration {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date := now
+	if t, err := time.Parse(timeFormat, header.Get("Date")); err == nil {
+		date = t
+	}
+	if v := header.Get("Expires"); v != "" {
+		t, err := time.Parse(timeFormat, v)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+	// heuristic freshness: 10% of the time since the last modification
+	if t, err := time.Parse(timeFormat, header.Get("Last-Modified")); err == nil && date.After(t) {
+		d := date.Sub(t) / 10
+		if d > heuristicMaxAge {
+			d = heuristicMaxAge
+		}
+		return d
+	}
+	return 0
+}
+
+func (e *CacheEntry) fresh(req *Request, now time.Time) bool {
+	if e.NoCache {
+		return false
+	}
+	reqCC := parseCacheControl(req.Header.Values("Cache-Control"))
+	if reqCC.has("no-cache") || req.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	expires := e.Expires
+	if d, ok := reqCC.seconds("max-age"); ok && e.StoredAt.Add(d).Before(expires) {
+		expires = e.StoredAt.Add(d)
+	}
+	return now.Before(expires)
+}
+
+func (e *CacheEntry) canRevalidate() bool {
+	return e.ETag != "" || e.LastModified != ""
+}
+
+// refresh updates the stored entry after a 304 from the origin.
+func (e *CacheEntry) refresh(resp *Response) {
+	for _, key := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified"} {
+		if v := resp.Header.Values(key); len(v) > 0 {
+			e.Header[key] = v
+		}
+	}
+	now := time.Now()
+	e.StoredAt = now
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		e.ETag = etag
+	}
+	cc := parseCacheControl(e.Header.Values("Cache-Control"))
+	e.Expires = now.Add(freshnessLifetime(e.Header, cc, now))
+}
+
+func (e *CacheEntry) response(cacheStatus string) *Response {
+	resp := newResponse(e.Status, e.Body)
+	resp.Header = cloneHeader(e.Header)
+	resp.Header.Set("Age", strconv.Itoa(int(time.Since(e.StoredAt).Seconds())))
+	resp.Header.Set("X-Cache", cacheStatus)
+	return resp
+}
@@ -0,0 +1,15 @@
+#!/bin/sh
+# Echoes the CGI environment and the request body.
+echo "Content-Type: text/plain; charset=utf-8"
+echo
+echo "method: $REQUEST_METHOD"
+echo "script: $SCRIPT_NAME"
+echo "path info: $PATH_INFO"
+echo "query: $QUERY_STRING"
+echo "remote: $REMOTE_ADDR"
+echo "user agent: $HTTP_USER_AGENT"
+if [ -n "$CONTENT_LENGTH" ]; then
+	echo "body:"
+	head -c "$CONTENT_LENGTH"
+	echo
+fi
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCGITimeout   = 10 * time.Second
+	defaultCGIMaxOutput = 4 << 20
+	maxCGIStderr        = 4096
+)
+
+type CGIConfig struct {
+	Prefix    string `json:"prefix"`
+	Dir       string `json:"dir"`
+	Timeout   string `json:"timeout"`
+	MaxOutput int64  `json:"max_output"`
+}
+
+// CGIRoute runs executables from Dir for request paths under Prefix, the
+// first path segment after the prefix names the script and the rest is
+// passed as PATH_INFO.
+type CGIRoute struct {
+	Prefix    string
+	Dir       string
+	Timeout   time.Duration
+	MaxOutput int64
+}
+
+var errOutputTooLarge = errors.New("script output too large")
+
+// environment variables that are always passed to scripts
+var cgiInheritEnv = []string{"PATH", "LANG", "TZ", "SYSTEMROOT"}
+
+func newCGIRoute(cc CGIConfig, base string) (*CGIRoute, error) {
+	if !strings.HasPrefix(cc.Prefix, "/") {
+		return nil, fmt.Errorf("cgi prefix must start with /")
+	}
+	route := &CGIRoute{
+		Prefix:    strings.TrimSuffix(cc.Prefix, "/") + "/",
+		Dir:       resolveConfigPath(base, cc.Dir),
+		MaxOutput: cc.MaxOutput,
+	}
+	if info, err := os.Stat(route.Dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("cgi dir %s is not a directory", route.Dir)
+	}
+	// scripts run in their own directory, a relative path would not resolve
+	var err error
+	if route.Dir, err = filepath.Abs(route.Dir); err != nil {
+		return nil, err
+	}
+	if route.Timeout, err = parseDuration(cc.Timeout, defaultCGITimeout); err != nil {
+		return nil, err
+	}
+	if route.MaxOutput <= 0 {
+		route.MaxOutput = defaultCGIMaxOutput
+	}
+	return route, nil
+}
+
+func (c *CGIRoute) match(urlPath string) bool {
+	return strings.HasPrefix(urlPath, c.Prefix)
+}
+
+// script splits the request path into the script name and path info.
+func (c *CGIRoute) script(urlPath string) (name, scriptName, pathInfo string, err error) {
+	rest := strings.TrimPrefix(urlPath, c.Prefix)
+	base := rest
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		base, pathInfo = rest[:i], rest[i:]
+	}
+	if base == "" || base == "." || base == ".." || strings.HasPrefix(base, ".") || strings.ContainsAny(base, "\x00\\") {
+		return "", "", "", os.ErrNotExist
+	}
+	name = filepath.Join(c.Dir, base)
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", "", "", err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "", "", "", errForbidden
+	}
+	return name, c.Prefix + base, pathInfo, nil
+}
+
+func (c *CGIRoute) serve(root string, req *Request) *Response {
+	name, scriptName, pathInfo, err := c.script(req.URL.Path)
+	if err != nil {
+		return fileErrorResponse(err)
+	}
+
+	// CGI needs CONTENT_LENGTH up front, so a chunked body is buffered
+	var body []byte
+	if req.ContentLength > 0 || req.Chunked {
+		if body, err = io.ReadAll(req.Body); err != nil {
+			log.Printf("Error reading request body - %s", err.Error())
+			return errorResponse(statusOf(err))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name)
+	cmd.Dir = filepath.Dir(name)
+	cmd.Env = cgiEnv(root, req, scriptName, pathInfo, name, len(body))
+	cmd.Stdin = bytes.NewReader(body)
+	// a script that forks a child holding stdout open must not block us
+	cmd.WaitDelay = time.Second
+
+	stdout := &cappedBuffer{max: c.MaxOutput}
+	stderr := &cappedBuffer{max: maxCGIStderr, truncate: true}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if stderr.buf.Len() > 0 {
+		log.Printf("CGI %s stderr - %s", scriptName, strings.TrimSpace(stderr.buf.String()))
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		log.Printf("CGI %s timed out after %v", scriptName, c.Timeout)
+		return errorResponse(504)
+	case stdout.exceeded:
+		log.Printf("CGI %s - %s", scriptName, errOutputTooLarge.Error())
+		return errorResponse(502)
+	case err != nil:
+		log.Printf("CGI %s failed - %s", scriptName, err.Error())
+		return errorResponse(502)
+	}
+
+	resp, err := parseCGIResponse(stdout.buf.Bytes())
+	if err != nil {
+		log.Printf("CGI %s - %s", scriptName, err.Error())
+		return errorResponse(502)
+	}
+	return resp
+}
+
+// cgiEnv builds the meta-variables of RFC 3875 section 4.1.
+func cgiEnv(root string, req *Request, scriptName, pathInfo, fileName string, contentLength int) []string {
+	host, port := req.Host, "80"
+	if h, p, err := net.SplitHostPort(req.Host); err == nil {
+		host, port = h, p
+	}
+	remoteHost, remotePort := req.RemoteAddr, ""
+	if h, p, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		remoteHost, remotePort = h, p
+	}
+
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=" + serverName,
+		"SERVER_NAME=" + host,
+		"SERVER_PORT=" + port,
+		"SERVER_PROTOCOL=" + req.Proto,
+		"REQUEST_METHOD=" + req.Method,
+		"REQUEST_URI=" + req.URL.RequestURI(),
+		"QUERY_STRING=" + req.URL.RawQuery,
+		"SCRIPT_NAME=" + scriptName,
+		"SCRIPT_FILENAME=" + fileName,
+		"PATH_INFO=" + pathInfo,
+		"DOCUMENT_ROOT=" + root,
+		"REMOTE_ADDR=" + remoteHost,
+		"REMOTE_HOST=" + remoteHost,
+		"REMOTE_PORT=" + remotePort,
+	}
+	if pathInfo != "" {
+		env = append(env, "PATH_TRANSLATED="+filepath.Join(root, filepath.FromSlash(path.Clean(pathInfo))))
+	}
+	if contentLength > 0 {
+		env = append(env, "CONTENT_LENGTH="+strconv.Itoa(contentLength))
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		env = append(env, "CONTENT_TYPE="+ct)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if i := strings.IndexByte(auth, ' '); i > 0 {
+			env = append(env, "AUTH_TYPE="+auth[:i])
+		}
+	}
+
+	for key, values := range req.Header {
+		switch key {
+		// credentials stay with the server, and HTTP_PROXY would be
+		// mistaken for a proxy setting by many scripts
+		case "Authorization", "Proxy-Authorization", "Proxy", "Content-Type", "Content-Length":
+			continue
+		}
+		name := "HTTP_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		env = append(env, name+"="+strings.Join(values, ", "))
+	}
+	for _, key := range cgiInheritEnv {
+		if v, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+v)
+		}
+	}
+	return env
+}
+
+// parseCGIResponse reads the header block of the script output, a Status
+// header sets the code and a Location without one is a redirect.
+func parseCGIResponse(out []byte) (*Response, error) {
+	src := bytes.NewReader(out)
+	r := bufio.NewReader(src)
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("malformed script headers: %w", err)
+	}
+	if len(header) == 0 {
+		return nil, errors.New("script sent no headers")
+	}
+
+	status := 200
+	if v := header.Get("Status"); v != "" {
+		code, err := strconv.Atoi(strings.Fields(v)[0])
+		if err != nil || code < 200 || code > 599 {
+			return nil, fmt.Errorf("malformed Status %q", v)
+		}
+		status = code
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = 302
+	} else if header.Get("Content-Type") == "" {
+		return nil, errors.New("script sent no Content-Type")
+	}
+	removeHopHeaders(header)
+	header.Del("Content-Length")
+
+	body := out[len(out)-src.Len()-r.Buffered():]
+	resp := newResponse(status, body)
+	resp.Header = header
+	return resp, nil
+}
+
+// cappedBuffer fails writes past max, or silently drops them with truncate.
+// It does not embed bytes.Buffer so that io.Copy cannot bypass Write
+// through ReadFrom.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	truncate bool
+	exceeded bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if left := b.max - int64(b.buf.Len()); int64(len(p)) > left {
+		if !b.truncate {
+			b.exceeded = true
+			return 0, errOutputTooLarge
+		}
+		if left > 0 {
+			b.buf.Write(p[:left])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
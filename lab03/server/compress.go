@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var compressThreshold = 1024
+
+// precompressed siblings are looked up as "<file><ext>", brotli is only
+// served from disk since there is no encoder in the standard library
+var precompressed = []struct {
+	coding string
+	ext    string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptedEncodings returns codings from Accept-Encoding with non-zero
+// quality, most preferred first. "*" stands for the codings the server has
+// that are not listed, so an explicit q=0 excludes a coding even then.
+func acceptedEncodings(header string) []string {
+	type coding struct {
+		name string
+		q    float64
+	}
+	var codings []coding
+	listed := make(map[string]bool)
+	starQ := 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		listed[name] = true
+		if name == "*" {
+			starQ = q
+		} else if q > 0 {
+			codings = append(codings, coding{name, q})
+		}
+	}
+	if starQ > 0 {
+		for _, p := range precompressed {
+			if !listed[p.coding] {
+				codings = append(codings, coding{p.coding, starQ})
+			}
+		}
+	}
+	sort.SliceStable(codings, func(i, j int) bool {
+		return codings[i].q > codings[j].q
+	})
+
+	names := make([]string, 0, len(codings))
+	for _, c := range codings {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func acceptsEncoding(accepted []string, coding string) bool {
+	for _, a := range accepted {
+		if a == coding {
+			return true
+		}
+	}
+	return false
+}
+
+// findPrecompressed returns the first sibling of name that is encoded with
+// a coding the client accepts.
+func findPrecompressed(name string, accepted []string) (string, string) {
+	for _, a := range accepted {
+		for _, p := range precompressed {
+			if a != p.coding {
+				continue
+			}
+			// Lstat so that a symlinked sibling cannot leave the document root
+			if info, err := os.Lstat(name + p.ext); err == nil && info.Mode().IsRegular() {
+				return name + p.ext, p.coding
+			}
+		}
+	}
+	return "", ""
+}
+
+func isCompressible(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	for _, t := range []string{"json", "javascript", "xml", "svg", "wasm"} {
+		if strings.Contains(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,908 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	maxEvents     = 256
+	loopTick      = 100 * time.Millisecond
+	readChunk     = 64 << 10
+	maxPendingOut = 1 << 20
+)
+
+// eventLoop serves connections with non-blocking sockets on one goroutine.
+// Every loop waits on the shared listening socket with EPOLLEXCLUSIVE, so
+// the kernel wakes only one of them per incoming connection. Handlers run
+// on the loop itself, except for the requests Server.Blocking picks: those
+// run on a goroutine that posts the response back through wakefd, so a
+// slow upstream or script does not hold up the other connections. A
+// connection leaves its loop for a goroutine when it is upgraded or gets
+// a streamed response, which could block the loop as well.
+type eventLoop struct {
+	s       *Server
+	handler Handler
+	epfd    int
+	lfd     int
+	conns   map[int]*evConn
+	buf     []byte
+
+	accepting bool
+	// stopped is called once the loop no longer watches lfd
+	stopped func()
+
+	// mu guards the responses of blocking handlers until the loop takes
+	// them, wakefd is an eventfd signalled for each and -1 once closed
+	mu      sync.Mutex
+	wakefd  int
+	results []*offloaded
+}
+
+// offloaded is a request served on a goroutine and its response.
+type offloaded struct {
+	c     *evConn
+	req   *Request
+	resp  *Response
+	start time.Time
+}
+
+type evConn struct {
+	fd     int
+	ip     string
+	remote string
+
+	in  []byte
+	out []byte
+	// need is the buffered length below which parsing is not retried
+	need      int
+	continued bool
+	parser    bufferedParser
+
+	served          int
+	eof             bool
+	closeAfterWrite bool
+	// busy is set while a blocking handler serves the current request
+	busy      bool
+	wantWrite bool
+	// events is the epoll interest set of fd
+	events uint32
+
+	idleSince  time.Time
+	reqStart   time.Time
+	writeSince time.Time
+}
+
+// incompleteError means the buffer holds only part of a request.
+type incompleteError struct {
+	need           int
+	expectContinue bool
+}
+
+func (e *incompleteError) Error() string {
+	return "incomplete request"
+}
+
+var errNotTCP = errors.New("not a TCP listener")
+
+// runEventLoops serves listener with s.Loops epoll loops until Shutdown,
+// listeners that do not expose a socket, such as TLS, return an error.
+func (s *Server) runEventLoops(listener net.Listener, handler Handler) error {
+	tl, ok := listener.(*net.TCPListener)
+	if !ok {
+		return errNotTCP
+	}
+	file, err := tl.File()
+	if err != nil {
+		return err
+	}
+	lfd := int(file.Fd())
+	if err := unix.SetNonblock(lfd, true); err != nil {
+		closeListenerFile(file)
+		return err
+	}
+
+	n := s.Loops
+	if n < 1 {
+		n = 1
+	}
+	// the duplicate keeps the socket listening after Shutdown closed the
+	// listener, it is closed as soon as no loop accepts on it any more so
+	// new clients are refused instead of waiting in the backlog
+	var accepting sync.WaitGroup
+	accepting.Add(n)
+	loops := make([]*eventLoop, 0, n)
+	for i := 0; i < n; i++ {
+		loop, err := newEventLoop(s, handler, lfd, accepting.Done)
+		if err != nil {
+			for _, l := range loops {
+				_ = unix.Close(l.epfd)
+			}
+			closeListenerFile(file)
+			return err
+		}
+		loops = append(loops, loop)
+	}
+	go func() {
+		accepting.Wait()
+		closeListenerFile(file)
+	}()
+	log.Printf("Running %d event loops on %v", n, listener.Addr())
+
+	var wg sync.WaitGroup
+	for _, loop := range loops {
+		wg.Add(1)
+		go func(loop *eventLoop) {
+			defer wg.Done()
+			loop.run()
+		}(loop)
+	}
+	wg.Wait()
+	return nil
+}
+
+func closeListenerFile(file *os.File) {
+	if err := file.Close(); err != nil {
+		log.Printf("Error closing listener - %s", err.Error())
+	}
+}
+
+func newEventLoop(s *Server, handler Handler, lfd int, stopped func()) (*eventLoop, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	wakefd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+	for _, ev := range []unix.EpollEvent{
+		{Events: unix.EPOLLIN | unix.EPOLLEXCLUSIVE, Fd: int32(lfd)},
+		{Events: unix.EPOLLIN, Fd: int32(wakefd)},
+	} {
+		if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, int(ev.Fd), &ev); err != nil {
+			_ = unix.Close(wakefd)
+			_ = unix.Close(epfd)
+			return nil, err
+		}
+	}
+	return &eventLoop{
+		s:         s,
+		handler:   handler,
+		epfd:      epfd,
+		lfd:       lfd,
+		stopped:   stopped,
+		conns:     make(map[int]*evConn),
+		buf:       make([]byte, readChunk),
+		accepting: true,
+		wakefd:    wakefd,
+	}, nil
+}
+
+func (l *eventLoop) run() {
+	defer func() {
+		l.stopAccepting()
+		l.closeWake()
+		if err := unix.Close(l.epfd); err != nil {
+			log.Printf("Error closing epoll - %s", err.Error())
+		}
+	}()
+
+	events := make([]unix.EpollEvent, maxEvents)
+	for {
+		if l.s.isClosing() {
+			if atomic.LoadInt32(&l.s.expired) == 1 {
+				l.forceClose()
+			}
+			l.drain()
+			if len(l.conns) == 0 {
+				return
+			}
+		}
+
+		n, err := unix.EpollWait(l.epfd, events, int(loopTick/time.Millisecond))
+		if err != nil && err != unix.EINTR {
+			log.Printf("Error waiting for events - %s", err.Error())
+			l.closeAll()
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			// once lfd is closed its number may be reused by a connection
+			if fd == l.lfd && l.accepting {
+				l.accept()
+				continue
+			}
+			if fd == l.wakefd {
+				l.collect()
+				continue
+			}
+			c, ok := l.conns[fd]
+			if !ok {
+				continue
+			}
+			ev := events[i].Events
+			if ev&(unix.EPOLLIN|unix.EPOLLRDHUP|unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+				l.read(c)
+			}
+			if ev&unix.EPOLLOUT != 0 && l.conns[fd] == c {
+				l.flush(c)
+				if l.conns[fd] == c && len(c.out) == 0 && len(c.in) > 0 {
+					l.process(c)
+				}
+			}
+		}
+		l.sweep(time.Now())
+	}
+}
+
+func (l *eventLoop) accept() {
+	for {
+		fd, sa, err := unix.Accept4(l.lfd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		if err != nil {
+			switch err {
+			case unix.EAGAIN, unix.EINTR, unix.ECONNABORTED:
+			default:
+				atomic.AddInt64(&l.s.stats.acceptErrors, 1)
+				log.Printf("Error accepting - %s", err.Error())
+			}
+			return
+		}
+		remote := sockaddrString(sa)
+		log.Printf("Accepted connection %s\n", remote)
+
+		ip := remote
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			ip = host
+		}
+		if !l.s.acquireIP(ip) {
+			atomic.AddInt64(&l.s.stats.rejected, 1)
+			log.Printf("Too many connections from %s\n", remote)
+			// a fresh socket buffer always has room for the short response
+			if _, err := unix.Write(fd, serializeResponse(nil, rejectResponse(), false)); err != nil {
+				log.Printf("Error writing response - %s", err.Error())
+			}
+			_ = unix.Close(fd)
+			continue
+		}
+
+		if !l.s.addConn() {
+			l.s.releaseIP(ip)
+			_ = unix.Close(fd)
+			return
+		}
+
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
+			log.Printf("Error setting TCP_NODELAY - %s", err.Error())
+		}
+		ev := unix.EpollEvent{Events: readEvents, Fd: int32(fd)}
+		if err := unix.EpollCtl(l.epfd, unix.EPOLL_CTL_ADD, fd, &ev); err != nil {
+			log.Printf("Error watching connection - %s", err.Error())
+			l.s.releaseIP(ip)
+			_ = unix.Close(fd)
+			l.s.wg.Done()
+			continue
+		}
+		l.conns[fd] = &evConn{fd: fd, ip: ip, remote: remote, idleSince: time.Now(), events: readEvents}
+		atomic.AddInt64(&l.s.stats.accepted, 1)
+		l.s.addInFlight()
+	}
+}
+
+func (l *eventLoop) read(c *evConn) {
+	for !c.inputFull() {
+		n, err := unix.Read(c.fd, l.buf)
+		if n > 0 {
+			if len(c.in) == 0 && c.reqStart.IsZero() {
+				c.reqStart = time.Now()
+			}
+			c.in = append(c.in, l.buf[:n]...)
+			continue
+		}
+		if err == unix.EAGAIN {
+			break
+		}
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			l.s.connError("Error reading request", err)
+			l.closeConn(c)
+			return
+		}
+		c.eof = true
+	}
+
+	l.process(c)
+	if l.conns[c.fd] != c || !c.eof {
+		return
+	}
+	// the client is gone, a partial request left in the buffer is dropped
+	if !l.s.isClosing() && len(c.in) > 0 && len(c.out) == 0 {
+		log.Printf("Connection %s closed mid-request", c.remote)
+	}
+	if len(c.out) == 0 && !c.busy {
+		l.closeConn(c)
+		return
+	}
+	// the response is still written, the socket stops reporting the end
+	// of its input meanwhile
+	c.closeAfterWrite = true
+	c.in = nil
+	l.watch(c)
+}
+
+// process answers every complete request in the input buffer, pausing
+// while too much output is pending. Reading stops meanwhile, so a client
+// that does not read its responses cannot make the server buffer without
+// bound.
+func (l *eventLoop) process(c *evConn) {
+	for len(c.in) > 0 && len(c.in) >= c.need && len(c.out) < maxPendingOut && !c.closeAfterWrite && !c.busy {
+		start := c.reqStart
+		if start.IsZero() {
+			start = time.Now()
+		}
+
+		if c.served == 0 && h2cEnabled && bytes.HasPrefix([]byte(h2Preface), c.in[:min(len(c.in), len(h2Preface))]) {
+			// a client with prior knowledge of HTTP/2 gets its own goroutine
+			if len(c.in) < len(h2Preface) {
+				c.need = len(h2Preface)
+				break
+			}
+			l.handoff(c, &Response{Upgrade: func(conn net.Conn, rw *bufio.ReadWriter) {
+				l.s.serveH2(conn, rw, l.handler, nil, nil)
+			}})
+			return
+		}
+
+		req, consumed, err := c.parser.parse(c.in)
+		var inc *incompleteError
+		if errors.As(err, &inc) {
+			c.need = inc.need
+			if inc.expectContinue && !c.continued {
+				c.continued = true
+				c.out = append(c.out, "HTTP/1.1 100 Continue"+crlf+crlf...)
+			}
+			break
+		}
+		if err != nil {
+			l.s.connError("Error parsing request", err)
+			resp := errorResponse(statusOf(err))
+			l.queue(c, nil, resp, false)
+			logAccess(nil, resp, c.remote, start)
+			c.closeAfterWrite = true
+			break
+		}
+
+		c.in = c.in[consumed:]
+		c.need = 0
+		c.continued = false
+		c.served++
+		req.RemoteAddr = c.remote
+
+		if l.s.Blocking != nil && l.s.Blocking(req) {
+			l.offload(c, req, start)
+			break
+		}
+		if !l.respond(c, req, l.handler(req), start) {
+			return
+		}
+	}
+	if len(c.in) == 0 {
+		c.in = nil
+		c.reqStart = time.Time{}
+		c.idleSince = time.Now()
+	}
+	l.flush(c)
+}
+
+// respond queues the response to a request of c, it reports false when the
+// connection was closed or left the loop.
+func (l *eventLoop) respond(c *evConn, req *Request, resp *Response, start time.Time) bool {
+	atomic.AddInt64(&l.s.stats.requests, 1)
+	keepAlive := shouldKeepAlive(req) && canKeepAlive(req, resp) &&
+		c.served < maxRequestsPerConn && !l.s.isClosing()
+
+	if resp.Stream != nil {
+		// reading a stream may block on its source, the connection
+		// goes on with the blocking path
+		l.handoff(c, &Response{Upgrade: l.writeStream(req, resp, keepAlive, c.served, start), Done: resp.finish})
+		return false
+	}
+	n, err := l.queue(c, req, resp, keepAlive)
+	if err != nil || resp.Upgrade == nil {
+		resp.finish()
+	}
+	if err != nil {
+		l.s.connError("Error writing response", err)
+		l.closeConn(c)
+		return false
+	}
+	log.Printf("%s %s %s - %d, written response: %d bytes", req.Method, req.Target, req.Proto, resp.Status, n)
+	logAccess(req, resp, req.RemoteAddr, start)
+
+	if resp.Upgrade != nil {
+		l.handoff(c, resp)
+		return false
+	}
+	if !keepAlive {
+		c.closeAfterWrite = true
+	}
+	c.reqStart = time.Time{}
+	if len(c.in) > 0 {
+		c.reqStart = time.Now()
+	}
+	return true
+}
+
+// offload runs the handler of a blocking request on a goroutine, the
+// connection keeps its place in the loop but reads no further requests
+// until the response is posted back.
+func (l *eventLoop) offload(c *evConn, req *Request, start time.Time) {
+	c.busy = true
+	go func() {
+		l.post(&offloaded{c: c, req: req, resp: l.handler(req), start: start})
+	}()
+}
+
+func (l *eventLoop) post(o *offloaded) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.wakefd < 0 {
+		// the loop is gone and so is the connection
+		o.resp.finish()
+		return
+	}
+	l.results = append(l.results, o)
+	one := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := unix.Write(l.wakefd, one); err != nil && err != unix.EAGAIN {
+		log.Printf("Error waking event loop - %s", err.Error())
+	}
+}
+
+// collect answers the requests whose blocking handlers have returned and
+// goes on with the requests their clients pipelined meanwhile.
+func (l *eventLoop) collect() {
+	var counter [8]byte
+	if _, err := unix.Read(l.wakefd, counter[:]); err != nil && err != unix.EAGAIN {
+		log.Printf("Error reading event loop wakeup - %s", err.Error())
+	}
+	l.mu.Lock()
+	results := l.results
+	l.results = nil
+	l.mu.Unlock()
+
+	for _, o := range results {
+		c := o.c
+		c.busy = false
+		if l.conns[c.fd] != c {
+			// closed while its handler ran, e.g. by a forced shutdown
+			o.resp.finish()
+			continue
+		}
+		if l.respond(c, o.req, o.resp, o.start) {
+			l.process(c)
+		}
+	}
+}
+
+func (l *eventLoop) closeWake() {
+	l.mu.Lock()
+	results := l.results
+	l.results = nil
+	if err := unix.Close(l.wakefd); err != nil {
+		log.Printf("Error closing event loop wakeup - %s", err.Error())
+	}
+	l.wakefd = -1
+	l.mu.Unlock()
+	for _, o := range results {
+		o.resp.finish()
+	}
+}
+
+// maxHeadBytes is the most a request head can take before the parser
+// fails it, with an empty line before the request line.
+const maxHeadBytes = 2 + MaxRequestLine + 2 + MaxHeaderBytes
+
+// bufferedParser parses requests from the input buffer of a connection as
+// it grows. The head is parsed once its end has arrived and a chunked body
+// is decoded chunk by chunk, so a request that comes in many reads is not
+// parsed again from its start on every one of them.
+type bufferedParser struct {
+	// scanned is how much of the buffer was searched for the end of the head
+	scanned int
+	req     *Request
+	expect  bool
+	// next is the offset of the first byte of the body not decoded yet
+	next int
+	body []byte
+}
+
+// parse returns the request at the start of data and its length, a
+// truncated request is reported as incompleteError and the state is kept
+// for the next call with the same data and more.
+func (p *bufferedParser) parse(data []byte) (*Request, int, error) {
+	req, n, err := p.advance(data)
+	var inc *incompleteError
+	if !errors.As(err, &inc) {
+		*p = bufferedParser{}
+	}
+	return req, n, err
+}
+
+func (p *bufferedParser) advance(data []byte) (*Request, int, error) {
+	if p.req == nil {
+		if !p.headArrived(data) {
+			return nil, 0, &incompleteError{}
+		}
+		if err := p.parseHead(data); err != nil {
+			return nil, 0, err
+		}
+	}
+	if p.req.Chunked {
+		return p.decodeChunks(data)
+	}
+	end := p.next + int(p.req.ContentLength)
+	if len(data) < end {
+		return nil, 0, &incompleteError{need: end, expectContinue: p.expect}
+	}
+	p.req.Body = bytes.NewReader(append([]byte(nil), data[p.next:end]...))
+	return p.req, end, nil
+}
+
+// headArrived looks for the empty line that ends the head in the bytes
+// that were not searched yet.
+func (p *bufferedParser) headArrived(data []byte) bool {
+	from := p.scanned - len("\n\r")
+	if from < 0 {
+		from = 0
+	}
+	p.scanned = len(data)
+	rest := data[from:]
+	return bytes.Contains(rest, []byte("\n\n")) || bytes.Contains(rest, []byte("\n\r\n")) ||
+		len(data) > maxHeadBytes
+}
+
+func (p *bufferedParser) parseHead(data []byte) error {
+	src := bytes.NewReader(data)
+	r := bufio.NewReaderSize(src, BufCap)
+	req, err := readRequest(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the empty line was not the end of the head, search it again
+		p.scanned = 0
+		return &incompleteError{}
+	}
+	if err != nil {
+		return err
+	}
+	p.req = req
+	p.next = len(data) - src.Len() - r.Buffered()
+	p.expect = strings.EqualFold(req.Header.Get("Expect"), "100-continue") && req.Proto == "HTTP/1.1"
+	return nil
+}
+
+// decodeChunks decodes the chunks that arrived completely. The need of an
+// incomplete request is the end of the chunk being received, so a large
+// chunk is decoded once.
+func (p *bufferedParser) decodeChunks(data []byte) (*Request, int, error) {
+	src := bytes.NewReader(data[p.next:])
+	r := bufio.NewReaderSize(src, BufCap)
+	offset := func() int {
+		return len(data) - src.Len() - r.Buffered()
+	}
+	cr := &chunkedReader{r: r, read: int64(len(p.body)), limit: MaxBodySize}
+
+	for {
+		size, err := cr.nextChunk()
+		if err != nil {
+			return nil, 0, p.chunkError(data, err)
+		}
+		if size == 0 {
+			if err := cr.readTrailer(); err != nil {
+				return nil, 0, p.chunkError(data, err)
+			}
+			p.req.Body = bytes.NewReader(p.body)
+			return p.req, offset(), nil
+		}
+
+		start := offset()
+		if end := start + int(size) + len("\n"); len(data) < end {
+			return nil, 0, &incompleteError{need: end, expectContinue: p.expect}
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return nil, 0, err
+		}
+		if err := cr.readChunkEnd(); err != nil {
+			return nil, 0, p.chunkError(data, err)
+		}
+		p.body = append(p.body, data[start:start+int(size)]...)
+		p.next = offset()
+	}
+}
+
+func (p *bufferedParser) chunkError(data []byte, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &incompleteError{need: len(data) + 1, expectContinue: p.expect}
+	}
+	return err
+}
+
+// writeStream returns the function that writes a streamed response
+// after the connection left the loop and serves its next requests.
+func (l *eventLoop) writeStream(req *Request, resp *Response, keepAlive bool, served int, start time.Time) func(net.Conn, *bufio.ReadWriter) {
+	return func(conn net.Conn, rw *bufio.ReadWriter) {
+		if !l.s.setDeadline(conn.SetWriteDeadline, writeTimeout) {
+			resp.finish()
+			return
+		}
+		n, err := writeResponse(rw.Writer, req, resp, keepAlive)
+		resp.finish()
+		if err != nil {
+			l.s.connError("Error writing response", err)
+			// what was written goes out before the connection closes,
+			// like serveConn does
+			if err := rw.Flush(); err != nil {
+				l.s.connError("Error writing response", err)
+			}
+			return
+		}
+		log.Printf("%s %s %s - %d, written response: %d bytes", req.Method, req.Target, req.Proto, resp.Status, n)
+		logAccess(req, resp, req.RemoteAddr, start)
+
+		if err := rw.Flush(); err != nil {
+			l.s.connError("Error writing response", err)
+			return
+		}
+		if keepAlive {
+			l.s.serveConn(conn, rw, l.handler, served+1)
+		}
+	}
+}
+
+// queue serializes resp into the output buffer of c, streamed responses
+// are written by writeStream instead.
+func (l *eventLoop) queue(c *evConn, req *Request, resp *Response, keepAlive bool) (int, error) {
+	if len(c.out) == 0 {
+		c.writeSince = time.Now()
+	}
+	buf := bytes.NewBuffer(c.out)
+	w := bufio.NewWriterSize(buf, BufCap)
+	n, err := writeResponse(w, req, resp, keepAlive)
+	if err == nil {
+		err = w.Flush()
+	}
+	c.out = buf.Bytes()
+	return n, err
+}
+
+func serializeResponse(req *Request, resp *Response, keepAlive bool) []byte {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if _, err := writeResponse(w, req, resp, keepAlive); err != nil {
+		log.Printf("Error writing response - %s", err.Error())
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("Error writing response - %s", err.Error())
+	}
+	return buf.Bytes()
+}
+
+func (l *eventLoop) flush(c *evConn) {
+	for len(c.out) > 0 {
+		n, err := unix.Write(c.fd, c.out)
+		if n > 0 {
+			c.out = c.out[n:]
+			c.writeSince = time.Now()
+			continue
+		}
+		if err == unix.EAGAIN {
+			c.wantWrite = true
+			l.watch(c)
+			return
+		}
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			l.s.connError("Error writing response", err)
+			l.closeConn(c)
+			return
+		}
+	}
+	c.out = nil
+	c.wantWrite = false
+	l.watch(c)
+	if c.closeAfterWrite && !c.busy {
+		l.closeConn(c)
+	}
+}
+
+const readEvents = unix.EPOLLIN | unix.EPOLLRDHUP
+
+// inputFull reports whether c has no use for more input: it ended, more
+// is buffered than the pending request and the head of the next one can
+// take, or so much output is pending that processing is paused.
+func (c *evConn) inputFull() bool {
+	return c.eof || len(c.out) >= maxPendingOut || len(c.in) > c.need+maxHeadBytes
+}
+
+// watch updates the epoll interest of c: input while it has room for more
+// and output while a write is pending.
+func (l *eventLoop) watch(c *evConn) {
+	var events uint32
+	if !c.inputFull() {
+		events |= readEvents
+	}
+	if c.wantWrite {
+		events |= unix.EPOLLOUT
+	}
+	if events == c.events {
+		return
+	}
+	ev := unix.EpollEvent{Events: events, Fd: int32(c.fd)}
+	if err := unix.EpollCtl(l.epfd, unix.EPOLL_CTL_MOD, c.fd, &ev); err != nil {
+		l.s.connError("Error watching connection", err)
+		l.closeConn(c)
+		return
+	}
+	c.events = events
+}
+
+// handoff moves an upgraded connection out of the loop into a goroutine
+// with a regular net.Conn, the unread input is replayed to the handler.
+func (l *eventLoop) handoff(c *evConn, resp *Response) {
+	delete(l.conns, c.fd)
+	if err := unix.EpollCtl(l.epfd, unix.EPOLL_CTL_DEL, c.fd, nil); err != nil {
+		log.Printf("Error unwatching connection - %s", err.Error())
+	}
+	// released once the goroutine has taken the connection over, so
+	// Shutdown never sees it untracked
+	defer l.s.wg.Done()
+	atomic.AddInt64(&l.s.stats.inFlight, -1)
+
+	file := os.NewFile(uintptr(c.fd), c.remote)
+	conn, err := net.FileConn(file)
+	if cerr := file.Close(); cerr != nil {
+		log.Printf("Error closing connection - %s", cerr.Error())
+	}
+	if err != nil {
+		l.s.connError("Error upgrading connection", err)
+		resp.finish()
+		l.s.releaseIP(c.ip)
+		return
+	}
+
+	in, out := c.in, c.out
+	l.s.wg.Add(1)
+	l.s.trackConn(conn)
+	go func() {
+		defer l.s.untrackConn(conn)
+		defer func(conn net.Conn) {
+			if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error closing connection - %s", err.Error())
+			}
+		}(conn)
+		r := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(in), conn), BufCap)
+		w := bufio.NewWriterSize(conn, BufCap)
+		if _, err := w.Write(out); err != nil {
+			l.s.connError("Error writing response", err)
+			resp.finish()
+			return
+		}
+		l.s.upgrade(conn, bufio.NewReadWriter(r, w), resp)
+	}()
+}
+
+// sweep applies the handleConn timeouts: idle connections are closed
+// silently, a request that takes too long to arrive gets a 408 and a
+// client that stops reading its response is dropped.
+func (l *eventLoop) sweep(now time.Time) {
+	for _, c := range l.conns {
+		switch {
+		case c.busy:
+			// the blocking handler has its own timeouts
+		case len(c.out) > 0:
+			if now.Sub(c.writeSince) > writeTimeout {
+				l.s.connError("Error writing response", os.ErrDeadlineExceeded)
+				l.closeConn(c)
+			}
+		case len(c.in) > 0:
+			limit := readHeaderTimeout
+			if c.need > 0 {
+				limit += readBodyTimeout
+			}
+			if now.Sub(c.reqStart) > limit {
+				l.s.connError("Error parsing request", os.ErrDeadlineExceeded)
+				resp := errorResponse(408)
+				l.queue(c, nil, resp, false)
+				logAccess(nil, resp, c.remote, c.reqStart)
+				c.in = nil
+				c.closeAfterWrite = true
+				l.flush(c)
+			}
+		default:
+			wait := idleTimeout
+			if c.served == 0 {
+				wait = readHeaderTimeout
+			}
+			if now.Sub(c.idleSince) > wait {
+				l.closeConn(c)
+			}
+		}
+	}
+}
+
+// drain stops accepting and closes connections waiting for a request,
+// the others are closed once their current response is written.
+func (l *eventLoop) drain() {
+	l.stopAccepting()
+	for _, c := range l.conns {
+		// a connection that has not sent its first request is still served
+		if c.served > 0 && len(c.in) == 0 && len(c.out) == 0 && !c.busy {
+			l.closeConn(c)
+		}
+	}
+}
+
+func (l *eventLoop) stopAccepting() {
+	if !l.accepting {
+		return
+	}
+	l.accepting = false
+	if err := unix.EpollCtl(l.epfd, unix.EPOLL_CTL_DEL, l.lfd, nil); err != nil {
+		log.Printf("Error closing listener - %s", err.Error())
+	}
+	l.stopped()
+}
+
+func (l *eventLoop) closeAll() {
+	for _, c := range l.conns {
+		l.closeConn(c)
+	}
+}
+
+// forceClose drops every connection once the shutdown timeout expired.
+func (l *eventLoop) forceClose() {
+	for _, c := range l.conns {
+		atomic.AddInt64(&l.s.stats.forced, 1)
+		l.closeConn(c)
+	}
+}
+
+func (l *eventLoop) closeConn(c *evConn) {
+	if l.conns[c.fd] != c {
+		return
+	}
+	delete(l.conns, c.fd)
+	if err := unix.Close(c.fd); err != nil {
+		log.Printf("Error closing connection - %s", err.Error())
+	}
+	l.s.releaseIP(c.ip)
+	atomic.AddInt64(&l.s.stats.inFlight, -1)
+	l.s.wg.Done()
+}
+
+func sockaddrString(sa unix.Sockaddr) string {
+	switch a := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(a.Addr[:]).String(), strconv.Itoa(a.Port))
+	case *unix.SockaddrInet6:
+		return net.JoinHostPort(net.IP(a.Addr[:]).String(), strconv.Itoa(a.Port))
+	}
+	return "unknown"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEventLoopBoundsInput pipelines uploads without reading a single
+// response, the loop has to stop reading once its output is backed up, so
+// the client's writes stall after the socket buffers are full.
+func TestEventLoopBoundsInput(t *testing.T) {
+	setTimeouts(t, 5*time.Second, 5*time.Second)
+	big := bytes.Repeat([]byte("x"), 64<<10)
+	addr := startServer(t, NewServer(TaskE, 1), func(req *Request) *Response {
+		return newResponse(200, big)
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	request := append([]byte(fmt.Sprintf("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n", len(big))), big...)
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var written int
+	for {
+		n, err := conn.Write(request)
+		written += n
+		if err != nil {
+			break
+		}
+	}
+
+	// the loop buffers at most maxPendingOut of output and one request of
+	// input, the rest sits in the socket buffers of both sides
+	if limit := 64 << 20; written > limit {
+		t.Errorf("server took %d MB from a client that reads nothing", written>>20)
+	}
+}
+
+// TestEventLoopBlockingHandler holds a blocking handler until the other
+// connections of the only loop have been served.
+func TestEventLoopBlockingHandler(t *testing.T) {
+	setTimeouts(t, time.Second, time.Second)
+	release := make(chan struct{})
+	s := NewServer(TaskE, 1)
+	s.Loops = 1
+	s.Blocking = func(req *Request) bool {
+		return req.URL.Path == "/slow"
+	}
+	addr := startServer(t, s, func(req *Request) *Response {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		return pathHandler(req)
+	})
+	var once sync.Once
+	unblock := func() {
+		once.Do(func() {
+			close(release)
+		})
+	}
+	t.Cleanup(unblock)
+
+	slow, slowReader := dialKeepAlive(t, addr)
+	// the request after the blocked one waits for it, responses stay in order
+	if _, err := io.WriteString(slow, "GET /slow HTTP/1.1\r\nHost: test\r\n\r\nGET /after HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := get(addr, "/fast", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 200 {
+		t.Errorf("GET /fast - %d", status)
+	}
+
+	unblock()
+	readPath(t, slowReader, "/slow")
+	readPath(t, slowReader, "/after")
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func (s *Server) runEventLoops(listener net.Listener, handler Handler) error {
+	return errors.New("the epoll event loop needs Linux")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var fileCache *FileCache
+
+// FileCache keeps the contents of hot files in memory, least recently used
+// files are evicted once the total size exceeds MaxBytes. An entry is only
+// used while the size and mtime of the file on disk still match it.
+type FileCache struct {
+	MaxBytes int64
+	MaxEntry int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+
+	stats FileCacheStats
+}
+
+type FileCacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Invalidations int64 `json:"invalidations"`
+	Evictions     int64 `json:"evictions"`
+	Entries       int64 `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	MaxBytes      int64 `json:"max_bytes"`
+}
+
+type cachedFile struct {
+	name    string
+	data    []byte
+	size    int64
+	modTime time.Time
+}
+
+func NewFileCache(maxBytes, maxEntry int64) *FileCache {
+	if maxEntry <= 0 || maxEntry > maxBytes {
+		maxEntry = maxBytes
+	}
+	return &FileCache{
+		MaxBytes: maxBytes,
+		MaxEntry: maxEntry,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// ReadFile returns the contents of name, info is the result of a fresh
+// stat of the file and decides whether the cached copy is still valid.
+func (c *FileCache) ReadFile(name string, info os.FileInfo) ([]byte, error) {
+	if c == nil {
+		return os.ReadFile(name)
+	}
+
+	c.mu.Lock()
+	if el, ok := c.items[name]; ok {
+		entry := el.Value.(*cachedFile)
+		if entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			atomic.AddInt64(&c.stats.Hits, 1)
+			return entry.data, nil
+		}
+		c.remove(el)
+		atomic.AddInt64(&c.stats.Invalidations, 1)
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.stats.Misses, 1)
+
+	data, err := os.ReadFile(name)
+	if err != nil || int64(len(data)) > c.MaxEntry || int64(len(data)) != info.Size() {
+		// a file that changed while being read is not cached
+		return data, err
+	}
+	c.add(&cachedFile{name: name, data: data, size: info.Size(), modTime: info.ModTime()})
+	return data, nil
+}
+
+func (c *FileCache) add(entry *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[entry.name]; ok {
+		c.remove(el)
+	}
+	c.items[entry.name] = c.lru.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.MaxBytes {
+		c.remove(c.lru.Back())
+		atomic.AddInt64(&c.stats.Evictions, 1)
+	}
+}
+
+// remove must be called with c.mu held.
+func (c *FileCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cachedFile)
+	delete(c.items, entry.name)
+	c.size -= entry.size
+}
+
+// Poll stats every cached file each interval and drops the ones that were
+// changed or removed, so stale contents do not hold memory until the next
+// request for them.
+func (c *FileCache) Poll(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		entries := make([]*cachedFile, 0, len(c.items))
+		for _, el := range c.items {
+			entries = append(entries, el.Value.(*cachedFile))
+		}
+		c.mu.Unlock()
+
+		for _, entry := range entries {
+			info, err := os.Stat(entry.name)
+			if err == nil && info.Size() == entry.size && info.ModTime().Equal(entry.modTime) {
+				continue
+			}
+			c.mu.Lock()
+			// the entry may have been replaced in the meantime
+			if el, ok := c.items[entry.name]; ok && el.Value.(*cachedFile) == entry {
+				c.remove(el)
+				atomic.AddInt64(&c.stats.Invalidations, 1)
+				log.Printf("File cache dropped changed %s", entry.name)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *FileCache) Stats() FileCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return FileCacheStats{
+		Hits:          atomic.LoadInt64(&c.stats.Hits),
+		Misses:        atomic.LoadInt64(&c.stats.Misses),
+		Invalidations: atomic.LoadInt64(&c.stats.Invalidations),
+		Evictions:     atomic.LoadInt64(&c.stats.Evictions),
+		Entries:       int64(len(c.items)),
+		Bytes:         c.size,
+		MaxBytes:      c.MaxBytes,
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var benchPaths = []string{"/index.html", "/style.css"}
+
+// readCached stats name and reads it through c like the file handler does.
+func readCached(t *testing.T, c *FileCache, name string) string {
+	t.Helper()
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.ReadFile(name, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFileCache(250, 120)
+	names := map[string]string{}
+	for _, n := range []string{"a", "b", "c", "big"} {
+		names[n] = filepath.Join(dir, n)
+		size := 100
+		if n == "big" {
+			size = 121
+		}
+		writeFile(t, names[n], string(bytes.Repeat([]byte(n[:1]), size)))
+	}
+
+	readCached(t, c, names["a"])
+	readCached(t, c, names["b"])
+	// a becomes the most recently used, so c pushes out b
+	readCached(t, c, names["a"])
+	readCached(t, c, names["c"])
+	if st := c.Stats(); st.Entries != 2 || st.Bytes != 200 || st.Evictions != 1 || st.Hits != 1 {
+		t.Fatalf("after filling the cache %+v", st)
+	}
+	readCached(t, c, names["a"])
+	readCached(t, c, names["c"])
+	if st := c.Stats(); st.Hits != 3 {
+		t.Errorf("a and c were not kept, %+v", st)
+	}
+	readCached(t, c, names["b"])
+	if st := c.Stats(); st.Misses != 4 || st.Evictions != 2 || st.Bytes != 200 {
+		t.Errorf("b was not evicted, %+v", st)
+	}
+
+	// a file over MaxEntry is served but never cached
+	if got := readCached(t, c, names["big"]); len(got) != 121 {
+		t.Errorf("read %d bytes of big", len(got))
+	}
+	if st := c.Stats(); st.Entries != 2 || st.Evictions != 2 {
+		t.Errorf("big was cached, %+v", st)
+	}
+}
+
+func TestFileCacheInvalidation(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "f")
+	c := NewFileCache(1<<20, 0)
+	writeFile(t, name, "one")
+	readCached(t, c, name)
+	if got := readCached(t, c, name); got != "one" || c.Stats().Hits != 1 {
+		t.Fatalf("second read %q, %+v", got, c.Stats())
+	}
+
+	// same size, newer mtime
+	writeFile(t, name, "two")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCached(t, c, name); got != "two" {
+		t.Errorf("read %q after the mtime changed", got)
+	}
+	// same mtime, other size
+	writeFile(t, name, "three")
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCached(t, c, name); got != "three" {
+		t.Errorf("read %q after the size changed", got)
+	}
+	if st := c.Stats(); st.Invalidations != 2 || st.Entries != 1 || st.Bytes != 5 {
+		t.Errorf("after two changes %+v", st)
+	}
+
+	// Poll drops the changed file without a request for it
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Poll(10*time.Millisecond, stop)
+	writeFile(t, name, "four!")
+	for deadline := time.Now().Add(5 * time.Second); c.Stats().Entries != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Poll kept the changed file, %+v", c.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := c.Stats(); st.Invalidations != 3 || st.Bytes != 0 {
+		t.Errorf("after Poll %+v", st)
+	}
+}
+
+func BenchmarkServeUncached(b *testing.B) {
+	benchmarkServeModes(b, nil)
+}
+
+func BenchmarkServeCached(b *testing.B) {
+	benchmarkServeModes(b, NewFileCache(64<<20, 1<<20))
+}
+
+// benchmarkServeModes serves the example files in every TaskType mode,
+// each client keeps its connection alive as the load mode of the client.
+func benchmarkServeModes(b *testing.B, cache *FileCache) {
+	oldRoot, oldCache := docRoot, fileCache
+	oldHosts, hadHosts := hosts.Load().(*hostTable)
+	docRoot, fileCache = "examples", cache
+	hosts.Store(defaultHosts(nil, nil))
+	b.Cleanup(func() {
+		docRoot, fileCache = oldRoot, oldCache
+		if hadHosts {
+			hosts.Store(oldHosts)
+		}
+	})
+
+	for _, task := range []TaskType{TaskA, TaskB, TaskD, TaskE} {
+		b.Run(task.String(), func(b *testing.B) {
+			addr := startServer(b, NewServer(task, 4), serve)
+			if task == TaskA {
+				// a sequential server serves one connection at a time
+				c := dialBench(b, addr)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					c.get(b, benchPaths[i%len(benchPaths)])
+				}
+				return
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c := dialBench(b, addr)
+				for i := 0; pb.Next(); i++ {
+					c.get(b, benchPaths[i%len(benchPaths)])
+				}
+			})
+		})
+	}
+}
+
+// benchConn is a keep-alive client connection, it reconnects when the
+// server closes it after maxRequestsPerConn requests.
+type benchConn struct {
+	addr string
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialBench(b *testing.B, addr string) *benchConn {
+	c := &benchConn{addr: addr}
+	b.Cleanup(c.close)
+	return c
+}
+
+func (c *benchConn) close() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *benchConn) get(b *testing.B, path string) {
+	if c.conn == nil {
+		conn, err := net.Dial("tcp", c.addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.conn, c.r = conn, bufio.NewReader(conn)
+	}
+	if _, err := fmt.Fprintf(c.conn, "GET %s HTTP/1.1\r\nHost: bench\r\n\r\n", path); err != nil {
+		b.Fatal(err)
+	}
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		b.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b.Fatalf("GET %s - %d", path, resp.StatusCode)
+	}
+	if resp.Close {
+		c.close()
+	}
+}
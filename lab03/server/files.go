@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const indexFile = "index.html"
+
+var (
+	docRoot     = "examples"
+	listingDirs = false
+
+	errForbidden = errors.New("path escapes document root")
+)
+
+func serveFile(root string, listing bool, req *Request) *Response {
+	name, err := resolvePath(root, req.URL.Path)
+	if err != nil {
+		return fileErrorResponse(err)
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileErrorResponse(err)
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			resp := newResponse(301, nil)
+			resp.Header.Set("Location", (&url.URL{Path: req.URL.Path + "/", RawQuery: req.URL.RawQuery}).String())
+			return resp
+		}
+		index := filepath.Join(name, indexFile)
+		if indexInfo, err := os.Stat(index); err == nil && indexInfo.Mode().IsRegular() {
+			name, info = index, indexInfo
+		} else if listing {
+			return listDir(name, req.URL.Path)
+		} else {
+			return errorResponse(403)
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return errorResponse(403)
+	}
+
+	accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+	if encName, coding := findPrecompressed(name, accepted); encName != "" {
+		encInfo, err := os.Stat(encName)
+		if err != nil {
+			return fileErrorResponse(err)
+		}
+		data, err := fileCache.ReadFile(encName, encInfo)
+		if err != nil {
+			return fileErrorResponse(err)
+		}
+		resp := newResponse(200, data)
+		resp.Header.Set("Content-Type", fileContentType(name))
+		resp.Header.Set("Content-Encoding", coding)
+		resp.Header.Set("Vary", "Accept-Encoding")
+		resp.Header.Set("Last-Modified", httpTime(encInfo.ModTime()))
+		return resp
+	}
+
+	data, err := fileCache.ReadFile(name, info)
+	if err != nil {
+		return fileErrorResponse(err)
+	}
+
+	resp := newResponse(200, data)
+	resp.Header.Set("Content-Type", contentType(name, data))
+	resp.Header.Set("Last-Modified", httpTime(info.ModTime()))
+	compressResponse(resp, accepted)
+	return resp
+}
+
+// compressResponse gzips compressible bodies on the fly when they are at
+// least compressThreshold bytes long, a negative threshold disables it.
+func compressResponse(resp *Response, accepted []string) {
+	if !isCompressible(resp.Header.Get("Content-Type")) {
+		return
+	}
+	resp.Header.Set("Vary", "Accept-Encoding")
+	if compressThreshold < 0 || len(resp.Body) < compressThreshold || !acceptsEncoding(accepted, "gzip") {
+		return
+	}
+
+	zipped, err := gzipBytes(resp.Body)
+	if err != nil {
+		log.Printf("Error compressing response - %s", err.Error())
+		return
+	}
+	if len(zipped) >= len(resp.Body) {
+		return
+	}
+	resp.Body = zipped
+	resp.Header.Set("Content-Encoding", "gzip")
+}
+
+// resolvePath maps a decoded URL path to a file under root. Paths that climb
+// above the root with ".." or leave it through a symlink give errForbidden.
+func resolvePath(root, urlPath string) (string, error) {
+	if strings.ContainsAny(urlPath, "\x00\\") {
+		return "", errForbidden
+	}
+
+	depth := 0
+	for _, seg := range strings.Split(urlPath, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", errForbidden
+			}
+		default:
+			depth++
+		}
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if absRoot, err = filepath.EvalSymlinks(absRoot); err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(absRoot, filepath.FromSlash(path.Clean("/"+urlPath)))
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	if real != absRoot && !strings.HasPrefix(real, absRoot+string(filepath.Separator)) {
+		return "", errForbidden
+	}
+	return real, nil
+}
+
+func fileErrorResponse(err error) *Response {
+	log.Printf("Error reading file - %s\n", err.Error())
+	switch {
+	case errors.Is(err, errForbidden), errors.Is(err, os.ErrPermission):
+		return errorResponse(403)
+	case errors.Is(err, os.ErrNotExist):
+		return errorResponse(404)
+	default:
+		return errorResponse(500)
+	}
+}
+
+func listDir(dir, urlPath string) *Response {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fileErrorResponse(err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	title := html.EscapeString("Index of " + urlPath)
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	if urlPath != "/" {
+		b.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if e.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	resp := newResponse(200, []byte(b.String()))
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return resp
+}
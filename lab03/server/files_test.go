@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "www")
+	for _, d := range []string{filepath.Join(root, "sub"), filepath.Join(dir, "private")} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"www/index.html", "www/sub/a.txt", "secret.txt", "private/key"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"escape":     "../secret.txt",
+		"escape-dir": "../private",
+		"inside":     "sub/a.txt",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		want   string
+		err    error
+	}{
+		{"/index.html", "index.html", nil},
+		{"/sub/../index.html", "index.html", nil},
+		{"/./sub//a.txt", "sub/a.txt", nil},
+		{"/sub/", "sub", nil},
+		{"/inside", "sub/a.txt", nil},
+		{"/missing", "", os.ErrNotExist},
+		{"/../secret.txt", "", errForbidden},
+		{"/sub/../../secret.txt", "", errForbidden},
+		{"/%2e%2e/secret.txt", "", errForbidden},
+		{"/%2E%2E%2fsecret.txt", "", errForbidden},
+		{"/sub%2f..%2f..%2fsecret.txt", "", errForbidden},
+		{"/..%5csecret.txt", "", errForbidden},
+		{"/sub%5ca.txt", "", errForbidden},
+		{"/index.html%00.txt", "", errForbidden},
+		{"/escape", "", errForbidden},
+		{"/escape-dir/key", "", errForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			req, err := readRequest(bufio.NewReader(strings.NewReader("GET " + tt.target + " HTTP/1.1\r\nHost: test\r\n\r\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := resolvePath(root, req.URL.Path)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("resolvePath(%q) = %q, %v, want %v", req.URL.Path, got, err, tt.err)
+				}
+				return
+			}
+			if want := filepath.Join(realRoot, filepath.FromSlash(tt.want)); err != nil || got != want {
+				t.Errorf("resolvePath(%q) = %q, %v, want %q", req.URL.Path, got, err, want)
+			}
+		})
+	}
+}
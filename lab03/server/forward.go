@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	forwardCache *DiskCache
+	blocklist    []string
+	connectPorts = map[string]bool{"443": true}
+
+	originDialTimeout = 5 * time.Second
+	originRespTimeout = 30 * time.Second
+)
+
+// forwardProxy serves absolute-URI proxy requests and CONNECT tunnels,
+// GET responses are cached in forwardCache when it is set.
+func forwardProxy(req *Request) *Response {
+	if req.Method == "CONNECT" {
+		return connectTunnel(req)
+	}
+	if !req.URL.IsAbs() || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+		log.Printf("Not a proxy request %s", req.Target)
+		return errorResponse(400)
+	}
+	if isBlocked(req.URL.Hostname()) {
+		log.Printf("Blocked request to %s", req.URL.Host)
+		return errorResponse(403)
+	}
+
+	key := req.URL.String()
+	if forwardCache == nil {
+		return fetchOrigin(req, nil)
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		// unsafe methods invalidate the stored response, RFC 9111 4.4
+		forwardCache.Delete(key)
+		return fetchOrigin(req, nil)
+	}
+
+	entry, cached := forwardCache.Load(key)
+	if cached && entry.fresh(req, time.Now()) {
+		return entry.response("HIT")
+	}
+	if req.Method == "HEAD" {
+		return fetchOrigin(req, nil)
+	}
+
+	var conditional textproto.MIMEHeader
+	if cached && entry.canRevalidate() && !hasConditional(req) {
+		conditional = make(textproto.MIMEHeader)
+		if entry.ETag != "" {
+			conditional.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			conditional.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp := fetchOrigin(req, conditional)
+	if conditional != nil && resp.Status == 304 {
+		resp.finish()
+		entry.refresh(resp)
+		if err := forwardCache.Store(entry); err != nil {
+			log.Printf("Error updating cache entry - %s", err.Error())
+		}
+		return entry.response("REVALIDATED")
+	}
+	if resp.Stream == nil {
+		return resp
+	}
+	return storeResponse(key, req, resp)
+}
+
+// storeResponse buffers a body up to maxCacheEntry bytes and caches it,
+// larger bodies are passed through without caching. A body shorter than
+// its Content-Length is answered with 502.
+func storeResponse(key string, req *Request, resp *Response) *Response {
+	if resp.Length > maxCacheEntry {
+		resp.Header.Set("X-Cache", "MISS")
+		return resp
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(resp.Stream, maxCacheEntry+1))
+	if err != nil {
+		resp.finish()
+		log.Printf("Error reading origin response - %s", err.Error())
+		return errorResponse(502)
+	}
+	if n > maxCacheEntry {
+		resp.Header.Set("X-Cache", "MISS")
+		resp.Stream = io.MultiReader(&buf, resp.Stream)
+		return resp
+	}
+	resp.finish()
+	if resp.Length >= 0 && n != resp.Length {
+		// the origin closed early, a truncated body must not be served
+		// from the cache as if it were complete
+		log.Printf("Error reading origin response - got %d of %d bytes", n, resp.Length)
+		return errorResponse(502)
+	}
+
+	body := buf.Bytes()
+	if entry := newCacheEntry(key, req, resp, body); entry != nil {
+		if err := forwardCache.Store(entry); err != nil {
+			log.Printf("Error storing cache entry - %s", err.Error())
+		}
+	}
+
+	out := newResponse(resp.Status, body)
+	out.Header = resp.Header
+	out.Header.Set("X-Cache", "MISS")
+	return out
+}
+
+func hasConditional(req *Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+func fetchOrigin(req *Request, extra textproto.MIMEHeader) *Response {
+	addr := originAddr(req.URL.Scheme, req.URL.Host)
+	dialer := &net.Dialer{Timeout: originDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if req.URL.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: req.URL.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		log.Printf("Error connecting to origin %s - %s", addr, err.Error())
+		if isTimeout(err) {
+			return errorResponse(504)
+		}
+		return errorResponse(502)
+	}
+
+	resp, err := originRoundTrip(conn, req, extra)
+	if err != nil {
+		if cerr := conn.Close(); cerr != nil {
+			log.Printf("Error closing origin connection - %s", cerr.Error())
+		}
+		log.Printf("Error fetching %s - %s", req.URL, err.Error())
+		if isTimeout(err) {
+			return errorResponse(504)
+		}
+		return errorResponse(502)
+	}
+	return resp
+}
+
+func originRoundTrip(conn net.Conn, req *Request, extra textproto.MIMEHeader) (*Response, error) {
+	if err := conn.SetDeadline(time.Now().Add(originRespTimeout)); err != nil {
+		return nil, err
+	}
+
+	header := forwardedHeader(req)
+	header.Set("Host", req.URL.Host)
+	header.Add("Via", "1.1 "+serverName)
+	for key, values := range extra {
+		header[key] = values
+	}
+
+	w := bufio.NewWriterSize(conn, BufCap)
+	if err := writeUpstreamRequest(w, req, req.URL.RequestURI(), header); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	resp, err := readUpstreamResponse(bufio.NewReaderSize(conn, BufCap), req.Method)
+	if err != nil {
+		return nil, err
+	}
+	// as for reverse proxy routes, every read of the body gets the response
+	// timeout, storeResponse copies it with nobody waiting on the client
+	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if resp.Stream != nil {
+		resp.Stream = &idleReader{conn: conn, r: resp.Stream, timeout: originRespTimeout}
+	}
+	resp.Header.Add("Via", "1.1 "+serverName)
+	resp.Done = func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Error closing origin connection - %s", err.Error())
+		}
+	}
+	return resp, nil
+}
+
+func originAddr(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
+}
+
+func connectTunnel(req *Request) *Response {
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		return errorResponse(400)
+	}
+	if !connectPorts[port] {
+		log.Printf("CONNECT to port %s is not allowed", port)
+		return errorResponse(403)
+	}
+	if isBlocked(host) {
+		log.Printf("Blocked tunnel to %s", req.URL.Host)
+		return errorResponse(403)
+	}
+
+	target, err := net.DialTimeout("tcp", req.URL.Host, originDialTimeout)
+	if err != nil {
+		log.Printf("Error connecting to %s - %s", req.URL.Host, err.Error())
+		if isTimeout(err) {
+			return errorResponse(504)
+		}
+		return errorResponse(502)
+	}
+
+	resp := newResponse(200, nil)
+	resp.Done = func() {
+		if err := target.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error closing tunnel - %s", err.Error())
+		}
+	}
+	resp.Upgrade = func(conn net.Conn, rw *bufio.ReadWriter) {
+		tunnel(conn, rw.Reader, target)
+	}
+	return resp
+}
+
+// tunnel copies bytes both ways until either side is done, then closes
+// both connections so the other copy returns as well.
+func tunnel(client net.Conn, clientReader io.Reader, target net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		_ = client.Close()
+		_ = target.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(target, clientReader); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Tunnel %s closed - %s", target.RemoteAddr(), err.Error())
+		}
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(client, target); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Tunnel %s closed - %s", target.RemoteAddr(), err.Error())
+		}
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
+
+func loadBlocklist(name string) ([]string, error) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line != "" {
+			domains = append(domains, strings.ToLower(strings.TrimPrefix(line, ".")))
+		}
+	}
+	return domains, nil
+}
+
+// isBlocked matches the host and all of its subdomains.
+func isBlocked(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range blocklist {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startOrigin answers every connection with the raw response and closes it.
+func startOrigin(t *testing.T, raw string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := readRequest(bufio.NewReader(conn)); err == nil {
+				_, _ = io.WriteString(conn, raw)
+			}
+			_ = conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestForwardCacheTruncated(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := forwardCache
+	forwardCache = cache
+	t.Cleanup(func() {
+		forwardCache = old
+	})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		cached bool
+	}{
+		{"complete", "0123456789", 200, true},
+		{"cut short", "short", 502, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startOrigin(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nCache-Control: max-age=60\r\n\r\n"+tt.body)
+			url := "http://" + addr + "/file"
+			req, err := readRequest(bufio.NewReader(strings.NewReader("GET " + url + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := forwardProxy(req)
+			resp.finish()
+			if resp.Status != tt.status {
+				t.Errorf("GET %s - %d, want %d", url, resp.Status, tt.status)
+			}
+			if _, ok := cache.Load(url); ok != tt.cached {
+				t.Errorf("cached %v, want %v", ok, tt.cached)
+			}
+		})
+	}
+}
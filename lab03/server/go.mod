@@ -1 +1,10 @@
 module server
+
+go 1.21
+
+require (
+	golang.org/x/net v0.25.0
+	golang.org/x/sys v0.20.0
+)
+
+require golang.org/x/text v0.15.0 // indirect
@@ -0,0 +1,1109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP/2 over cleartext TCP (RFC 9113), entered either with the client
+// connection preface (prior knowledge) or through an Upgrade: h2c request.
+// Request bodies are buffered until the client ends the stream, responses
+// go out as DATA frames within the peer's flow control windows.
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+var h2cEnabled = false
+
+// h2MaxBuffered caps the request body bytes a connection holds for all its
+// streams. Windows are reopened as soon as DATA arrives, so this and not
+// flow control bounds the memory of a client that opens many uploads.
+var h2MaxBuffered int64 = 2 * MaxBodySize
+
+const (
+	h2FrameHeaderLen  = 9
+	h2MaxFrameSize    = 16384
+	h2MaxFrameSizeMax = 1<<24 - 1
+	h2DefaultWindow   = 65535
+	h2MaxWindow       = 1<<31 - 1
+	h2MaxStreams      = 100
+)
+
+const (
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FramePriority     = 0x2
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePushPromise  = 0x5
+	h2FramePing         = 0x6
+	h2FrameGoAway       = 0x7
+	h2FrameWindowUpdate = 0x8
+	h2FrameContinuation = 0x9
+)
+
+const (
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+)
+
+const (
+	h2SettingHeaderTableSize      = 0x1
+	h2SettingEnablePush           = 0x2
+	h2SettingMaxConcurrentStreams = 0x3
+	h2SettingInitialWindowSize    = 0x4
+	h2SettingMaxFrameSize         = 0x5
+	h2SettingMaxHeaderListSize    = 0x6
+)
+
+const (
+	h2ErrNo              = 0x0
+	h2ErrProtocol        = 0x1
+	h2ErrInternal        = 0x2
+	h2ErrFlowControl     = 0x3
+	h2ErrStreamClosed    = 0x5
+	h2ErrFrameSize       = 0x6
+	h2ErrRefusedStream   = 0x7
+	h2ErrCancel          = 0x8
+	h2ErrCompression     = 0x9
+	h2ErrEnhanceYourCalm = 0xb
+	h2ErrHTTP11Required  = 0xd
+)
+
+var h2ErrNames = map[uint32]string{
+	h2ErrNo:              "NO_ERROR",
+	h2ErrProtocol:        "PROTOCOL_ERROR",
+	h2ErrInternal:        "INTERNAL_ERROR",
+	h2ErrFlowControl:     "FLOW_CONTROL_ERROR",
+	h2ErrStreamClosed:    "STREAM_CLOSED",
+	h2ErrFrameSize:       "FRAME_SIZE_ERROR",
+	h2ErrRefusedStream:   "REFUSED_STREAM",
+	h2ErrCancel:          "CANCEL",
+	h2ErrCompression:     "COMPRESSION_ERROR",
+	h2ErrEnhanceYourCalm: "ENHANCE_YOUR_CALM",
+	h2ErrHTTP11Required:  "HTTP_1_1_REQUIRED",
+}
+
+// h2Error is a connection error when Stream is 0, otherwise only the
+// stream is reset.
+type h2Error struct {
+	Code   uint32
+	Stream uint32
+	Msg    string
+}
+
+func (e *h2Error) Error() string {
+	name, ok := h2ErrNames[e.Code]
+	if !ok {
+		name = "UNKNOWN"
+	}
+	if e.Stream != 0 {
+		return fmt.Sprintf("stream %d %s: %s", e.Stream, name, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", name, e.Msg)
+}
+
+func h2ConnError(code uint32, format string, args ...interface{}) error {
+	return &h2Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+func h2StreamError(id, code uint32, format string, args ...interface{}) error {
+	return &h2Error{Code: code, Stream: id, Msg: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errH2Reset   = errors.New("stream reset by peer")
+	errH2Closed  = errors.New("connection closed")
+	errH2Stalled = errors.New("flow control window stalled")
+)
+
+type h2Conn struct {
+	s       *Server
+	conn    net.Conn
+	r       *bufio.Reader
+	handler Handler
+	remote  string
+
+	// owned by the read loop
+	dec         *hpackDecoder
+	buf         []byte
+	gotSettings bool
+	recvWin     int64
+	contStream  uint32
+	contBlock   []byte
+	contEnd     bool
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	streams   map[uint32]*h2Stream
+	buffered  int64
+	lastID    uint32
+	sendWin   int64
+	initWin   int64
+	maxFrame  int
+	goingAway bool
+	dead      bool
+
+	wg sync.WaitGroup
+}
+
+type h2Stream struct {
+	id      uint32
+	start   time.Time
+	fields  []headerField
+	body    bytes.Buffer
+	recvWin int64
+	sendWin int64
+	// halfClosed is set once the client has sent END_STREAM, from then on
+	// the handler owns the stream
+	halfClosed bool
+	// discard is set when the response did not wait for the whole body
+	discard bool
+	reset   bool
+}
+
+// serveH2 runs an HTTP/2 connection after the preface was detected or the
+// 101 response for an h2c upgrade was sent, upgraded is the request that
+// asked for the upgrade and is answered on stream 1.
+func (s *Server) serveH2(conn net.Conn, rw *bufio.ReadWriter, handler Handler, upgraded *Request, settings []byte) {
+	c := &h2Conn{
+		s:        s,
+		conn:     conn,
+		r:        rw.Reader,
+		w:        rw.Writer,
+		handler:  handler,
+		remote:   conn.RemoteAddr().String(),
+		dec:      newHpackDecoder(hpackDefaultTableSize, MaxHeaderBytes),
+		buf:      make([]byte, h2MaxFrameSize),
+		recvWin:  h2DefaultWindow,
+		streams:  make(map[uint32]*h2Stream),
+		sendWin:  h2DefaultWindow,
+		initWin:  h2DefaultWindow,
+		maxFrame: h2MaxFrameSize,
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	err := c.serve(upgraded, settings)
+	var he *h2Error
+	if errors.As(err, &he) {
+		c.goAway(he.Code)
+	}
+	if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		s.connError("Error in HTTP/2 connection", err)
+	}
+
+	c.mu.Lock()
+	c.dead = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	if err != nil {
+		// handlers blocked on writes to a broken connection give up
+		if cerr := conn.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+			log.Printf("Error closing connection - %s", cerr.Error())
+		}
+	}
+	c.wg.Wait()
+}
+
+func (c *h2Conn) serve(upgraded *Request, settings []byte) error {
+	var payload []byte
+	payload = appendSetting(payload, h2SettingMaxConcurrentStreams, h2MaxStreams)
+	payload = appendSetting(payload, h2SettingMaxHeaderListSize, MaxHeaderBytes)
+	if err := c.writeFrame(h2FrameSettings, 0, 0, payload); err != nil {
+		return err
+	}
+
+	if upgraded != nil {
+		if err := c.applySettings(settings); err != nil {
+			return err
+		}
+		upgraded.Proto = "HTTP/2.0"
+		st := c.openStream(1)
+		st.halfClosed = true
+		c.dispatch(st, upgraded, nil)
+	}
+
+	if !c.s.setDeadline(c.conn.SetReadDeadline, readHeaderTimeout) {
+		return nil
+	}
+	preface := make([]byte, len(h2Preface))
+	if _, err := io.ReadFull(c.r, preface); err != nil {
+		return err
+	}
+	if string(preface) != h2Preface {
+		return errors.New("invalid connection preface")
+	}
+
+	for {
+		if !c.s.setDeadline(c.conn.SetReadDeadline, idleTimeout) {
+			return nil
+		}
+		if c.s.isClosing() {
+			c.goAway(h2ErrNo)
+		}
+		if _, err := c.r.Peek(h2FrameHeaderLen); err != nil {
+			if !isTimeout(err) {
+				return err
+			}
+			// nothing arrived: close when idle, otherwise wake up the
+			// streams waiting for window so stalled ones can give up
+			c.mu.Lock()
+			idle := len(c.streams) == 0
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			if idle {
+				c.goAway(h2ErrNo)
+				return nil
+			}
+			continue
+		}
+
+		if !c.s.setDeadline(c.conn.SetReadDeadline, readBodyTimeout) {
+			return nil
+		}
+		typ, flags, id, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		if err := c.handleFrame(typ, flags, id, payload); err != nil {
+			var he *h2Error
+			if errors.As(err, &he) && he.Stream != 0 {
+				log.Printf("HTTP/2 %s", he.Error())
+				c.resetStream(he.Stream, he.Code)
+				continue
+			}
+			return err
+		}
+	}
+}
+
+func (c *h2Conn) readFrame() (typ, flags uint8, id uint32, payload []byte, err error) {
+	var hdr [h2FrameHeaderLen]byte
+	if _, err = io.ReadFull(c.r, hdr[:]); err != nil {
+		return
+	}
+	length := uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+	typ, flags = hdr[3], hdr[4]
+	id = binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff
+	if length > h2MaxFrameSize {
+		err = h2ConnError(h2ErrFrameSize, "frame of %d bytes", length)
+		return
+	}
+	payload = c.buf[:length]
+	_, err = io.ReadFull(c.r, payload)
+	return
+}
+
+func (c *h2Conn) handleFrame(typ, flags uint8, id uint32, payload []byte) error {
+	if !c.gotSettings {
+		if typ != h2FrameSettings || flags&h2FlagAck != 0 {
+			return h2ConnError(h2ErrProtocol, "connection preface without SETTINGS")
+		}
+		c.gotSettings = true
+	}
+	if c.contStream != 0 && (typ != h2FrameContinuation || id != c.contStream) {
+		return h2ConnError(h2ErrProtocol, "expected CONTINUATION for stream %d", c.contStream)
+	}
+
+	switch typ {
+	case h2FrameData:
+		return c.handleData(flags, id, payload)
+	case h2FrameHeaders:
+		return c.handleHeaders(flags, id, payload)
+	case h2FrameContinuation:
+		if c.contStream == 0 {
+			return h2ConnError(h2ErrProtocol, "unexpected CONTINUATION")
+		}
+		c.contBlock = append(c.contBlock, payload...)
+		if len(c.contBlock) > MaxHeaderBytes {
+			return h2ConnError(h2ErrEnhanceYourCalm, "header block too large")
+		}
+		if flags&h2FlagEndHeaders != 0 {
+			return c.endHeaders()
+		}
+	case h2FramePriority:
+		if id == 0 {
+			return h2ConnError(h2ErrProtocol, "PRIORITY on stream 0")
+		}
+		if len(payload) != 5 {
+			return h2StreamError(id, h2ErrFrameSize, "PRIORITY of %d bytes", len(payload))
+		}
+	case h2FrameRSTStream:
+		if id == 0 {
+			return h2ConnError(h2ErrProtocol, "RST_STREAM on stream 0")
+		}
+		if len(payload) != 4 {
+			return h2ConnError(h2ErrFrameSize, "RST_STREAM of %d bytes", len(payload))
+		}
+		c.mu.Lock()
+		if id > c.lastID {
+			c.mu.Unlock()
+			return h2ConnError(h2ErrProtocol, "RST_STREAM on idle stream %d", id)
+		}
+		if st, ok := c.streams[id]; ok {
+			st.reset = true
+			if !st.halfClosed {
+				delete(c.streams, id)
+			}
+			c.cond.Broadcast()
+		}
+		c.mu.Unlock()
+	case h2FrameSettings:
+		if id != 0 {
+			return h2ConnError(h2ErrProtocol, "SETTINGS on stream %d", id)
+		}
+		if flags&h2FlagAck != 0 {
+			if len(payload) != 0 {
+				return h2ConnError(h2ErrFrameSize, "SETTINGS ack with payload")
+			}
+			return nil
+		}
+		if err := c.applySettings(payload); err != nil {
+			return err
+		}
+		return c.writeFrame(h2FrameSettings, h2FlagAck, 0, nil)
+	case h2FramePushPromise:
+		return h2ConnError(h2ErrProtocol, "PUSH_PROMISE from a client")
+	case h2FramePing:
+		if id != 0 {
+			return h2ConnError(h2ErrProtocol, "PING on stream %d", id)
+		}
+		if len(payload) != 8 {
+			return h2ConnError(h2ErrFrameSize, "PING of %d bytes", len(payload))
+		}
+		if flags&h2FlagAck == 0 {
+			return c.writeFrame(h2FramePing, h2FlagAck, 0, payload)
+		}
+	case h2FrameGoAway:
+		if id != 0 {
+			return h2ConnError(h2ErrProtocol, "GOAWAY on stream %d", id)
+		}
+		// the client opens no more streams, the open ones are finished
+	case h2FrameWindowUpdate:
+		if len(payload) != 4 {
+			return h2ConnError(h2ErrFrameSize, "WINDOW_UPDATE of %d bytes", len(payload))
+		}
+		return c.handleWindowUpdate(id, int64(binary.BigEndian.Uint32(payload)&0x7fffffff))
+	}
+	// unknown frame types are ignored
+	return nil
+}
+
+func (c *h2Conn) handleData(flags uint8, id uint32, payload []byte) error {
+	if id == 0 {
+		return h2ConnError(h2ErrProtocol, "DATA on stream 0")
+	}
+	// the whole frame, padding included, counts against flow control
+	size := int64(len(payload))
+	data, err := stripPadding(flags, payload)
+	if err != nil {
+		return err
+	}
+	if c.recvWin -= size; c.recvWin < 0 {
+		return h2ConnError(h2ErrFlowControl, "connection window exceeded")
+	}
+
+	c.mu.Lock()
+	st, ok := c.streams[id]
+	if ok && st.discard {
+		c.mu.Unlock()
+		return c.windowUpdate(0, size)
+	}
+	if !ok || st.halfClosed {
+		idle := id > c.lastID
+		c.mu.Unlock()
+		if idle {
+			return h2ConnError(h2ErrProtocol, "DATA on idle stream %d", id)
+		}
+		// a stream that was reset or answered early, the data is dropped
+		if !ok {
+			return c.windowUpdate(0, size)
+		}
+		return h2StreamError(id, h2ErrStreamClosed, "DATA after END_STREAM")
+	}
+	if st.recvWin -= size; st.recvWin < 0 {
+		c.mu.Unlock()
+		return h2StreamError(id, h2ErrFlowControl, "stream window exceeded")
+	}
+	if c.buffered+int64(len(data)) > h2MaxBuffered {
+		c.mu.Unlock()
+		// the stream is reset and its data dropped, the connection
+		// window gets the frame back
+		if err := c.windowUpdate(0, size); err != nil {
+			return err
+		}
+		return h2StreamError(id, h2ErrFlowControl, "connection buffers more than %d bytes", h2MaxBuffered)
+	}
+	tooLarge := int64(st.body.Len()+len(data)) > MaxBodySize
+	if !tooLarge {
+		st.body.Write(data)
+		c.buffered += int64(len(data))
+	}
+	end := flags&h2FlagEndStream != 0 || tooLarge
+	if end {
+		st.halfClosed = true
+		st.discard = tooLarge && flags&h2FlagEndStream == 0
+	}
+	c.mu.Unlock()
+
+	// the body is buffered anyway and bounded by h2MaxBuffered, so the
+	// window is reopened right away
+	if err := c.windowUpdate(0, size); err != nil {
+		return err
+	}
+	if !end {
+		return c.windowUpdate(id, size)
+	}
+	if tooLarge {
+		req, _ := c.newRequest(st)
+		c.dispatch(st, req, errorResponse(413))
+		return nil
+	}
+	return c.startRequest(st)
+}
+
+func stripPadding(flags uint8, payload []byte) ([]byte, error) {
+	if flags&h2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, h2ConnError(h2ErrProtocol, "invalid padding")
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+func (c *h2Conn) handleHeaders(flags uint8, id uint32, payload []byte) error {
+	if id == 0 || id%2 == 0 {
+		return h2ConnError(h2ErrProtocol, "HEADERS on stream %d", id)
+	}
+	frag, err := stripPadding(flags, payload)
+	if err != nil {
+		return err
+	}
+	if flags&h2FlagPriority != 0 {
+		if len(frag) < 5 {
+			return h2ConnError(h2ErrFrameSize, "HEADERS too short for priority")
+		}
+		frag = frag[5:]
+	}
+
+	c.mu.Lock()
+	st, ok := c.streams[id]
+	switch {
+	case ok && (st.halfClosed || flags&h2FlagEndStream == 0):
+		c.mu.Unlock()
+		return h2ConnError(h2ErrProtocol, "unexpected HEADERS on stream %d", id)
+	case !ok && id <= c.lastID:
+		c.mu.Unlock()
+		return h2ConnError(h2ErrStreamClosed, "HEADERS on closed stream %d", id)
+	case !ok:
+		c.lastID = id
+	}
+	c.mu.Unlock()
+
+	c.contStream = id
+	c.contBlock = append(c.contBlock[:0], frag...)
+	c.contEnd = flags&h2FlagEndStream != 0
+	if flags&h2FlagEndHeaders != 0 {
+		return c.endHeaders()
+	}
+	return nil
+}
+
+// endHeaders decodes a complete header block, which either opens a stream
+// or carries the trailers of one.
+func (c *h2Conn) endHeaders() error {
+	id, end := c.contStream, c.contEnd
+	c.contStream = 0
+	fields, err := c.dec.decode(c.contBlock)
+	if err != nil {
+		return h2ConnError(h2ErrCompression, "%s", err.Error())
+	}
+
+	c.mu.Lock()
+	if st, ok := c.streams[id]; ok {
+		// trailers are accepted and ignored
+		st.halfClosed = true
+		c.mu.Unlock()
+		return c.startRequest(st)
+	}
+	refuse := c.goingAway || len(c.streams) >= h2MaxStreams
+	c.mu.Unlock()
+	if refuse {
+		return h2StreamError(id, h2ErrRefusedStream, "too many streams")
+	}
+
+	st := c.openStream(id)
+	st.fields = fields
+	if !end {
+		return nil
+	}
+	c.mu.Lock()
+	st.halfClosed = true
+	c.mu.Unlock()
+	return c.startRequest(st)
+}
+
+func (c *h2Conn) openStream(id uint32) *h2Stream {
+	st := &h2Stream{id: id, start: time.Now(), recvWin: h2DefaultWindow}
+	c.mu.Lock()
+	st.sendWin = c.initWin
+	c.streams[id] = st
+	first := len(c.streams) == 1
+	if id > c.lastID {
+		c.lastID = id
+	}
+	c.mu.Unlock()
+	if first {
+		c.s.setIdle(c.conn, false)
+	}
+	return st
+}
+
+// closeStream forgets a finished stream, a connection without streams is
+// idle and is woken up right away on shutdown.
+func (c *h2Conn) closeStream(st *h2Stream) {
+	c.mu.Lock()
+	delete(c.streams, st.id)
+	c.dropBody(st)
+	idle := len(c.streams) == 0
+	c.mu.Unlock()
+	if idle {
+		c.s.setIdle(c.conn, true)
+	}
+}
+
+// dropBody releases the buffered body of a stream nobody reads any more,
+// it must be called with c.mu held.
+func (c *h2Conn) dropBody(st *h2Stream) {
+	c.buffered -= int64(st.body.Len())
+	st.body = bytes.Buffer{}
+}
+
+func (c *h2Conn) startRequest(st *h2Stream) error {
+	req, err := c.newRequest(st)
+	if err != nil {
+		log.Printf("Error parsing request - %s", err.Error())
+		c.dispatch(st, req, errorResponse(statusOf(err)))
+		return nil
+	}
+	c.dispatch(st, req, nil)
+	return nil
+}
+
+// newRequest maps the pseudo-header fields onto a Request, on error the
+// returned request still carries enough to log and answer it.
+func (c *h2Conn) newRequest(st *h2Stream) (*Request, error) {
+	req := &Request{
+		Proto:      "HTTP/2.0",
+		Header:     make(textproto.MIMEHeader),
+		RemoteAddr: c.remote,
+		URL:        &url.URL{Path: "/"},
+		Body:       bytes.NewReader(st.body.Bytes()),
+	}
+	req.ContentLength = int64(st.body.Len())
+
+	var scheme string
+	var cookies []string
+	seen := make(map[string]bool)
+	regular := false
+	total := 0
+	for _, f := range st.fields {
+		total += f.size()
+		if total > MaxHeaderBytes || len(req.Header) > MaxHeaderCount {
+			return req, errHeaderTooLong
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			if regular || seen[f.Name] {
+				return req, badRequest("misplaced or repeated %s", f.Name)
+			}
+			seen[f.Name] = true
+			switch f.Name {
+			case ":method":
+				req.Method = f.Value
+			case ":path":
+				req.Target = f.Value
+			case ":scheme":
+				scheme = f.Value
+			case ":authority":
+				req.Host = f.Value
+			default:
+				return req, badRequest("unknown pseudo-header %s", f.Name)
+			}
+			continue
+		}
+		regular = true
+		if f.Name != strings.ToLower(f.Name) || !isToken(f.Name) {
+			return req, badRequest("invalid header name %q", f.Name)
+		}
+		switch f.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return req, badRequest("connection-specific header %s", f.Name)
+		case "te":
+			if f.Value != "trailers" {
+				return req, badRequest("invalid te %q", f.Value)
+			}
+		case "cookie":
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		req.Header.Add(textproto.CanonicalMIMEHeaderKey(f.Name), f.Value)
+	}
+	if len(cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	if !isToken(req.Method) {
+		return req, badRequest("invalid method %q", req.Method)
+	}
+	if req.Method == "CONNECT" {
+		req.Target = req.Host
+	} else if req.Target == "" || scheme == "" {
+		return req, badRequest("missing :path or :scheme")
+	}
+	u, err := parseTarget(req.Method, req.Target)
+	if err != nil {
+		return req, err
+	}
+	req.URL = u
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	if req.Host == "" {
+		return req, badRequest("missing :authority")
+	}
+	if req.Header.Get("Host") == "" {
+		req.Header.Set("Host", req.Host)
+	}
+	if cl := req.Header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(st.body.Len()) {
+		return req, badRequest("content-length does not match the body")
+	}
+	return req, nil
+}
+
+// dispatch answers a half-closed stream in its own goroutine, with resp
+// when it is set and with the handler otherwise.
+func (c *h2Conn) dispatch(st *h2Stream, req *Request, resp *Response) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.closeStream(st)
+		if resp == nil {
+			resp = c.handler(req)
+		}
+		atomic.AddInt64(&c.s.stats.requests, 1)
+		if resp.Upgrade != nil {
+			// tunnels need a connection of their own
+			resp.finish()
+			resp = errorResponse(501)
+		}
+
+		n, err := c.writeResponse(st, req, resp)
+		resp.finish()
+		if err != nil {
+			if err == errH2Reset || err == errH2Stalled {
+				log.Printf("HTTP/2 stream %d - %s", st.id, err.Error())
+				c.resetStream(st.id, h2ErrCancel)
+			} else if err == io.ErrUnexpectedEOF {
+				log.Printf("HTTP/2 stream %d - response body cut short", st.id)
+				c.resetStream(st.id, h2ErrInternal)
+			} else if err != errH2Closed {
+				c.s.connError("Error writing response", err)
+			}
+			return
+		}
+		log.Printf("%s %s %s - %d, written response: %d bytes", req.Method, req.Target, req.Proto, resp.Status, n)
+		logAccess(req, resp, req.RemoteAddr, st.start)
+
+		// the response is complete, the rest of the request is not needed
+		c.mu.Lock()
+		unfinished := st.discard
+		c.mu.Unlock()
+		if unfinished {
+			c.resetStream(st.id, h2ErrNo)
+		}
+	}()
+}
+
+var h2HopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+func (c *h2Conn) writeResponse(st *h2Stream, req *Request, resp *Response) (int, error) {
+	resp.Header.Set("Date", httpTime(time.Now()))
+	resp.Header.Set("Server", serverName)
+	for _, key := range h2HopHeaders {
+		resp.Header.Del(key)
+	}
+	switch {
+	case !bodyAllowed(resp.Status):
+		resp.Header.Del("Content-Length")
+	case resp.Stream == nil:
+		resp.Header.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	case resp.Length >= 0:
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.Length, 10))
+	default:
+		resp.Header.Del("Content-Length")
+	}
+	if resp.Header.Get("Content-Type") == "" && len(resp.Body) > 0 {
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	block := appendHeaderField(nil, headerField{":status", strconv.Itoa(resp.Status)})
+	keys := make([]string, 0, len(resp.Header))
+	for key := range resp.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ToLower(key)
+		for _, v := range resp.Header[key] {
+			block = appendHeaderField(block, headerField{name, v})
+		}
+	}
+
+	endStream := req.Method == "HEAD" || !bodyAllowed(resp.Status)
+	total, err := c.writeHeaders(st.id, block, endStream)
+	if err != nil || endStream {
+		return total, err
+	}
+
+	src := resp.Stream
+	if src == nil {
+		src = bytes.NewReader(resp.Body)
+	} else if resp.Length >= 0 {
+		src = io.LimitReader(src, resp.Length)
+	}
+	buf := make([]byte, h2MaxFrameSize)
+	for {
+		m, rerr := io.ReadFull(src, buf)
+		last := rerr == io.EOF || rerr == io.ErrUnexpectedEOF
+		if rerr != nil && !last {
+			return total, rerr
+		}
+		data := buf[:m]
+		if last && resp.Stream != nil && resp.Length >= 0 && resp.Sent+int64(m) != resp.Length {
+			// END_STREAM would pass the short body off as complete
+			return total, io.ErrUnexpectedEOF
+		}
+		for len(data) > 0 || last {
+			k, err := c.reserve(st, len(data))
+			if err != nil {
+				return total, err
+			}
+			var flags uint8
+			if last && k == len(data) {
+				flags = h2FlagEndStream
+			}
+			if err := c.writeFrame(h2FrameData, flags, st.id, data[:k]); err != nil {
+				return total, err
+			}
+			total += h2FrameHeaderLen + k
+			resp.Sent += int64(k)
+			data = data[k:]
+			if flags != 0 {
+				return total, nil
+			}
+		}
+	}
+}
+
+// reserve waits until both windows allow sending some of want bytes and
+// takes that much from them, an empty frame needs no window.
+func (c *h2Conn) reserve(st *h2Stream, want int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := time.Now()
+	for {
+		switch {
+		case c.dead:
+			return 0, errH2Closed
+		case st.reset:
+			return 0, errH2Reset
+		case want == 0:
+			return 0, nil
+		}
+		n := int64(want)
+		if c.sendWin < n {
+			n = c.sendWin
+		}
+		if st.sendWin < n {
+			n = st.sendWin
+		}
+		if n > 0 {
+			c.sendWin -= n
+			st.sendWin -= n
+			return int(n), nil
+		}
+		if time.Since(start) > writeTimeout {
+			return 0, errH2Stalled
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *h2Conn) handleWindowUpdate(id uint32, incr int64) error {
+	if incr == 0 {
+		if id == 0 {
+			return h2ConnError(h2ErrProtocol, "zero WINDOW_UPDATE")
+		}
+		return h2StreamError(id, h2ErrProtocol, "zero WINDOW_UPDATE")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == 0 {
+		if c.sendWin += incr; c.sendWin > h2MaxWindow {
+			return h2ConnError(h2ErrFlowControl, "connection window overflow")
+		}
+		c.cond.Broadcast()
+		return nil
+	}
+	st, ok := c.streams[id]
+	if !ok {
+		if id > c.lastID {
+			return h2ConnError(h2ErrProtocol, "WINDOW_UPDATE on idle stream %d", id)
+		}
+		return nil
+	}
+	if st.sendWin += incr; st.sendWin > h2MaxWindow {
+		return h2StreamError(id, h2ErrFlowControl, "stream window overflow")
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *h2Conn) applySettings(payload []byte) error {
+	if len(payload)%6 != 0 {
+		return h2ConnError(h2ErrFrameSize, "SETTINGS of %d bytes", len(payload))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ; len(payload) > 0; payload = payload[6:] {
+		id := binary.BigEndian.Uint16(payload)
+		v := binary.BigEndian.Uint32(payload[2:])
+		switch id {
+		case h2SettingEnablePush:
+			if v > 1 {
+				return h2ConnError(h2ErrProtocol, "ENABLE_PUSH %d", v)
+			}
+		case h2SettingInitialWindowSize:
+			if v > h2MaxWindow {
+				return h2ConnError(h2ErrFlowControl, "INITIAL_WINDOW_SIZE %d", v)
+			}
+			// the change applies to the windows of open streams too
+			delta := int64(v) - c.initWin
+			c.initWin = int64(v)
+			for _, st := range c.streams {
+				if st.sendWin += delta; st.sendWin > h2MaxWindow {
+					return h2ConnError(h2ErrFlowControl, "stream window overflow")
+				}
+			}
+			c.cond.Broadcast()
+		case h2SettingMaxFrameSize:
+			if v < h2MaxFrameSize || v > h2MaxFrameSizeMax {
+				return h2ConnError(h2ErrProtocol, "MAX_FRAME_SIZE %d", v)
+			}
+			c.maxFrame = int(v)
+		}
+		// the encoder uses no dynamic table, so HEADER_TABLE_SIZE needs
+		// no action, the remaining limits do not apply to a server
+	}
+	return nil
+}
+
+func appendSetting(dst []byte, id uint16, v uint32) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, id)
+	return binary.BigEndian.AppendUint32(dst, v)
+}
+
+func (c *h2Conn) windowUpdate(id uint32, incr int64) error {
+	if incr == 0 {
+		return nil
+	}
+	if id == 0 {
+		c.recvWin += incr
+	} else {
+		c.mu.Lock()
+		if st, ok := c.streams[id]; ok {
+			st.recvWin += incr
+		}
+		c.mu.Unlock()
+	}
+	return c.writeFrame(h2FrameWindowUpdate, 0, id, binary.BigEndian.AppendUint32(nil, uint32(incr)))
+}
+
+func (c *h2Conn) resetStream(id, code uint32) {
+	c.mu.Lock()
+	if st, ok := c.streams[id]; ok {
+		st.reset = true
+		if !st.halfClosed {
+			delete(c.streams, id)
+			c.dropBody(st)
+		}
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+	if err := c.writeFrame(h2FrameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, code)); err != nil {
+		c.s.connError("Error writing response", err)
+	}
+}
+
+// goAway tells the client which streams were processed, it is sent once
+// unless an error follows a graceful GOAWAY.
+func (c *h2Conn) goAway(code uint32) {
+	c.mu.Lock()
+	if c.goingAway && code == h2ErrNo || c.dead {
+		c.mu.Unlock()
+		return
+	}
+	c.goingAway = true
+	payload := binary.BigEndian.AppendUint32(nil, c.lastID)
+	c.mu.Unlock()
+	payload = binary.BigEndian.AppendUint32(payload, code)
+	if err := c.writeFrame(h2FrameGoAway, 0, 0, payload); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.s.connError("Error writing response", err)
+	}
+}
+
+// writeHeaders sends a header block as HEADERS and as many CONTINUATION
+// frames as the peer's frame size requires, nothing may come in between.
+func (c *h2Conn) writeHeaders(id uint32, block []byte, endStream bool) (int, error) {
+	c.mu.Lock()
+	maxFrame := c.maxFrame
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	total := 0
+	typ := uint8(h2FrameHeaders)
+	var flags uint8
+	if endStream {
+		flags = h2FlagEndStream
+	}
+	for {
+		frag := block
+		if len(frag) > maxFrame {
+			frag = frag[:maxFrame]
+		}
+		block = block[len(frag):]
+		if len(block) == 0 {
+			flags |= h2FlagEndHeaders
+		}
+		if err := c.appendFrame(typ, flags, id, frag); err != nil {
+			return total, err
+		}
+		total += h2FrameHeaderLen + len(frag)
+		if len(block) == 0 {
+			return total, c.flush()
+		}
+		typ, flags = h2FrameContinuation, 0
+	}
+}
+
+func (c *h2Conn) writeFrame(typ, flags uint8, id uint32, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.appendFrame(typ, flags, id, payload); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// appendFrame and flush must be called with c.wmu held.
+func (c *h2Conn) appendFrame(typ, flags uint8, id uint32, payload []byte) error {
+	hdr := [h2FrameHeaderLen]byte{
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		typ, flags,
+	}
+	binary.BigEndian.PutUint32(hdr[5:], id)
+	if _, err := c.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(payload)
+	return err
+}
+
+func (c *h2Conn) flush() error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// isH2Preface reports whether the buffered input starts with the HTTP/2
+// connection preface, more input is only awaited while it still matches.
+func isH2Preface(r *bufio.Reader) bool {
+	for n := 1; n <= len(h2Preface); n++ {
+		b, err := r.Peek(n)
+		if err != nil || string(b) != h2Preface[:n] {
+			return false
+		}
+	}
+	return true
+}
+
+// h2cHandler switches HTTP/1.1 requests with Upgrade: h2c to HTTP/2, the
+// request itself is answered on stream 1 of the new connection.
+func (s *Server) h2cHandler(next Handler) Handler {
+	return func(req *Request) *Response {
+		if req.Proto != "HTTP/1.1" || !headerHasToken(req.Header, "Upgrade", "h2c") ||
+			!headerHasToken(req.Header, "Connection", "HTTP2-Settings") {
+			return next(req)
+		}
+		values := req.Header.Values("HTTP2-Settings")
+		if len(values) != 1 {
+			return errorResponse(400)
+		}
+		settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+		if err != nil || len(settings)%6 != 0 {
+			return errorResponse(400)
+		}
+
+		// the body has to be read before the connection switches protocols
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return errorResponse(statusOf(err))
+		}
+		req.Body = bytes.NewReader(body)
+		for _, key := range []string{"Connection", "Upgrade", "Http2-Settings"} {
+			req.Header.Del(key)
+		}
+
+		resp := newResponse(101, nil)
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", "h2c")
+		resp.Upgrade = func(conn net.Conn, rw *bufio.ReadWriter) {
+			s.serveH2(conn, rw, next, req, settings)
+		}
+		return resp
+	}
+}
+
+func headerHasToken(header textproto.MIMEHeader, key, token string) bool {
+	for _, v := range header.Values(key) {
+		for _, opt := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(opt), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
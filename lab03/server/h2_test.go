@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// h2Body is larger than the initial flow control window of both sides.
+var h2Body = bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+
+func h2TestHandler(req *Request) *Response {
+	switch req.URL.Path {
+	case "/echo":
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return errorResponse(statusOf(err))
+		}
+		return newResponse(200, body)
+	case "/big":
+		return newResponse(200, h2Body)
+	case "/stream":
+		resp := newResponse(200, nil)
+		resp.Stream, resp.Length = bytes.NewReader(h2Body), -1
+		return resp
+	case "/short":
+		resp := newResponse(200, nil)
+		resp.Stream, resp.Length = bytes.NewReader(h2Body[:100]), int64(len(h2Body))
+		return resp
+	case "/hello":
+		resp := newResponse(200, []byte("hello "+req.Method))
+		resp.Header.Set("X-Host", req.Host)
+		return resp
+	}
+	return errorResponse(404)
+}
+
+// startH2Server enables h2c for the test and serves h2TestHandler the way
+// main wires it.
+func startH2Server(t *testing.T, task TaskType) string {
+	t.Helper()
+	old := h2cEnabled
+	h2cEnabled = true
+	t.Cleanup(func() {
+		h2cEnabled = old
+	})
+	s := NewServer(task, 4)
+	return startServer(t, s, s.h2cHandler(h2TestHandler))
+}
+
+// h2Client speaks HTTP/2 with prior knowledge over plain TCP and counts the
+// connections it opens.
+func h2Client(t *testing.T) (*http.Client, *int32) {
+	var dials int32
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}, &dials
+}
+
+func h2Do(client *http.Client, method, url string, body []byte) (*http.Response, []byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.ProtoMajor != 2 {
+		return nil, nil, fmt.Errorf("response over %s", resp.Proto)
+	}
+	return resp, data, nil
+}
+
+func TestH2PriorKnowledge(t *testing.T) {
+	for _, task := range []TaskType{TaskB, TaskD, TaskE} {
+		t.Run(task.String(), func(t *testing.T) {
+			addr := startH2Server(t, task)
+			client, dials := h2Client(t)
+			base := "http://" + addr
+
+			resp, body, err := h2Do(client, "GET", base+"/hello", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 200 || string(body) != "hello GET" || resp.Header.Get("X-Host") != addr {
+				t.Errorf("GET /hello - %d %q, X-Host %q", resp.StatusCode, body, resp.Header.Get("X-Host"))
+			}
+
+			// a body shorter than its Content-Length resets the stream
+			if _, body, err = h2Do(client, "GET", base+"/short", nil); err == nil {
+				t.Errorf("GET /short - %d bytes and no error", len(body))
+			}
+
+			if resp, body, err = h2Do(client, "HEAD", base+"/big", nil); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 200 || len(body) != 0 {
+				t.Errorf("HEAD /big - %d with %d bytes", resp.StatusCode, len(body))
+			}
+
+			if resp, _, err = h2Do(client, "GET", base+"/missing", nil); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 404 {
+				t.Errorf("GET /missing - %d", resp.StatusCode)
+			}
+
+			// uploads and downloads past the initial windows need WINDOW_UPDATEs
+			// in both directions
+			if resp, body, err = h2Do(client, "POST", base+"/echo", h2Body); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 200 || !bytes.Equal(body, h2Body) {
+				t.Errorf("POST /echo - %d, echoed %d of %d bytes", resp.StatusCode, len(body), len(h2Body))
+			}
+
+			// concurrent requests are multiplexed on the same connection
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+			for i := 0; i < cap(errs); i++ {
+				path := []string{"/big", "/stream"}[i%2]
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, body, err := h2Do(client, "GET", base+path, nil)
+					if err == nil && (resp.StatusCode != 200 || !bytes.Equal(body, h2Body)) {
+						err = fmt.Errorf("GET %s - %d with %d bytes", path, resp.StatusCode, len(body))
+					}
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+
+			if n := atomic.LoadInt32(dials); n != 1 {
+				t.Errorf("client opened %d connections, want 1", n)
+			}
+		})
+	}
+}
+
+func TestH2Upgrade(t *testing.T) {
+	addr := startH2Server(t, TaskB)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// HTTP2-Settings is SETTINGS_MAX_CONCURRENT_STREAMS = 100
+	if _, err := io.WriteString(conn, "POST /echo HTTP/1.1\r\nHost: test\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n"+
+		"Content-Length: 5\r\n\r\nhello"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 || !strings.EqualFold(resp.Header.Get("Upgrade"), "h2c") {
+		t.Fatalf("upgrade answered %d, Upgrade %q", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatal(err)
+	}
+	framer := http2.NewFramer(conn, r)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upgraded request is answered on stream 1
+	var status string
+	var body []byte
+	dec := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		if f.Name == ":status" {
+			status = f.Value
+		}
+	})
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err := framer.WriteSettingsAck(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			continue
+		case *http2.HeadersFrame:
+			if f.StreamID != 1 || !f.HeadersEnded() {
+				t.Fatalf("HEADERS on stream %d", f.StreamID)
+			}
+			if _, err := dec.Write(f.HeaderBlockFragment()); err != nil {
+				t.Fatal(err)
+			}
+			if !f.StreamEnded() {
+				continue
+			}
+		case *http2.DataFrame:
+			if f.StreamID != 1 {
+				t.Fatalf("DATA on stream %d", f.StreamID)
+			}
+			body = append(body, f.Data()...)
+			if !f.StreamEnded() {
+				continue
+			}
+		case *http2.GoAwayFrame:
+			t.Fatalf("GOAWAY %v", f.ErrCode)
+		default:
+			continue
+		}
+		break
+	}
+	if status != "200" || string(body) != "hello" {
+		t.Errorf("stream 1 - %s %q", status, body)
+	}
+}
+
+// h2Raw opens a prior knowledge connection driven frame by frame.
+type h2Raw struct {
+	t      *testing.T
+	framer *http2.Framer
+	enc    *hpack.Encoder
+	block  bytes.Buffer
+}
+
+func dialH2Raw(t *testing.T, addr string) *h2Raw {
+	conn, _ := dialKeepAlive(t, addr)
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatal(err)
+	}
+	c := &h2Raw{t: t, framer: http2.NewFramer(conn, conn)}
+	c.enc = hpack.NewEncoder(&c.block)
+	if err := c.framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *h2Raw) post(id uint32, path string) {
+	c.block.Reset()
+	for _, f := range []hpack.HeaderField{{Name: ":method", Value: "POST"}, {Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "test"}, {Name: ":path", Value: path}} {
+		if err := c.enc.WriteField(f); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	if err := c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: c.block.Bytes(), EndHeaders: true}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *h2Raw) data(id uint32, n int, end bool) {
+	for {
+		k := n
+		if k > h2MaxFrameSize {
+			k = h2MaxFrameSize
+		}
+		n -= k
+		if err := c.framer.WriteData(id, end && n == 0, make([]byte, k)); err != nil {
+			c.t.Fatal(err)
+		}
+		if n == 0 {
+			return
+		}
+	}
+}
+
+// next returns the next RST_STREAM or the body size of the next complete
+// response, other frames are answered or skipped. Only the connection
+// window is reopened, a response must fit in the initial stream window.
+func (c *h2Raw) next() (id uint32, code http2.ErrCode, body int) {
+	for {
+		frame, err := c.framer.ReadFrame()
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err := c.framer.WriteSettingsAck(); err != nil {
+					c.t.Fatal(err)
+				}
+			}
+		case *http2.RSTStreamFrame:
+			return f.StreamID, f.ErrCode, 0
+		case *http2.DataFrame:
+			body += len(f.Data())
+			if n := uint32(len(f.Data())); n > 0 {
+				if err := c.framer.WriteWindowUpdate(0, n); err != nil {
+					c.t.Fatal(err)
+				}
+			}
+			if f.StreamEnded() {
+				return f.StreamID, http2.ErrCodeNo, body
+			}
+		case *http2.GoAwayFrame:
+			c.t.Fatalf("GOAWAY %v", f.ErrCode)
+		}
+	}
+}
+
+// TestH2BufferedBodies uploads more than a connection may buffer, the stream
+// that crosses the limit is reset and the others are served.
+func TestH2BufferedBodies(t *testing.T) {
+	old := h2MaxBuffered
+	h2MaxBuffered = 100000
+	t.Cleanup(func() {
+		h2MaxBuffered = old
+	})
+	c := dialH2Raw(t, startH2Server(t, TaskB))
+
+	c.post(1, "/echo")
+	c.data(1, 60000, false)
+	c.post(3, "/echo")
+	c.data(3, 60000, false)
+	if id, code, _ := c.next(); id != 3 || code != http2.ErrCodeFlowControl {
+		t.Fatalf("stream %d ended with %v, want stream 3 reset with FLOW_CONTROL_ERROR", id, code)
+	}
+
+	c.data(1, 0, true)
+	if id, code, n := c.next(); id != 1 || code != http2.ErrCodeNo || n != 60000 {
+		t.Fatalf("stream %d ended with %v after %d bytes", id, code, n)
+	}
+	// the answered stream gave its buffer back
+	c.post(5, "/echo")
+	c.data(5, 60000, true)
+	if id, code, n := c.next(); id != 5 || code != http2.ErrCodeNo || n != 60000 {
+		t.Fatalf("stream %d ended with %v after %d bytes", id, code, n)
+	}
+}
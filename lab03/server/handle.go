@@ -1,104 +1,282 @@
 package main
 
 import (
-	"fmt"
+	"bufio"
+	"errors"
 	"io"
 	"log"
 	"net"
-	"os"
+	"path"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
-const (
-	BufCap      = 2048
-	ResourceDir = "examples/"
-)
+const BufCap = 2048
 
 var (
-	NotFound      = []byte("HTTP/1.1 404 Not Found" + separator() + separator())
-	Ok            = []byte("HTTP/1.1 200 OK" + separator())
-	ContentType   = []byte("Content-Type: text/plain; charset=UTF-8" + separator())
-	ContentLength = []byte("Content-Length: ")
+	idleTimeout        = 5 * time.Second
+	readHeaderTimeout  = 5 * time.Second
+	readBodyTimeout    = 30 * time.Second
+	writeTimeout       = 30 * time.Second
+	maxRequestsPerConn = 100
 )
 
-func handleConn(conn net.Conn) {
+type Handler func(req *Request) *Response
+
+// handleConn serves a connection the caller has already tracked.
+func (s *Server) handleConn(conn net.Conn, handler Handler) {
+	defer s.untrackConn(conn)
 	defer func(conn net.Conn) {
 		err := conn.Close()
-		if err != nil {
-			log.Fatal(err.Error())
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error closing connection - %s", err.Error())
 		}
 	}(conn)
 
-	buf := make([]byte, BufCap)
-	n, err := conn.Read(buf)
+	r := bufio.NewReaderSize(conn, BufCap)
+	w := bufio.NewWriterSize(conn, BufCap)
+	s.serveConn(conn, bufio.NewReadWriter(r, w), handler, 1)
+}
 
-	if err != nil && err != io.EOF {
-		log.Printf("Error reading connection - %s", err.Error())
-		return
-	}
-	buf = buf[:n]
-	//fmt.Println("--------------------------------------------")
-	//fmt.Println(string(buf))
-	//fmt.Println("--------------------------------------------")
-	req := strings.Split(string(buf), " ")
-	if len(req) < 2 {
-		log.Printf("Error parsing request - %v", req)
-		if _, err := conn.Write(NotFound); err != nil {
-			log.Printf("Error writing response - %s", err.Error())
+// serveConn answers requests on conn until it is done, served is the
+// number of the next request. The output is flushed before it returns.
+func (s *Server) serveConn(conn net.Conn, rw *bufio.ReadWriter, handler Handler, served int) {
+	r, w := rw.Reader, rw.Writer
+	defer func() {
+		if err := w.Flush(); err != nil {
+			s.connError("Error writing response", err)
+		}
+	}()
+
+	for ; ; served++ {
+		// a new connection gets only the header timeout to send its first
+		// request, a kept-alive one may stay idle for longer
+		wait := idleTimeout
+		if served == 1 {
+			wait = readHeaderTimeout
+		}
+		if !s.setDeadline(conn.SetReadDeadline, wait) {
+			return
+		}
+
+		// an idle connection closed or timed out between requests is not an error,
+		// the first request of a freshly accepted connection is always awaited
+		s.setIdle(conn, served > 1)
+		if _, err := r.Peek(1); err != nil {
+			return
+		}
+		s.setIdle(conn, false)
+		start := time.Now()
+
+		if served == 1 && h2cEnabled && isH2Preface(r) {
+			if err := conn.SetDeadline(time.Time{}); err != nil {
+				s.connError("Error setting deadline", err)
+				return
+			}
+			s.serveH2(conn, bufio.NewReadWriter(r, w), handler, nil, nil)
+			return
+		}
+
+		// the header deadline is absolute, so dribbling bytes does not extend it
+		if served > 1 && !s.setDeadline(conn.SetReadDeadline, readHeaderTimeout) {
+			return
+		}
+		req, err := readRequest(r)
+		if err != nil {
+			s.connError("Error parsing request", err)
+			resp := errorResponse(statusOf(err))
+			if s.setDeadline(conn.SetWriteDeadline, writeTimeout) {
+				if _, err := writeResponse(w, nil, resp, false); err != nil {
+					s.connError("Error writing response", err)
+				}
+			}
+			logAccess(nil, resp, conn.RemoteAddr().String(), start)
+			return
+		}
+
+		req.RemoteAddr = conn.RemoteAddr().String()
+
+		if !s.setDeadline(conn.SetReadDeadline, readBodyTimeout) {
+			return
+		}
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") && req.Proto == "HTTP/1.1" {
+			req.Body = &continueReader{r: req.Body, w: w}
+		}
+		resp := handler(req)
+		atomic.AddInt64(&s.stats.requests, 1)
+		keepAlive := shouldKeepAlive(req) && canKeepAlive(req, resp) &&
+			served < maxRequestsPerConn && !s.isClosing()
+
+		if !s.setDeadline(conn.SetWriteDeadline, writeTimeout) {
+			resp.finish()
+			return
+		}
+		n, err := writeResponse(w, req, resp, keepAlive)
+		if err != nil || resp.Upgrade == nil {
+			resp.finish()
+		}
+		if err != nil {
+			s.connError("Error writing response", err)
+			return
+		}
+		log.Printf("%s %s %s - %d, written response: %d bytes", req.Method, req.Target, req.Proto, resp.Status, n)
+		logAccess(req, resp, req.RemoteAddr, start)
+
+		if resp.Upgrade != nil {
+			s.upgrade(conn, bufio.NewReadWriter(r, w), resp)
 			return
 		}
-		return
-	}
 
-	fileName := strings.Trim(req[1], "/")
-	fileLength, err := os.ReadFile(ResourceDir + fileName)
-	if err != nil {
-		log.Printf("Error reading file - %s\n", err.Error())
-		if _, err := conn.Write(NotFound); err != nil {
-			log.Printf("Error writing response - %s", err.Error())
+		if !keepAlive {
+			return
+		}
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			s.connError("Error discarding request body", err)
 			return
 		}
+		// pipelined requests are answered in one batch
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				s.connError("Error writing response", err)
+				return
+			}
+		}
+	}
+}
+
+// upgrade hands the connection over to resp.Upgrade, deadlines are cleared
+// and the protocol handler is responsible for its own timeouts.
+func (s *Server) upgrade(conn net.Conn, rw *bufio.ReadWriter, resp *Response) {
+	defer resp.finish()
+	if err := rw.Flush(); err != nil {
+		s.connError("Error writing response", err)
 		return
 	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		s.connError("Error setting deadline", err)
+		return
+	}
+	resp.Upgrade(conn, rw)
+}
 
-	n, err = conn.Write([]byte(createOkResponse(fileLength)))
-	if err != nil {
-		log.Printf("Error writing response: %s\n", err.Error())
+func serve(req *Request) *Response {
+	vh := currentHosts().lookup(req.Host)
+	resp := serveHost(vh, req)
+	vh.decorate(resp)
+	return resp
+}
+
+// waitsOnUpstream reports whether serve passes req to a proxy route or a
+// CGI script.
+func waitsOnUpstream(req *Request) bool {
+	vh := currentHosts().lookup(req.Host)
+	p := cleanPath(req.URL.Path)
+	return vh.proxyFor(p) != nil || vh.cgiFor(p) != nil
+}
+
+func serveHost(vh *VirtualHost, req *Request) *Response {
+	// rules, routes and files all see the same cleaned path, otherwise
+	// /public/../private would get past a rule for /private
+	req.URL.Path = cleanPath(req.URL.Path)
+	req.URL.RawPath = ""
+	if !vh.allowed(req.URL.Path, req.RemoteAddr) {
+		return errorResponse(403)
+	}
+	if route := vh.proxyFor(req.URL.Path); route != nil {
+		return route.serve(req)
+	}
+	if route := vh.cgiFor(req.URL.Path); route != nil {
+		return route.serve(vh.Root, req)
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return serveFile(vh.Root, vh.Listing, req)
+	}
+	if vh.Uploads != nil && (req.Method == "PUT" || req.Method == "POST" || req.Method == "DELETE") {
+		return vh.Uploads.serve(vh.Root, req)
+	}
+
+	resp := errorResponse(405)
+	if vh.Uploads != nil {
+		resp.Header.Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+	}
+	return resp
+}
+
+// cleanPath resolves dot segments and repeated slashes, keeping the
+// trailing slash that tells a directory listing from a redirect.
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+func logAccess(req *Request, resp *Response, remote string, start time.Time) {
+	if accessLog == nil {
 		return
 	}
-	log.Printf("Written response: %d bytes", n)
+	entry := newAccessEntry(req, remote, start)
+	entry.Status = resp.Status
+	entry.Duration = time.Since(start)
+	entry.Bytes = int(resp.Sent)
+	accessLog.Log(entry)
+}
+
+// continueReader sends 100 Continue before the handler first reads the
+// body, a handler that never reads it lets the client skip sending it.
+type continueReader struct {
+	r    io.Reader
+	w    *bufio.Writer
+	sent bool
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		if _, err := c.w.WriteString("HTTP/1.1 100 Continue" + crlf + crlf); err != nil {
+			return 0, err
+		}
+		if err := c.w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(p)
 }
 
-func handlePull(runners chan struct{}, reqs chan net.Conn) {
-	for req := range reqs {
-		runners <- struct{}{}
-		localReq := req
-		go func(retChan chan struct{}) {
-			handleConn(localReq)
-			<-retChan
-		}(runners)
+func shouldKeepAlive(req *Request) bool {
+	for _, v := range req.Header.Values("Connection") {
+		for _, opt := range strings.Split(v, ",") {
+			opt = strings.TrimSpace(opt)
+			if strings.EqualFold(opt, "close") {
+				return false
+			}
+			if strings.EqualFold(opt, "keep-alive") {
+				return true
+			}
+		}
 	}
+	return req.Proto == "HTTP/1.1"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-func separator() string {
-	var osSep = fmt.Sprintf("%v", os.PathSeparator)
-	var lb = "\n"
-	if osSep != "/" {
-		lb = "\r\n"
+func (s *Server) setDeadline(set func(time.Time) error, timeout time.Duration) bool {
+	if err := set(time.Now().Add(timeout)); err != nil {
+		s.connError("Error setting deadline", err)
+		return false
 	}
-	return lb
+	return true
 }
 
-func createOkResponse(fileData []byte) string {
-	return fmt.Sprintf(
-		"%s%s%d%s%s%s%s%s",
-		Ok,
-		ContentLength,
-		len(fileData),
-		separator(),
-		ContentType,
-		separator(),
-		separator(),
-		fileData,
-	)
+func (s *Server) connError(msg string, err error) {
+	atomic.AddInt64(&s.stats.errors, 1)
+	log.Printf("%s - %s", msg, err.Error())
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pathHandler(req *Request) *Response {
+	return newResponse(200, []byte(req.URL.Path))
+}
+
+// dialKeepAlive opens a connection with a deadline for the whole test.
+func dialKeepAlive(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+// readPath reads one response of pathHandler and checks it answers path.
+func readPath(t *testing.T, r *bufio.Reader, path string) *http.Response {
+	t.Helper()
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("response to %s - %v", path, err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || string(body) != path {
+		t.Fatalf("response to %s - %d %q", path, resp.StatusCode, body)
+	}
+	return resp
+}
+
+// expectClosed checks that the server closed the connection.
+func expectClosed(t *testing.T, r *bufio.Reader) {
+	t.Helper()
+	if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("connection still open, read error %v", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	setTimeouts(t, time.Second, time.Second)
+	oldMax := maxRequestsPerConn
+	maxRequestsPerConn = 5
+	t.Cleanup(func() {
+		maxRequestsPerConn = oldMax
+	})
+
+	for _, task := range []TaskType{TaskA, TaskB, TaskD, TaskE} {
+		t.Run(task.String(), func(t *testing.T) {
+			addr := startServer(t, NewServer(task, 4), pathHandler)
+
+			t.Run("pipelined", func(t *testing.T) {
+				conn, r := dialKeepAlive(t, addr)
+				paths := []string{"/1", "/2", "/3"}
+				var batch string
+				for _, path := range paths {
+					batch += fmt.Sprintf("GET %s HTTP/1.1\r\nHost: test\r\n\r\n", path)
+				}
+				if _, err := io.WriteString(conn, batch); err != nil {
+					t.Fatal(err)
+				}
+				for _, path := range paths {
+					if resp := readPath(t, r, path); resp.Close {
+						t.Fatalf("response to %s closes the connection", path)
+					}
+				}
+				// the socket stays open for the next request
+				if _, err := io.WriteString(conn, "GET /4 HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+					t.Fatal(err)
+				}
+				readPath(t, r, "/4")
+			})
+
+			t.Run("connection close", func(t *testing.T) {
+				conn, r := dialKeepAlive(t, addr)
+				if _, err := io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"+
+					"GET /b HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+					t.Fatal(err)
+				}
+				if resp := readPath(t, r, "/a"); !resp.Close {
+					t.Error("response does not announce Connection: close")
+				}
+				expectClosed(t, r)
+			})
+
+			t.Run("request limit", func(t *testing.T) {
+				conn, r := dialKeepAlive(t, addr)
+				for i := 1; i <= maxRequestsPerConn; i++ {
+					path := fmt.Sprintf("/%d", i)
+					if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: test\r\n\r\n", path); err != nil {
+						t.Fatal(err)
+					}
+					resp := readPath(t, r, path)
+					if last := i == maxRequestsPerConn; resp.Close != last {
+						t.Fatalf("request %d of %d - Connection: close %v", i, maxRequestsPerConn, resp.Close)
+					}
+				}
+				expectClosed(t, r)
+			})
+		})
+	}
+}
+
+// TestShortStream answers with a stream that ends before its announced
+// length, the client must see the connection close instead of waiting for
+// the rest or reading the next response as body.
+func TestShortStream(t *testing.T) {
+	setTimeouts(t, time.Second, time.Second)
+	for _, task := range []TaskType{TaskA, TaskB, TaskD, TaskE} {
+		t.Run(task.String(), func(t *testing.T) {
+			addr := startServer(t, NewServer(task, 4), func(req *Request) *Response {
+				resp := newResponse(200, nil)
+				resp.Stream, resp.Length = strings.NewReader("short"), 10
+				return resp
+			})
+			conn, r := dialKeepAlive(t, addr)
+			if _, err := io.WriteString(conn, "GET /1 HTTP/1.1\r\nHost: test\r\n\r\nGET /2 HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("read %q, error %v, want a truncated body", body, err)
+			}
+			expectClosed(t, r)
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+)
+
+// HPACK header compression (RFC 7541) for the HTTP/2 connections. The
+// decoder supports the full format, the encoder only uses the static table
+// and literals without indexing, so it never needs a dynamic table.
+
+const hpackDefaultTableSize = 4096
+
+var (
+	errHpackIndex   = errors.New("hpack: invalid table index")
+	errHpackInteger = errors.New("hpack: integer overflow")
+	errHpackTrunc   = errors.New("hpack: truncated header block")
+	errHpackHuffman = errors.New("hpack: invalid huffman code")
+	errHpackSize    = errors.New("hpack: table size update above the limit")
+	errHpackString  = errors.New("hpack: string too long")
+)
+
+type headerField struct {
+	Name  string
+	Value string
+}
+
+func (f headerField) size() int {
+	return len(f.Name) + len(f.Value) + 32
+}
+
+var hpackStaticTable = [...]headerField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// static table lookups for the encoder, indexes are 1-based
+var (
+	hpackStaticField = make(map[headerField]int)
+	hpackStaticName  = make(map[string]int)
+)
+
+func init() {
+	for i, f := range hpackStaticTable {
+		hpackStaticField[f] = i + 1
+		if _, ok := hpackStaticName[f.Name]; !ok {
+			hpackStaticName[f.Name] = i + 1
+		}
+	}
+	buildHuffmanTree()
+}
+
+type hpackDecoder struct {
+	// dynamic table, newest entry first
+	table   []headerField
+	size    int
+	maxSize int
+	// limit is the SETTINGS_HEADER_TABLE_SIZE we advertised
+	limit int
+	// maxString bounds a single decoded name or value
+	maxString int
+}
+
+func newHpackDecoder(limit, maxString int) *hpackDecoder {
+	return &hpackDecoder{maxSize: limit, limit: limit, maxString: maxString}
+}
+
+// decode parses a complete header block. Every block must be decoded, even
+// for a stream that gets refused, to keep the dynamic table in sync.
+func (d *hpackDecoder) decode(block []byte) ([]headerField, error) {
+	var fields []headerField
+	first := true
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed header field
+			idx, rest, err := readHpackInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err := d.field(idx)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+			block = rest
+		case b&0xc0 == 0x40: // literal with incremental indexing
+			f, rest, err := d.literal(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(f)
+			fields = append(fields, f)
+			block = rest
+		case b&0xe0 == 0x20: // dynamic table size update
+			if !first {
+				return nil, errors.New("hpack: table size update after a header field")
+			}
+			size, rest, err := readHpackInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.limit) {
+				return nil, errHpackSize
+			}
+			d.maxSize = int(size)
+			d.evict()
+			block = rest
+			continue
+		default: // literal without indexing or never indexed
+			f, rest, err := d.literal(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+			block = rest
+		}
+		first = false
+	}
+	return fields, nil
+}
+
+func (d *hpackDecoder) field(idx uint64) (headerField, error) {
+	switch {
+	case idx == 0:
+		return headerField{}, errHpackIndex
+	case idx <= uint64(len(hpackStaticTable)):
+		return hpackStaticTable[idx-1], nil
+	}
+	idx -= uint64(len(hpackStaticTable)) + 1
+	if idx >= uint64(len(d.table)) {
+		return headerField{}, errHpackIndex
+	}
+	return d.table[idx], nil
+}
+
+func (d *hpackDecoder) literal(block []byte, prefix uint) (headerField, []byte, error) {
+	idx, rest, err := readHpackInt(block, prefix)
+	if err != nil {
+		return headerField{}, nil, err
+	}
+	var f headerField
+	if idx > 0 {
+		named, err := d.field(idx)
+		if err != nil {
+			return headerField{}, nil, err
+		}
+		f.Name = named.Name
+	} else if f.Name, rest, err = d.readString(rest); err != nil {
+		return headerField{}, nil, err
+	}
+	if f.Value, rest, err = d.readString(rest); err != nil {
+		return headerField{}, nil, err
+	}
+	return f, rest, nil
+}
+
+func (d *hpackDecoder) readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errHpackTrunc
+	}
+	huffman := block[0]&0x80 != 0
+	n, rest, err := readHpackInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(rest)) {
+		return "", nil, errHpackTrunc
+	}
+	raw := rest[:n]
+	rest = rest[n:]
+	if !huffman {
+		if len(raw) > d.maxString {
+			return "", nil, errHpackString
+		}
+		return string(raw), rest, nil
+	}
+	s, err := huffmanDecode(raw, d.maxString)
+	return s, rest, err
+}
+
+func (d *hpackDecoder) add(f headerField) {
+	// an entry larger than the whole table just empties it
+	d.table = append([]headerField{f}, d.table...)
+	d.size += f.size()
+	d.evict()
+}
+
+func (d *hpackDecoder) evict() {
+	for d.size > d.maxSize && len(d.table) > 0 {
+		last := d.table[len(d.table)-1]
+		d.table = d.table[:len(d.table)-1]
+		d.size -= last.size()
+	}
+}
+
+// readHpackInt decodes an integer with an N-bit prefix (RFC 7541 5.1).
+func readHpackInt(block []byte, prefix uint) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, errHpackTrunc
+	}
+	mask := uint64(1)<<prefix - 1
+	v := uint64(block[0]) & mask
+	block = block[1:]
+	if v < mask {
+		return v, block, nil
+	}
+	var shift uint
+	for i, b := range block {
+		if shift > 28 {
+			return 0, nil, errHpackInteger
+		}
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, block[i+1:], nil
+		}
+		shift += 7
+	}
+	return 0, nil, errHpackTrunc
+}
+
+func appendHpackInt(dst []byte, first byte, prefix uint, v uint64) []byte {
+	mask := uint64(1)<<prefix - 1
+	if v < mask {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(mask))
+	v -= mask
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendHpackString(dst []byte, s string) []byte {
+	dst = appendHpackInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// appendHeaderField encodes f, names must already be lower case. Fields
+// are never added to the peer's dynamic table.
+func appendHeaderField(dst []byte, f headerField) []byte {
+	if idx, ok := hpackStaticField[f]; ok {
+		return appendHpackInt(dst, 0x80, 7, uint64(idx))
+	}
+	if idx, ok := hpackStaticName[f.Name]; ok {
+		dst = appendHpackInt(dst, 0, 4, uint64(idx))
+	} else {
+		dst = append(dst, 0)
+		dst = appendHpackString(dst, f.Name)
+	}
+	return appendHpackString(dst, f.Value)
+}
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int // -1 for inner nodes, 256 for EOS
+}
+
+var huffmanRoot *huffmanNode
+
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{sym: -1}
+	insert := func(code uint32, length uint8, sym int) {
+		n := huffmanRoot
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := code >> uint(i) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{sym: -1}
+			}
+			n = n.children[bit]
+		}
+		n.sym = sym
+	}
+	for sym := 0; sym < 256; sym++ {
+		insert(huffmanCodes[sym], huffmanCodeLen[sym], sym)
+	}
+	insert(0x3fffffff, 30, 256)
+}
+
+// huffmanDecode walks the code tree bit by bit. The padding must be a
+// prefix of EOS shorter than 8 bits and EOS itself must not appear.
+func huffmanDecode(src []byte, maxLen int) (string, error) {
+	out := make([]byte, 0, len(src)*8/5)
+	n := huffmanRoot
+	depth, ones := 0, true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := b >> uint(i) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", errHpackHuffman
+			}
+			depth++
+			ones = ones && bit == 1
+			if n.sym < 0 {
+				continue
+			}
+			if n.sym == 256 {
+				return "", errHpackHuffman
+			}
+			if len(out) == maxLen {
+				return "", errHpackString
+			}
+			out = append(out, byte(n.sym))
+			n, depth, ones = huffmanRoot, 0, true
+		}
+	}
+	if depth > 7 || !ones {
+		return "", errHpackHuffman
+	}
+	return string(out), nil
+}
+
+// huffmanCodes and huffmanCodeLen are the code table of RFC 7541 Appendix B,
+// indexed by byte value. EOS (0x3fffffff, 30 bits) is never encoded.
+var huffmanCodes = [256]uint32{
+	0x1ff8, 0x7fffd8, 0xfffffe2, 0xfffffe3, 0xfffffe4, 0xfffffe5, 0xfffffe6, 0xfffffe7,
+	0xfffffe8, 0xffffea, 0x3ffffffc, 0xfffffe9, 0xfffffea, 0x3ffffffd, 0xfffffeb, 0xfffffec,
+	0xfffffed, 0xfffffee, 0xfffffef, 0xffffff0, 0xffffff1, 0xffffff2, 0x3ffffffe, 0xffffff3,
+	0xffffff4, 0xffffff5, 0xffffff6, 0xffffff7, 0xffffff8, 0xffffff9, 0xffffffa, 0xffffffb,
+	0x14, 0x3f8, 0x3f9, 0xffa, 0x1ff9, 0x15, 0xf8, 0x7fa,
+	0x3fa, 0x3fb, 0xf9, 0x7fb, 0xfa, 0x16, 0x17, 0x18,
+	0x0, 0x1, 0x2, 0x19, 0x1a, 0x1b, 0x1c, 0x1d,
+	0x1e, 0x1f, 0x5c, 0xfb, 0x7ffc, 0x20, 0xffb, 0x3fc,
+	0x1ffa, 0x21, 0x5d, 0x5e, 0x5f, 0x60, 0x61, 0x62,
+	0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a,
+	0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72,
+	0xfc, 0x73, 0xfd, 0x1ffb, 0x7fff0, 0x1ffc, 0x3ffc, 0x22,
+	0x7ffd, 0x3, 0x23, 0x4, 0x24, 0x5, 0x25, 0x26,
+	0x27, 0x6, 0x74, 0x75, 0x28, 0x29, 0x2a, 0x7,
+	0x2b, 0x76, 0x2c, 0x8, 0x9, 0x2d, 0x77, 0x78,
+	0x79, 0x7a, 0x7b, 0x7ffe, 0x7fc, 0x3ffd, 0x1ffd, 0xffffffc,
+	0xfffe6, 0x3fffd2, 0xfffe7, 0xfffe8, 0x3fffd3, 0x3fffd4, 0x3fffd5, 0x7fffd9,
+	0x3fffd6, 0x7fffda, 0x7fffdb, 0x7fffdc, 0x7fffdd, 0x7fffde, 0xffffeb, 0x7fffdf,
+	0xffffec, 0xffffed, 0x3fffd7, 0x7fffe0, 0xffffee, 0x7fffe1, 0x7fffe2, 0x7fffe3,
+	0x7fffe4, 0x1fffdc, 0x3fffd8, 0x7fffe5, 0x3fffd9, 0x7fffe6, 0x7fffe7, 0xffffef,
+	0x3fffda, 0x1fffdd, 0xfffe9, 0x3fffdb, 0x3fffdc, 0x7fffe8, 0x7fffe9, 0x1fffde,
+	0x7fffea, 0x3fffdd, 0x3fffde, 0xfffff0, 0x1fffdf, 0x3fffdf, 0x7fffeb, 0x7fffec,
+	0x1fffe0, 0x1fffe1, 0x3fffe0, 0x1fffe2, 0x7fffed, 0x3fffe1, 0x7fffee, 0x7fffef,
+	0xfffea, 0x3fffe2, 0x3fffe3, 0x3fffe4, 0x7ffff0, 0x3fffe5, 0x3fffe6, 0x7ffff1,
+	0x3ffffe0, 0x3ffffe1, 0xfffeb, 0x7fff1, 0x3fffe7, 0x7ffff2, 0x3fffe8, 0x1ffffec,
+	0x3ffffe2, 0x3ffffe3, 0x3ffffe4, 0x7ffffde, 0x7ffffdf, 0x3ffffe5, 0xfffff1, 0x1ffffed,
+	0x7fff2, 0x1fffe3, 0x3ffffe6, 0x7ffffe0, 0x7ffffe1, 0x3ffffe7, 0x7ffffe2, 0xfffff2,
+	0x1fffe4, 0x1fffe5, 0x3ffffe8, 0x3ffffe9, 0xffffffd, 0x7ffffe3, 0x7ffffe4, 0x7ffffe5,
+	0xfffec, 0xfffff3, 0xfffed, 0x1fffe6, 0x3fffe9, 0x1fffe7, 0x1fffe8, 0x7ffff3,
+	0x3fffea, 0x3fffeb, 0x1ffffee, 0x1ffffef, 0xfffff4, 0xfffff5, 0x3ffffea, 0x7ffff4,
+	0x3ffffeb, 0x7ffffe6, 0x3ffffec, 0x3ffffed, 0x7ffffe7, 0x7ffffe8, 0x7ffffe9, 0x7ffffea,
+	0x7ffffeb, 0xffffffe, 0x7ffffec, 0x7ffffed, 0x7ffffee, 0x7ffffef, 0x7fffff0, 0x3ffffee,
+}
+
+var huffmanCodeLen = [256]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+}
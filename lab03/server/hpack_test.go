@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+func dehex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// hpackStep is one header block of RFC 7541 Appendix C with the fields it
+// decodes to and the dynamic table after it.
+type hpackStep struct {
+	block string
+	want  []headerField
+	table []headerField
+	size  int
+}
+
+var (
+	c2Request = []headerField{
+		{":method", "GET"},
+		{":scheme", "http"},
+		{":path", "/"},
+		{":authority", "www.example.com"},
+	}
+	c2NoCache = append(append([]headerField{}, c2Request...), headerField{"cache-control", "no-cache"})
+	c2Custom  = []headerField{
+		{":method", "GET"},
+		{":scheme", "https"},
+		{":path", "/index.html"},
+		{":authority", "www.example.com"},
+		{"custom-key", "custom-value"},
+	}
+	c3Tables = [][]headerField{
+		{{":authority", "www.example.com"}},
+		{{"cache-control", "no-cache"}, {":authority", "www.example.com"}},
+		{{"custom-key", "custom-value"}, {"cache-control", "no-cache"}, {":authority", "www.example.com"}},
+	}
+
+	c5Responses = [][]headerField{
+		{
+			{":status", "302"},
+			{"cache-control", "private"},
+			{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+			{"location", "https://www.example.com"},
+		},
+		{
+			{":status", "307"},
+			{"cache-control", "private"},
+			{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+			{"location", "https://www.example.com"},
+		},
+		{
+			{":status", "200"},
+			{"cache-control", "private"},
+			{"date", "Mon, 21 Oct 2013 20:13:22 GMT"},
+			{"location", "https://www.example.com"},
+			{"content-encoding", "gzip"},
+			{"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+		},
+	}
+	c5Tables = [][]headerField{
+		{
+			{"location", "https://www.example.com"},
+			{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+			{"cache-control", "private"},
+			{":status", "302"},
+		},
+		{
+			{":status", "307"},
+			{"location", "https://www.example.com"},
+			{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+			{"cache-control", "private"},
+		},
+		{
+			{"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+			{"content-encoding", "gzip"},
+			{"date", "Mon, 21 Oct 2013 20:13:22 GMT"},
+		},
+	}
+)
+
+func TestHpackDecodeFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+		want  headerField
+		table []headerField
+	}{
+		// C.2.1 literal header field with indexing
+		{
+			name:  "C.2.1",
+			block: "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572",
+			want:  headerField{"custom-key", "custom-header"},
+			table: []headerField{{"custom-key", "custom-header"}},
+		},
+		// C.2.2 literal header field without indexing
+		{
+			name:  "C.2.2",
+			block: "040c 2f73 616d 706c 652f 7061 7468",
+			want:  headerField{":path", "/sample/path"},
+		},
+		// C.2.3 literal header field never indexed
+		{
+			name:  "C.2.3",
+			block: "1008 7061 7373 776f 7264 0673 6563 7265 74",
+			want:  headerField{"password", "secret"},
+		},
+		// C.2.4 indexed header field
+		{
+			name:  "C.2.4",
+			block: "82",
+			want:  headerField{":method", "GET"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newHpackDecoder(hpackDefaultTableSize, MaxHeaderBytes)
+			fields, err := d.decode(dehex(tt.block))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fields) != 1 || fields[0] != tt.want {
+				t.Errorf("decoded %v, want %v", fields, tt.want)
+			}
+			if !reflect.DeepEqual(d.table, tt.table) {
+				t.Errorf("dynamic table %v, want %v", d.table, tt.table)
+			}
+		})
+	}
+}
+
+func TestHpackDecodeSequences(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		steps []hpackStep
+	}{
+		{
+			name:  "C.3 requests",
+			limit: hpackDefaultTableSize,
+			steps: []hpackStep{
+				{"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", c2Request, c3Tables[0], 57},
+				{"8286 84be 5808 6e6f 2d63 6163 6865", c2NoCache, c3Tables[1], 110},
+				{"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", c2Custom, c3Tables[2], 164},
+			},
+		},
+		{
+			name:  "C.4 requests with huffman",
+			limit: hpackDefaultTableSize,
+			steps: []hpackStep{
+				{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", c2Request, c3Tables[0], 57},
+				{"8286 84be 5886 a8eb 1064 9cbf", c2NoCache, c3Tables[1], 110},
+				{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", c2Custom, c3Tables[2], 164},
+			},
+		},
+		{
+			name:  "C.5 responses",
+			limit: 256,
+			steps: []hpackStep{
+				{`4803 3330 3258 0770 7269 7661 7465 611d
+				4d6f 6e2c 2032 3120 4f63 7420 3230 3133
+				2032 303a 3133 3a32 3120 474d 546e 1768
+				7474 7073 3a2f 2f77 7777 2e65 7861 6d70
+				6c65 2e63 6f6d`, c5Responses[0], c5Tables[0], 222},
+				{"4803 3330 37c1 c0bf", c5Responses[1], c5Tables[1], 222},
+				{`88c1 611d 4d6f 6e2c 2032 3120 4f63 7420
+				3230 3133 2032 303a 3133 3a32 3220 474d
+				54c0 5a04 677a 6970 7738 666f 6f3d 4153
+				444a 4b48 514b 425a 584f 5157 454f 5049
+				5541 5851 5745 4f49 553b 206d 6178 2d61
+				6765 3d33 3630 303b 2076 6572 7369 6f6e
+				3d31`, c5Responses[2], c5Tables[2], 215},
+			},
+		},
+		{
+			name:  "C.6 responses with huffman",
+			limit: 256,
+			steps: []hpackStep{
+				{`4882 6402 5885 aec3 771a 4b61 96d0 7abe
+				9410 54d4 44a8 2005 9504 0b81 66e0 82a6
+				2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8
+				e9ae 82ae 43d3`, c5Responses[0], c5Tables[0], 222},
+				{"4883 640e ffc1 c0bf", c5Responses[1], c5Tables[1], 222},
+				{`88c1 6196 d07a be94 1054 d444 a820 0595
+				040b 8166 e084 a62d 1bff c05a 839b d9ab
+				77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b
+				3960 d5af 2708 7f36 72c1 ab27 0fb5 291f
+				9587 3160 65c0 03ed 4ee5 b106 3d50 07`, c5Responses[2], c5Tables[2], 215},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// every block of a sequence shares the connection's decoder
+			d := newHpackDecoder(tt.limit, MaxHeaderBytes)
+			for i, step := range tt.steps {
+				fields, err := d.decode(dehex(step.block))
+				if err != nil {
+					t.Fatalf("block %d: %v", i+1, err)
+				}
+				if !reflect.DeepEqual(fields, step.want) {
+					t.Errorf("block %d: decoded %v, want %v", i+1, fields, step.want)
+				}
+				if !reflect.DeepEqual(d.table, step.table) {
+					t.Errorf("block %d: dynamic table %v, want %v", i+1, d.table, step.table)
+				}
+				if d.size != step.size {
+					t.Errorf("block %d: table size %d, want %d", i+1, d.size, step.size)
+				}
+			}
+		})
+	}
+}
+
+func TestHpackDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+		want  error
+	}{
+		{name: "index zero", block: "80", want: errHpackIndex},
+		{name: "index past the tables", block: "be", want: errHpackIndex},
+		{name: "truncated string", block: "0003 6162", want: errHpackTrunc},
+		{name: "integer overflow", block: "ff ff ff ff ff ff ff", want: errHpackInteger},
+		{name: "size update above the limit", block: "3fe2 1f", want: errHpackSize},
+		// EOS padding longer than 7 bits
+		{name: "huffman padding", block: "0081 ff", want: errHpackHuffman},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newHpackDecoder(hpackDefaultTableSize, MaxHeaderBytes)
+			if _, err := d.decode(dehex(tt.block)); err != tt.want {
+				t.Errorf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+var roundTripFields = []headerField{
+	{":status", "200"},
+	{":status", "418"},
+	{"content-type", "text/html; charset=utf-8"},
+	{"content-length", "1234"},
+	{"x-custom", "value"},
+	{"x-empty", ""},
+	{"set-cookie", strings.Repeat("a", 300)},
+	{"x-binary", "\x00\x7f\xff"},
+}
+
+// TestHpackRoundTrip encodes fields the way the server writes responses and
+// decodes them with both decoders.
+func TestHpackRoundTrip(t *testing.T) {
+	var block []byte
+	for _, f := range roundTripFields {
+		block = appendHeaderField(block, f)
+	}
+
+	fields, err := newHpackDecoder(hpackDefaultTableSize, MaxHeaderBytes).decode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fields, roundTripFields) {
+		t.Errorf("decoded %v, want %v", fields, roundTripFields)
+	}
+
+	decoded, err := hpack.NewDecoder(hpackDefaultTableSize, nil).DecodeFull(block)
+	if err != nil {
+		t.Fatalf("x/net decoder: %v", err)
+	}
+	if len(decoded) != len(roundTripFields) {
+		t.Fatalf("x/net decoded %v", decoded)
+	}
+	for i, f := range decoded {
+		if f.Name != roundTripFields[i].Name || f.Value != roundTripFields[i].Value || f.Sensitive {
+			t.Errorf("x/net decoded %v, want %v", f, roundTripFields[i])
+		}
+	}
+}
+
+// TestHpackDecodeEncoder decodes blocks of the x/net encoder, which indexes
+// fields and uses huffman codes, across table size changes.
+func TestHpackDecodeEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	d := newHpackDecoder(hpackDefaultTableSize, MaxHeaderBytes)
+	for i, size := range []uint32{hpackDefaultTableSize, 256, 0, 1024} {
+		buf.Reset()
+		enc.SetMaxDynamicTableSize(size)
+		for _, f := range roundTripFields {
+			if err := enc.WriteField(hpack.HeaderField{Name: f.Name, Value: f.Value, Sensitive: f.Name == "set-cookie"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fields, err := d.decode(buf.Bytes())
+		if err != nil {
+			t.Fatalf("block %d: %v", i+1, err)
+		}
+		if !reflect.DeepEqual(fields, roundTripFields) {
+			t.Errorf("block %d: decoded %v, want %v", i+1, fields, roundTripFields)
+		}
+		if d.size > int(size) {
+			t.Errorf("block %d: table size %d above %d", i+1, d.size, size)
+		}
+	}
+}
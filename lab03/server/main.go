@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type TaskType int
@@ -14,21 +20,157 @@ const (
 	TaskA TaskType = iota
 	TaskB
 	TaskD
+	TaskE
 	host = "localhost"
 )
 
 var limit int = 1
 
+var configPath string
+
 func main() {
-	modeFlag := flag.String("t", "A", "task")
+	modeFlag := flag.String("t", "A", "task: A, B, D or E (epoll event loop)")
 	portFlag := flag.Int("p", 8080, "server port")
 	boundFlag := flag.Int("l", 1, "concurrency level")
+	loopsFlag := flag.Int("loops", 1, "number of event loops in mode E")
+	idleFlag := flag.Duration("i", idleTimeout, "keep-alive idle timeout")
+	headerFlag := flag.Duration("rh", readHeaderTimeout, "timeout for reading request headers")
+	bodyFlag := flag.Duration("rb", readBodyTimeout, "timeout for reading a request body")
+	writeFlag := flag.Duration("w", writeTimeout, "timeout for writing a response")
+	perIPFlag := flag.Int("ip", 0, "max simultaneous connections per client IP, 0 for unlimited")
+	requestsFlag := flag.Int("r", maxRequestsPerConn, "max requests per connection")
+	rootFlag := flag.String("d", docRoot, "document root")
+	listFlag := flag.Bool("ls", listingDirs, "generate listings for directories without index.html")
+	compressFlag := flag.Int("z", compressThreshold, "min body size in bytes for on-the-fly gzip, negative to disable")
+	tlsPortFlag := flag.Int("tp", 0, "HTTPS port, 0 to disable TLS")
+	certFlag := flag.String("cert", "", "comma-separated certificate files")
+	keyFlag := flag.String("key", "", "comma-separated key files, paired with -cert")
+	selfSignedFlag := flag.String("self-signed", "", "comma-separated host names for a generated self-signed certificate")
+	redirectFlag := flag.Bool("redirect", false, "redirect plain HTTP requests to HTTPS")
+	shutdownFlag := flag.Duration("g", 10*time.Second, "graceful shutdown timeout")
+	configFlag := flag.String("c", "", "virtual hosts config file, reloaded on SIGHUP, replaces the default host flags -d, -ls, -uploads and -cgi")
+	forwardFlag := flag.Bool("fp", false, "run as a caching forward proxy instead of a file server")
+	cacheFlag := flag.String("cache", "", "forward proxy cache directory, empty to disable caching")
+	blocklistFlag := flag.String("blocklist", "", "file with domains the forward proxy refuses, one per line")
+	connectFlag := flag.String("connect-ports", "443", "comma-separated ports allowed for CONNECT")
+	uploadsFlag := flag.String("uploads", "", "users file (name:sha256hex) enabling PUT/POST/DELETE for the default host")
+	uploadMaxFlag := flag.Int64("upload-max", defaultUploadMax, "max upload size in bytes")
+	cgiFlag := flag.String("cgi", "", "directory of CGI scripts served under /cgi-bin/ for the default host")
+	cgiTimeoutFlag := flag.Duration("cgi-timeout", defaultCGITimeout, "CGI script execution timeout")
+	cgiOutputFlag := flag.Int64("cgi-output", defaultCGIMaxOutput, "max CGI script output in bytes")
+	fileCacheFlag := flag.Int64("fc", 0, "in-memory file cache size in megabytes, 0 to disable")
+	fileEntryFlag := flag.Int64("fc-entry", 1<<20, "largest file kept in the file cache, in bytes")
+	filePollFlag := flag.Duration("fc-poll", 2*time.Second, "interval for dropping changed files from the cache, 0 to disable")
+	wsFlag := flag.String("ws", "", "path prefix of the WebSocket echo and chat endpoints (<prefix>/echo, <prefix>/chat) on every host, empty to disable")
+	h2cFlag := flag.Bool("h2c", h2cEnabled, "accept cleartext HTTP/2 with prior knowledge or through Upgrade: h2c")
+	statusFlag := flag.String("status", "", "path of a JSON status endpoint with server and cache counters on every host, empty to disable")
+	logFlag := flag.String("log", "", "access log file, `-` for stdout")
+	logFormatFlag := flag.String("log-format", "combined", "access log format: common, combined, timed (combined with the duration in microseconds) or json")
+	logSizeFlag := flag.Int64("log-size", 10, "rotate the access log after this many megabytes, 0 to disable")
+	logBackupsFlag := flag.Int("log-backups", 5, "number of rotated access logs to keep")
 
 	flag.Parse()
 	if flag.NArg() != 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *configFlag != "" {
+		// the config file describes every host, these would be ignored
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "d", "ls", "uploads", "upload-max", "cgi", "cgi-timeout", "cgi-output":
+				log.Fatalf("Error parsing flags - -%s cannot be combined with -c", f.Name)
+			}
+		})
+	}
+
+	idleTimeout = *idleFlag
+	readHeaderTimeout = *headerFlag
+	readBodyTimeout = *bodyFlag
+	writeTimeout = *writeFlag
+	maxRequestsPerConn = *requestsFlag
+	docRoot = *rootFlag
+	listingDirs = *listFlag
+	compressThreshold = *compressFlag
+	configPath = *configFlag
+
+	if configPath == "" {
+		var uploads *Uploads
+		if *uploadsFlag != "" {
+			var err error
+			if uploads, err = newUploads(*uploadsFlag, *uploadMaxFlag); err != nil {
+				log.Fatalf("Error loading upload users - %s", err.Error())
+			}
+		}
+		var cgi *CGIRoute
+		if *cgiFlag != "" {
+			var err error
+			cc := CGIConfig{Prefix: "/cgi-bin/", Dir: *cgiFlag, Timeout: cgiTimeoutFlag.String(), MaxOutput: *cgiOutputFlag}
+			if cgi, err = newCGIRoute(cc, "."); err != nil {
+				log.Fatalf("Error configuring CGI - %s", err.Error())
+			}
+		}
+		hosts.Store(defaultHosts(uploads, cgi))
+	} else {
+		table, err := loadConfig(configPath)
+		if err != nil {
+			log.Fatalf("Error loading config - %s", err.Error())
+		}
+		hosts.Store(table)
+	}
+
+	if *logFlag != "" {
+		format, err := parseLogFormat(*logFormatFlag)
+		if err != nil {
+			log.Fatalf("Error configuring access log - %s", err.Error())
+		}
+		if *logFlag == "-" {
+			accessLog = NewAccessLogger(os.Stdout, format)
+		} else {
+			file, err := OpenRotatingFile(*logFlag, *logSizeFlag<<20, *logBackupsFlag)
+			if err != nil {
+				log.Fatalf("Error opening access log - %s", err.Error())
+			}
+			defer func(file *RotatingFile) {
+				if err := file.Close(); err != nil {
+					log.Printf("Error closing access log - %s", err.Error())
+				}
+			}(file)
+			accessLog = NewAccessLogger(file, format)
+		}
+	}
+
+	handler := serve
+	if *forwardFlag {
+		handler = forwardProxy
+		if *cacheFlag != "" {
+			cache, err := NewDiskCache(*cacheFlag)
+			if err != nil {
+				log.Fatalf("Error opening cache - %s", err.Error())
+			}
+			forwardCache = cache
+		}
+		if *blocklistFlag != "" {
+			domains, err := loadBlocklist(*blocklistFlag)
+			if err != nil {
+				log.Fatalf("Error loading blocklist - %s", err.Error())
+			}
+			blocklist = domains
+		}
+		connectPorts = make(map[string]bool)
+		for _, port := range strings.Split(*connectFlag, ",") {
+			connectPorts[strings.TrimSpace(port)] = true
+		}
+	}
+
+	if *fileCacheFlag > 0 {
+		fileCache = NewFileCache(*fileCacheFlag<<20, *fileEntryFlag)
+		if *filePollFlag > 0 {
+			stop := make(chan struct{})
+			defer close(stop)
+			go fileCache.Poll(*filePollFlag, stop)
+		}
+	}
 
 	taskType := TaskA
 
@@ -41,53 +183,95 @@ func main() {
 			taskType = TaskD
 			limit = *boundFlag
 		}
+	} else if *modeFlag == "E" {
+		taskType = TaskE
 	}
 
 	addr := host + ":" + fmt.Sprintf("%d", *portFlag)
-	log.Printf("Serving on %s\n", addr)
 	log.Printf("Running mode %s\n", *modeFlag)
 
-	run(addr, taskType)
-}
+	server := NewServer(taskType, limit)
+	server.PerIP = *perIPFlag
+	server.Loops = *loopsFlag
+	server.Blocking = waitsOnUpstream
+	if *forwardFlag {
+		server.Blocking = func(*Request) bool { return true }
+	}
+	if *wsFlag != "" {
+		handler = server.websocketHandler(*wsFlag, handler)
+	}
+	if *statusFlag != "" {
+		handler = server.statusHandler(*statusFlag, handler)
+	}
+	if *h2cFlag {
+		h2cEnabled = true
+		handler = server.h2cHandler(handler)
+	}
+	var wg sync.WaitGroup
+	start := func(listener net.Listener, handler Handler) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.run(listener, handler)
+		}()
+	}
 
-func run(addr string, task TaskType) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Printf("Error listening %s - %s", addr, err.Error())
+	if *tlsPortFlag == 0 {
+		log.Printf("Serving on %s\n", addr)
+		start(listen(addr), handler)
+		waitShutdown(server, &wg, *shutdownFlag)
+		return
 	}
-	defer func(listener net.Listener) {
-		err := listener.Close()
+
+	store := newCertStore()
+	if *certFlag != "" {
+		if err := loadCertificates(store, *certFlag, *keyFlag); err != nil {
+			log.Fatalf("Error loading certificates - %s", err.Error())
+		}
+	}
+	if *selfSignedFlag != "" || *certFlag == "" {
+		hosts := []string{host, "127.0.0.1"}
+		if *selfSignedFlag != "" {
+			hosts = strings.Split(*selfSignedFlag, ",")
+		}
+		cert, err := generateSelfSigned(hosts)
 		if err != nil {
-			log.Printf("Error closing listener - %s", err.Error())
+			log.Fatalf("Error generating certificate - %s", err.Error())
+		}
+		if err := store.add(cert); err != nil {
+			log.Fatalf("Error generating certificate - %s", err.Error())
 		}
-	}(listener)
+		log.Printf("Generated self-signed certificate for %v\n", hosts)
+	}
 
-	var runners chan struct{}
-	var req chan net.Conn
+	tlsAddr := host + ":" + fmt.Sprintf("%d", *tlsPortFlag)
+	tlsListener := tls.NewListener(listen(tlsAddr), newTLSConfig(store))
+	log.Printf("Serving HTTPS on %s\n", tlsAddr)
 
-	if task == TaskD {
-		runners = make(chan struct{}, limit)
-		req = make(chan net.Conn)
-		go handlePull(runners, req)
+	plainHandler := handler
+	if *redirectFlag {
+		plainHandler = redirectHandler(*tlsPortFlag)
 	}
+	start(listen(addr), plainHandler)
+	log.Printf("Serving on %s\n", addr)
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Error accepting - %s", err.Error())
-		}
-		log.Printf("Accepted connection %v\n", conn.LocalAddr())
-
-		switch task {
-		case TaskA:
-			handleConn(conn)
-		case TaskB:
-			go handleConn(conn)
-		case TaskD:
-			req <- conn
-		default:
-			log.Println("Unresolved type of task")
-			return
+	start(tlsListener, handler)
+	waitShutdown(server, &wg, *shutdownFlag)
+}
+
+func waitShutdown(server *Server, listeners *sync.WaitGroup, timeout time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-sigs
+	for ; sig == syscall.SIGHUP; sig = <-sigs {
+		if configPath != "" {
+			reloadConfig(configPath)
 		}
 	}
+	signal.Stop(sigs)
+
+	log.Printf("Received %s, shutting down (timeout %v)\n", sig, timeout)
+	server.Shutdown(timeout)
+	listeners.Wait()
+	server.logStats()
 }
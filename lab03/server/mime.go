@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const sniffLen = 512
+
+var contentTypes = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".htm":  "text/html; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".json": "application/json",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".xml":  "application/xml",
+	".svg":  "image/svg+xml",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".ico":  "image/x-icon",
+	".pdf":  "application/pdf",
+	".wasm": "application/wasm",
+}
+
+// contentType picks the media type by file extension and falls back to
+// sniffing the first bytes of the content for unknown extensions.
+func contentType(name string, data []byte) string {
+	if ct := typeByExtension(name); ct != "" {
+		return ct
+	}
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	return http.DetectContentType(data)
+}
+
+// fileContentType is contentType for a file that is not read, such as the
+// original of a precompressed sibling: its first bytes are sniffed only
+// when the extension is unknown.
+func fileContentType(name string) string {
+	if ct := typeByExtension(name); ct != "" {
+		return ct
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer func(file *os.File) {
+		if err := file.Close(); err != nil {
+			log.Printf("Error closing file - %s", err.Error())
+		}
+	}(file)
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+func typeByExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ct, ok := contentTypes[ext]; ok {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Balance int
+
+const (
+	RoundRobin Balance = iota
+	LeastConn
+
+	defaultMaxFails    = 3
+	defaultFailTimeout = 10 * time.Second
+	defaultDialTimeout = 3 * time.Second
+	defaultRespTimeout = 30 * time.Second
+)
+
+type ProxyConfig struct {
+	Prefix      string   `json:"prefix"`
+	Upstreams   []string `json:"upstreams"`
+	Balance     string   `json:"balance"`
+	StripPrefix bool     `json:"strip_prefix"`
+	MaxFails    int      `json:"max_fails"`
+	FailTimeout string   `json:"fail_timeout"`
+	DialTimeout string   `json:"dial_timeout"`
+	RespTimeout string   `json:"response_timeout"`
+}
+
+type ProxyRoute struct {
+	Prefix      string
+	StripPrefix bool
+	Balance     Balance
+	Upstreams   []*Upstream
+
+	maxFails    int
+	failTimeout time.Duration
+	dialTimeout time.Duration
+	respTimeout time.Duration
+	next        uint32
+}
+
+// Upstream is a backend address with passive health tracking: after
+// maxFails consecutive failures it is skipped for failTimeout.
+type Upstream struct {
+	Addr   string
+	active int64
+
+	mu        sync.Mutex
+	fails     int
+	downUntil time.Time
+}
+
+// hop-by-hop headers are not forwarded in either direction
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+var errNoUpstream = errors.New("no healthy upstream")
+
+func newProxyRoute(pc ProxyConfig) (*ProxyRoute, error) {
+	if pc.Prefix == "" || !strings.HasPrefix(pc.Prefix, "/") {
+		return nil, fmt.Errorf("proxy prefix must start with /")
+	}
+	if len(pc.Upstreams) == 0 {
+		return nil, fmt.Errorf("proxy %s has no upstreams", pc.Prefix)
+	}
+	route := &ProxyRoute{
+		Prefix:      pc.Prefix,
+		StripPrefix: pc.StripPrefix,
+		maxFails:    pc.MaxFails,
+	}
+	switch pc.Balance {
+	case "", "round_robin":
+		route.Balance = RoundRobin
+	case "least_conn":
+		route.Balance = LeastConn
+	default:
+		return nil, fmt.Errorf("unknown balance %q", pc.Balance)
+	}
+	if route.maxFails <= 0 {
+		route.maxFails = defaultMaxFails
+	}
+
+	var err error
+	if route.failTimeout, err = parseDuration(pc.FailTimeout, defaultFailTimeout); err != nil {
+		return nil, err
+	}
+	if route.dialTimeout, err = parseDuration(pc.DialTimeout, defaultDialTimeout); err != nil {
+		return nil, err
+	}
+	if route.respTimeout, err = parseDuration(pc.RespTimeout, defaultRespTimeout); err != nil {
+		return nil, err
+	}
+
+	for _, addr := range pc.Upstreams {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", addr, err)
+		}
+		route.Upstreams = append(route.Upstreams, &Upstream{Addr: addr})
+	}
+	return route, nil
+}
+
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (u *Upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return now.After(u.downUntil)
+}
+
+func (u *Upstream) markFailed(maxFails int, failTimeout time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fails++
+	if u.fails >= maxFails {
+		u.downUntil = time.Now().Add(failTimeout)
+		u.fails = 0
+		log.Printf("Upstream %s marked down for %v", u.Addr, failTimeout)
+	}
+}
+
+func (u *Upstream) markOk() {
+	u.mu.Lock()
+	u.fails = 0
+	u.mu.Unlock()
+}
+
+// pick chooses a healthy upstream that was not tried yet for this request.
+func (p *ProxyRoute) pick(tried map[*Upstream]bool) *Upstream {
+	now := time.Now()
+	n := len(p.Upstreams)
+	var best *Upstream
+
+	start := int(atomic.AddUint32(&p.next, 1)-1) % n
+	for i := 0; i < n; i++ {
+		u := p.Upstreams[(start+i)%n]
+		if tried[u] || !u.healthy(now) {
+			continue
+		}
+		if p.Balance == RoundRobin {
+			return u
+		}
+		if best == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+			best = u
+		}
+	}
+	return best
+}
+
+func (p *ProxyRoute) match(path string) bool {
+	return strings.HasPrefix(path, p.Prefix) ||
+		strings.HasSuffix(p.Prefix, "/") && path == strings.TrimSuffix(p.Prefix, "/")
+}
+
+func (p *ProxyRoute) serve(req *Request) *Response {
+	tried := make(map[*Upstream]bool)
+	for {
+		u := p.pick(tried)
+		if u == nil {
+			log.Printf("Proxy %s - %s", p.Prefix, errNoUpstream.Error())
+			return errorResponse(502)
+		}
+		tried[u] = true
+
+		// a failed dial can be retried on another upstream, the request body
+		// has not been consumed yet
+		conn, err := net.DialTimeout("tcp", u.Addr, p.dialTimeout)
+		if err != nil {
+			log.Printf("Error connecting to upstream %s - %s", u.Addr, err.Error())
+			u.markFailed(p.maxFails, p.failTimeout)
+			continue
+		}
+
+		atomic.AddInt64(&u.active, 1)
+		resp, err := p.roundTrip(conn, u, req)
+		if err != nil {
+			atomic.AddInt64(&u.active, -1)
+			if cerr := conn.Close(); cerr != nil {
+				log.Printf("Error closing upstream connection - %s", cerr.Error())
+			}
+			log.Printf("Error proxying to upstream %s - %s", u.Addr, err.Error())
+			u.markFailed(p.maxFails, p.failTimeout)
+			if isTimeout(err) {
+				return errorResponse(504)
+			}
+			return errorResponse(502)
+		}
+		u.markOk()
+		return resp
+	}
+}
+
+func (p *ProxyRoute) roundTrip(conn net.Conn, u *Upstream, req *Request) (*Response, error) {
+	if err := conn.SetDeadline(time.Now().Add(p.respTimeout)); err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriterSize(conn, BufCap)
+	if err := p.writeRequest(w, u, req); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(conn, BufCap)
+	resp, err := readUpstreamResponse(r, req.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	// the response timeout covers the headers, after them it limits every
+	// read of the body so a stalled upstream cannot pin the copy forever
+	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if resp.Stream != nil {
+		resp.Stream = &idleReader{conn: conn, r: resp.Stream, timeout: p.respTimeout}
+	}
+	var once sync.Once
+	resp.Done = func() {
+		once.Do(func() {
+			atomic.AddInt64(&u.active, -1)
+			if err := conn.Close(); err != nil {
+				log.Printf("Error closing upstream connection - %s", err.Error())
+			}
+		})
+	}
+	return resp, nil
+}
+
+// idleReader re-arms the read deadline of conn before every read, the
+// body may take any time as long as it keeps coming.
+type idleReader struct {
+	conn    net.Conn
+	r       io.Reader
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (p *ProxyRoute) writeRequest(w *bufio.Writer, u *Upstream, req *Request) error {
+	target := req.URL.RequestURI()
+	if p.StripPrefix {
+		target = "/" + strings.TrimPrefix(strings.TrimPrefix(target, strings.TrimSuffix(p.Prefix, "/")), "/")
+	}
+
+	header := forwardedHeader(req)
+	header.Set("Host", u.Addr)
+	header.Set("X-Forwarded-Host", req.Host)
+	header.Set("X-Forwarded-Proto", "http")
+	return writeUpstreamRequest(w, req, target, header)
+}
+
+// forwardedHeader copies the end-to-end request headers and appends the
+// client address to X-Forwarded-For.
+func forwardedHeader(req *Request) textproto.MIMEHeader {
+	header := cloneHeader(req.Header)
+	removeHopHeaders(header)
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		header.Set("X-Forwarded-For", ip)
+	}
+	return header
+}
+
+// writeUpstreamRequest sends req with the given target and headers over a
+// fresh upstream connection, streaming the request body.
+func writeUpstreamRequest(w *bufio.Writer, req *Request, target string, header textproto.MIMEHeader) error {
+	if _, err := fmt.Fprintf(w, "%s %s HTTP/1.1"+crlf, req.Method, target); err != nil {
+		return err
+	}
+
+	header.Set("Connection", "close")
+	header.Del("Content-Length")
+	if req.Chunked {
+		header.Set("Transfer-Encoding", "chunked")
+	} else if req.ContentLength > 0 {
+		header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+
+	for key, values := range header {
+		for _, v := range values {
+			if _, err := fmt.Fprintf(w, "%s: %s"+crlf, key, v); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := w.WriteString(crlf); err != nil {
+		return err
+	}
+
+	if req.Chunked {
+		cw := &chunkedWriter{w: w}
+		if _, err := io.Copy(cw, req.Body); err != nil {
+			return err
+		}
+		return cw.Close()
+	}
+	if req.ContentLength > 0 {
+		_, err := io.Copy(w, req.Body)
+		return err
+	}
+	return nil
+}
+
+func readUpstreamResponse(r *bufio.Reader, method string) (*Response, error) {
+	for {
+		line, err := readLine(r, MaxRequestLine)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/1.") {
+			return nil, fmt.Errorf("malformed status line %q", line)
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil || status < 100 || status > 999 {
+			return nil, fmt.Errorf("malformed status line %q", line)
+		}
+
+		header, err := readHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		// interim responses such as 100 Continue are dropped
+		if status < 200 {
+			continue
+		}
+
+		resp := &Response{Status: status, Header: header, Length: -1}
+		if err := setupUpstreamBody(resp, r, method); err != nil {
+			return nil, err
+		}
+		removeHopHeaders(resp.Header)
+		return resp, nil
+	}
+}
+
+func setupUpstreamBody(resp *Response, r *bufio.Reader, method string) error {
+	if method == "HEAD" || !bodyAllowed(resp.Status) {
+		resp.Stream = eofReader{}
+		resp.Length = 0
+		if method == "HEAD" {
+			if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+				resp.Length = n
+			}
+		}
+		return nil
+	}
+	if te := resp.Header.Get("Transfer-Encoding"); te != "" {
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return fmt.Errorf("unsupported upstream transfer coding %q", te)
+		}
+		resp.Stream = &chunkedReader{r: r, limit: 1<<63 - 1}
+		return nil
+	}
+	if cl := resp.Header.Values("Content-Length"); len(cl) > 0 {
+		n, err := parseContentLength(cl)
+		if err != nil {
+			return err
+		}
+		resp.Length = n
+		resp.Stream = io.LimitReader(r, n)
+		return nil
+	}
+	resp.Stream = r
+	return nil
+}
+
+func cloneHeader(h textproto.MIMEHeader) textproto.MIMEHeader {
+	clone := make(textproto.MIMEHeader, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+func removeHopHeaders(h textproto.MIMEHeader) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
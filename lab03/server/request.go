@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	MaxRequestLine = 8 * 1024
+	MaxHeaderBytes = 16 * 1024
+	MaxHeaderCount = 100
+	MaxFoldLines   = 4
+	MaxBodySize    = 32 << 20
+)
+
+type Request struct {
+	Method string
+	Target string
+	Proto  string
+	URL    *url.URL
+	Header textproto.MIMEHeader
+	Host   string
+
+	RemoteAddr string
+
+	ContentLength int64
+	Chunked       bool
+	Body          io.Reader
+}
+
+// StatusError is returned by the parser when the request cannot be served,
+// Status is the response code that should be sent back to the client.
+type StatusError struct {
+	Status int
+	Msg    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, statusText(e.Status), e.Msg)
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &StatusError{Status: 400, Msg: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errLineTooLong   = errors.New("line too long")
+	errBodyTooLarge  = &StatusError{Status: 413, Msg: "request body too large"}
+	errHeaderTooLong = &StatusError{Status: 431, Msg: "request header fields too large"}
+)
+
+func readRequest(r *bufio.Reader) (*Request, error) {
+	line, err := readRequestLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{}
+	if req.Method, req.Target, req.Proto, err = parseRequestLine(line); err != nil {
+		return nil, err
+	}
+	if req.URL, err = parseTarget(req.Method, req.Target); err != nil {
+		return nil, err
+	}
+
+	if req.Header, err = readHeader(r); err != nil {
+		return nil, err
+	}
+
+	req.Host = req.Header.Get("Host")
+	if req.URL.Host != "" {
+		req.Host = req.URL.Host
+	}
+	if req.Proto == "HTTP/1.1" && len(req.Header.Values("Host")) != 1 {
+		return nil, badRequest("exactly one Host header is required")
+	}
+
+	if err := setupBody(req, r); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func readRequestLine(r *bufio.Reader) (string, error) {
+	// RFC 7230 3.5: ignore at least one empty line before the request-line
+	for i := 0; ; i++ {
+		line, err := readLine(r, MaxRequestLine)
+		if err == errLineTooLong {
+			return "", &StatusError{Status: 414, Msg: "request line too long"}
+		}
+		if err != nil {
+			return "", err
+		}
+		if line != "" {
+			return line, nil
+		}
+		if i > 0 {
+			return "", badRequest("empty request line")
+		}
+	}
+}
+
+func parseRequestLine(line string) (method, target, proto string, err error) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		return "", "", "", badRequest("malformed request line %q", line)
+	}
+	method, target, proto = parts[0], parts[1], parts[2]
+
+	if !isToken(method) {
+		return "", "", "", badRequest("invalid method %q", method)
+	}
+	if target == "" {
+		return "", "", "", badRequest("empty request target")
+	}
+	switch proto {
+	case "HTTP/1.0", "HTTP/1.1":
+	default:
+		if !strings.HasPrefix(proto, "HTTP/") {
+			return "", "", "", badRequest("invalid protocol %q", proto)
+		}
+		return "", "", "", &StatusError{Status: 505, Msg: proto}
+	}
+	return method, target, proto, nil
+}
+
+func parseTarget(method, target string) (*url.URL, error) {
+	switch {
+	case method == "CONNECT":
+		if strings.HasPrefix(target, "/") || !strings.Contains(target, ":") {
+			return nil, badRequest("CONNECT requires authority-form target")
+		}
+		return &url.URL{Host: target}, nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, badRequest("asterisk-form is only allowed for OPTIONS")
+		}
+		return &url.URL{Path: "*"}, nil
+	}
+
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, badRequest("invalid request target %q", target)
+	}
+	if u.IsAbs() && u.Host == "" {
+		return nil, badRequest("absolute target without host %q", target)
+	}
+	return u, nil
+}
+
+func readHeader(r *bufio.Reader) (textproto.MIMEHeader, error) {
+	header := make(textproto.MIMEHeader)
+	total := 0
+	count := 0
+	folds := 0
+	lastKey := ""
+
+	for {
+		line, err := readLine(r, MaxHeaderBytes-total)
+		if err == errLineTooLong {
+			return nil, errHeaderTooLong
+		}
+		if err != nil {
+			return nil, err
+		}
+		total += len(line) + 2
+		if line == "" {
+			return header, nil
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			// obsolete line folding, RFC 7230 3.2.4
+			if lastKey == "" {
+				return nil, badRequest("folded line before first header")
+			}
+			folds++
+			if folds > MaxFoldLines {
+				return nil, badRequest("too many folded lines for %s", lastKey)
+			}
+			values := header[lastKey]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return nil, badRequest("malformed header line %q", line)
+		}
+		name := line[:colon]
+		if !isToken(name) {
+			return nil, badRequest("invalid header name %q", name)
+		}
+		value := strings.Trim(line[colon+1:], " \t")
+		if strings.ContainsAny(value, "\x00\r\n") {
+			return nil, badRequest("invalid header value for %s", name)
+		}
+
+		count++
+		if count > MaxHeaderCount {
+			return nil, errHeaderTooLong
+		}
+
+		lastKey = textproto.CanonicalMIMEHeaderKey(name)
+		folds = 0
+		header[lastKey] = append(header[lastKey], value)
+	}
+}
+
+func setupBody(req *Request, r *bufio.Reader) error {
+	te := req.Header.Values("Transfer-Encoding")
+	cl := req.Header.Values("Content-Length")
+
+	if len(te) > 0 {
+		if len(cl) > 0 {
+			return badRequest("both Transfer-Encoding and Content-Length are set")
+		}
+		codings := strings.Split(strings.Join(te, ","), ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return badRequest("final transfer coding must be chunked")
+		}
+		if len(codings) > 1 {
+			return &StatusError{Status: 501, Msg: "unsupported transfer coding"}
+		}
+		req.Chunked = true
+		req.ContentLength = -1
+		req.Body = &chunkedReader{r: r, limit: MaxBodySize}
+		return nil
+	}
+
+	if len(cl) == 0 {
+		req.Body = eofReader{}
+		return nil
+	}
+
+	n, err := parseContentLength(cl)
+	if err != nil {
+		return err
+	}
+	if n > MaxBodySize {
+		return errBodyTooLarge
+	}
+	req.ContentLength = n
+	if n == 0 {
+		req.Body = eofReader{}
+	} else {
+		req.Body = &lengthReader{r: r, left: n}
+	}
+	return nil
+}
+
+func parseContentLength(values []string) (int64, error) {
+	first := strings.TrimSpace(values[0])
+	for _, v := range values[1:] {
+		if strings.TrimSpace(v) != first {
+			return 0, badRequest("conflicting Content-Length values")
+		}
+	}
+	if first == "" || strings.TrimLeft(first, "0123456789") != "" {
+		return 0, badRequest("invalid Content-Length %q", first)
+	}
+	n, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, badRequest("invalid Content-Length %q", first)
+	}
+	return n, nil
+}
+
+// readLine reads one line terminated by CRLF (or bare LF) without the
+// terminator, failing with errLineTooLong if it is longer than max bytes.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max+2 {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	if len(line) > max {
+		return "", errLineTooLong
+	}
+	return string(line), nil
+}
+
+type chunkedReader struct {
+	r     *bufio.Reader
+	left  int64
+	read  int64
+	limit int64
+	done  bool
+	err   error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.left == 0 {
+		size, err := c.nextChunk()
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+		if size == 0 {
+			if err := c.readTrailer(); err != nil {
+				c.err = err
+				return 0, err
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = size
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && c.left == 0 {
+		err = c.readChunkEnd()
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *chunkedReader) nextChunk() (int64, error) {
+	line, err := readLine(c.r, 256)
+	if err == errLineTooLong {
+		return 0, badRequest("chunk size line too long")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	size, err := strconv.ParseInt(line, 16, 64)
+	if err != nil || size < 0 || line == "" || line[0] == '+' || line[0] == '-' {
+		return 0, badRequest("invalid chunk size %q", line)
+	}
+	c.read += size
+	if c.read > c.limit {
+		return 0, errBodyTooLarge
+	}
+	return size, nil
+}
+
+func (c *chunkedReader) readChunkEnd() error {
+	line, err := readLine(c.r, 0)
+	if err == errLineTooLong {
+		return badRequest("missing CRLF after chunk data")
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return badRequest("missing CRLF after chunk data")
+	}
+	return nil
+}
+
+func (c *chunkedReader) readTrailer() error {
+	total := 0
+	for {
+		line, err := readLine(c.r, MaxHeaderBytes-total)
+		if err == errLineTooLong {
+			return errHeaderTooLong
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		total += len(line) + 2
+	}
+}
+
+// lengthReader reads a Content-Length body, a connection that ends before
+// the whole body arrived fails with io.ErrUnexpectedEOF like a chunked one.
+type lengthReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if err == io.EOF && l.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{
+			name:   "get",
+			raw:    "GET /a?b=c HTTP/1.1\r\nHost: x\r\n\r\n",
+			method: "GET",
+			path:   "/a",
+		},
+		{
+			name:   "bare lf",
+			raw:    "GET / HTTP/1.1\nHost: x\n\n",
+			method: "GET",
+			path:   "/",
+		},
+		{
+			name:   "content length",
+			raw:    "POST /p HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello",
+			method: "POST",
+			path:   "/p",
+			body:   "hello",
+		},
+		{
+			name:   "chunked",
+			raw:    "POST /p HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n1\r\n!\r\n0\r\nTrailer: t\r\n\r\n",
+			method: "POST",
+			path:   "/p",
+			body:   "hello!",
+		},
+		{
+			name:   "no host",
+			raw:    "GET / HTTP/1.1\r\n\r\n",
+			status: 400,
+		},
+		{
+			name:   "both lengths",
+			raw:    "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n",
+			status: 400,
+		},
+		{
+			name:   "long request line",
+			raw:    "GET /" + strings.Repeat("a", MaxRequestLine) + " HTTP/1.1\r\n\r\n",
+			status: 414,
+		},
+		{
+			name:   "long header",
+			raw:    "GET / HTTP/1.1\r\nHost: x\r\nX: " + strings.Repeat("a", MaxHeaderBytes) + "\r\n\r\n",
+			status: 431,
+		},
+		{
+			name:   "body too large",
+			raw:    "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 99999999999\r\n\r\n",
+			status: 413,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := readRequest(bufio.NewReader(strings.NewReader(tt.raw)))
+			if tt.status != 0 {
+				if got := statusOf(err); got != tt.status {
+					t.Fatalf("status = %d (%v), want %d", got, err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Method != tt.method || req.URL.Path != tt.path {
+				t.Errorf("got %s %s, want %s %s", req.Method, req.URL.Path, tt.method, tt.path)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestReadRequestPipelined(t *testing.T) {
+	raw := "GET /1 HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"POST /2 HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc" +
+		"POST /3 HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nde\r\n0\r\n\r\n" +
+		"GET /4 HTTP/1.1\r\nHost: x\r\n\r\n"
+	r := bufio.NewReader(strings.NewReader(raw))
+	var paths []string
+	for {
+		req, err := readRequest(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, req.URL.Path)
+	}
+	if got := strings.Join(paths, " "); got != "/1 /2 /3 /4" {
+		t.Errorf("paths = %s", got)
+	}
+}
+
+func TestReadRequestTruncatedBody(t *testing.T) {
+	for _, raw := range []string{
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nhello",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\na\r\nhello",
+	} {
+		req, err := readRequest(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(req.Body); err != io.ErrUnexpectedEOF {
+			t.Errorf("reading a body cut short - %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// FuzzParseRequest reads every request of the input as a keep-alive
+// connection would, the parser must fail with an error and never panic.
+func FuzzParseRequest(f *testing.F) {
+	seeds := []string{
+		"GET / HTTP/1.1\r\nHost: x\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\nHEAD /c HTTP/1.0\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabcGET / HTTP/1.1\r\nHost: x\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3;a=b\r\nabc\r\n0\r\nX: y\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nfffffffffffffffff\r\n",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: x\r\nX: " + strings.Repeat("a", MaxHeaderBytes) + "\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: x\r\n" + strings.Repeat("A: b\r\n", MaxHeaderCount+1) + "\r\n",
+		"GET / HTTP/1.1\r\nHost: x\r\nX: a\r\n b\r\n\tc\r\n\r\n",
+		"GET / HTTP/1.1\nHost: x\n\n",
+		"\r\nGET http://x/ HTTP/1.1\nHost: y\nContent-Length: 1\n\nz",
+		"CONNECT x:443 HTTP/1.1\r\nHost: x:443\r\n\r\n",
+		"OPTIONS * HTTP/1.1\r\nHost: x\r\n\r\n",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReaderSize(bytes.NewReader(data), BufCap)
+		for {
+			req, err := readRequest(r)
+			if err != nil {
+				var se *StatusError
+				if errors.As(err, &se) && (se.Status < 400 || se.Status > 599) {
+					t.Fatalf("status %d for %v", se.Status, err)
+				}
+				return
+			}
+			if req.URL == nil || req.Header == nil || req.Body == nil {
+				t.Fatalf("incomplete request %+v", req)
+			}
+			if _, err := io.Copy(io.Discard, req.Body); err != nil {
+				return
+			}
+		}
+	})
+}
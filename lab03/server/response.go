@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	crlf       = "\r\n"
+	serverName = "lab03-server"
+	timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+)
+
+type Response struct {
+	Status int
+	Header textproto.MIMEHeader
+	Body   []byte
+
+	// Stream, when set, is copied to the client instead of Body. Length is
+	// its size or -1 if unknown, in which case it is sent chunked.
+	Stream io.Reader
+	Length int64
+	// Done is called through finish after the response has been written or
+	// dropped, or after Upgrade returns.
+	Done func()
+	// Upgrade, when set, takes over the connection once the response
+	// headers are sent, e.g. for CONNECT tunnels.
+	Upgrade func(conn net.Conn, rw *bufio.ReadWriter)
+
+	// Sent is the number of body bytes written to the client.
+	Sent int64
+}
+
+func newResponse(status int, body []byte) *Response {
+	return &Response{Status: status, Header: make(textproto.MIMEHeader), Body: body}
+}
+
+func errorResponse(status int) *Response {
+	resp := newResponse(status, nil)
+	if status == 405 {
+		resp.Header.Set("Allow", "GET, HEAD")
+	}
+	return resp
+}
+
+func (resp *Response) finish() {
+	if resp.Done != nil {
+		resp.Done()
+		resp.Done = nil
+	}
+}
+
+// canKeepAlive reports whether the connection can be reused after resp,
+// a body of unknown length can only be delimited by closing for HTTP/1.0.
+func canKeepAlive(req *Request, resp *Response) bool {
+	return resp.Stream == nil || resp.Length >= 0 || req.Proto == "HTTP/1.1" || req.Method == "HEAD"
+}
+
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+func writeResponse(w *bufio.Writer, req *Request, resp *Response, keepAlive bool) (int, error) {
+	switch {
+	case resp.Upgrade != nil:
+	case keepAlive:
+		resp.Header.Set("Connection", "keep-alive")
+	default:
+		resp.Header.Set("Connection", "close")
+	}
+	resp.Header.Set("Date", httpTime(time.Now()))
+	resp.Header.Set("Server", serverName)
+	resp.Header.Del("Transfer-Encoding")
+
+	chunked := false
+	switch {
+	case !bodyAllowed(resp.Status) || resp.Upgrade != nil:
+		resp.Header.Del("Content-Length")
+	case resp.Stream == nil:
+		resp.Header.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	case resp.Length >= 0:
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.Length, 10))
+	default:
+		resp.Header.Del("Content-Length")
+		if req != nil && req.Proto == "HTTP/1.1" {
+			chunked = true
+			resp.Header.Set("Transfer-Encoding", "chunked")
+		}
+	}
+	if resp.Header.Get("Content-Type") == "" && len(resp.Body) > 0 {
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	total := 0
+	n, err := fmt.Fprintf(w, "HTTP/1.1 %d %s"+crlf, resp.Status, statusText(resp.Status))
+	total += n
+	if err != nil {
+		return total, err
+	}
+	keys := make([]string, 0, len(resp.Header))
+	for key := range resp.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, v := range resp.Header[key] {
+			n, err = fmt.Fprintf(w, "%s: %s"+crlf, key, v)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	n, err = w.WriteString(crlf)
+	total += n
+	if err != nil {
+		return total, err
+	}
+
+	if req != nil && req.Method == "HEAD" || !bodyAllowed(resp.Status) || resp.Upgrade != nil {
+		return total, nil
+	}
+	if resp.Stream == nil {
+		n, err = w.Write(resp.Body)
+		resp.Sent = int64(n)
+		return total + n, err
+	}
+
+	if chunked {
+		cw := &chunkedWriter{w: w}
+		resp.Sent, err = io.Copy(cw, resp.Stream)
+		if err == nil {
+			err = cw.Close()
+		}
+	} else if resp.Length >= 0 {
+		resp.Sent, err = io.Copy(w, io.LimitReader(resp.Stream, resp.Length))
+		// a body that ends early leaves the client waiting for the rest,
+		// the error makes the caller close the connection
+		if err == nil && resp.Sent != resp.Length {
+			err = io.ErrUnexpectedEOF
+		}
+	} else {
+		resp.Sent, err = io.Copy(w, resp.Stream)
+	}
+	return total + int(resp.Sent), err
+}
+
+type chunkedWriter struct {
+	w *bufio.Writer
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(c.w, "%x"+crlf, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = c.w.WriteString(crlf)
+	return n, err
+}
+
+func (c *chunkedWriter) Close() error {
+	_, err := c.w.WriteString("0" + crlf + crlf)
+	return err
+}
+
+func httpTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+func statusOf(err error) int {
+	if se, ok := err.(*StatusError); ok {
+		return se.Status
+	}
+	if isTimeout(err) {
+		return 408
+	}
+	return 400
+}
+
+func statusText(code int) string {
+	if text, ok := statusTexts[code]; ok {
+		return text
+	}
+	return "Unknown"
+}
+
+var statusTexts = map[int]string{
+	100: "Continue",
+	101: "Switching Protocols",
+	200: "OK",
+	201: "Created",
+	204: "No Content",
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	304: "Not Modified",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	408: "Request Timeout",
+	409: "Conflict",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	426: "Upgrade Required",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Server struct {
+	Task  TaskType
+	Limit int
+	// PerIP caps simultaneous connections from one address, 0 disables it
+	PerIP int
+	// Loops is the number of epoll event loops for TaskE
+	Loops int
+	// Blocking reports the requests whose handler waits on another server
+	// or process, the event loops run them on a goroutine
+	Blocking func(req *Request) bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]*connState
+	perIP     map[string]int
+	wg        sync.WaitGroup
+	closing   int32
+	// expired is set when the shutdown timeout runs out, the event loops
+	// then close their connections as Shutdown does with the others
+	expired int32
+
+	started time.Time
+	stats   Stats
+}
+
+type connState struct {
+	idle bool
+}
+
+type Stats struct {
+	accepted     int64
+	requests     int64
+	errors       int64
+	acceptErrors int64
+	rejected     int64
+	forced       int64
+	inFlight     int64
+	maxInFlight  int64
+}
+
+func NewServer(task TaskType, limit int) *Server {
+	return &Server{
+		Task:      task,
+		Limit:     limit,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]*connState),
+		perIP:     make(map[string]int),
+		started:   time.Now(),
+	}
+}
+
+func (t TaskType) String() string {
+	switch t {
+	case TaskA:
+		return "A (sequential)"
+	case TaskB:
+		return "B (goroutine per connection)"
+	case TaskD:
+		return "D (bounded pool)"
+	case TaskE:
+		return "E (epoll event loop)"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(t))
+	}
+}
+
+func listen(addr string) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Error listening %s - %s", addr, err.Error())
+	}
+	return listener
+}
+
+// run accepts connections until the listener is closed by Shutdown.
+func (s *Server) run(listener net.Listener, handler Handler) {
+	defer func(listener net.Listener) {
+		err := listener.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error closing listener - %s", err.Error())
+		}
+	}(listener)
+	if !s.trackListener(listener) {
+		return
+	}
+
+	task := s.Task
+	if task == TaskE {
+		err := s.runEventLoops(listener, handler)
+		if err == nil {
+			return
+		}
+		log.Printf("Event loop unavailable for %v - %s, using a goroutine per connection", listener.Addr(), err.Error())
+		task = TaskB
+	}
+
+	var runners chan struct{}
+	var req chan net.Conn
+
+	if task == TaskD {
+		runners = make(chan struct{}, s.Limit)
+		req = make(chan net.Conn)
+		go s.handlePull(runners, req, handler)
+		defer close(req)
+	}
+
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosing() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			atomic.AddInt64(&s.stats.acceptErrors, 1)
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			log.Printf("Error accepting - %s, retrying in %v", err.Error(), backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		log.Printf("Accepted connection %v\n", conn.RemoteAddr())
+
+		// rejected in the accept loop so one address cannot fill the pool queue
+		if !s.acquireIP(remoteIP(conn)) {
+			atomic.AddInt64(&s.stats.rejected, 1)
+			log.Printf("Too many connections from %v\n", conn.RemoteAddr())
+			go rejectConn(conn)
+			continue
+		}
+
+		// tracked right away, a connection queued for a pool runner must be
+		// closed by Shutdown as well
+		if !s.addConn() {
+			if err := conn.Close(); err != nil {
+				log.Printf("Error closing connection - %s", err.Error())
+			}
+			s.releaseIP(remoteIP(conn))
+			return
+		}
+		// counted once it is served, rejected ones only count as rejected
+		atomic.AddInt64(&s.stats.accepted, 1)
+		s.trackConn(conn)
+		switch task {
+		case TaskA:
+			s.handleConn(conn, handler)
+		case TaskB:
+			go s.handleConn(conn, handler)
+		case TaskD:
+			req <- conn
+		default:
+			log.Println("Unresolved type of task")
+			if err := conn.Close(); err != nil {
+				log.Printf("Error closing connection - %s", err.Error())
+			}
+			s.untrackConn(conn)
+			return
+		}
+	}
+}
+
+func (s *Server) handlePull(runners chan struct{}, reqs chan net.Conn, handler Handler) {
+	for req := range reqs {
+		runners <- struct{}{}
+		localReq := req
+		go func(retChan chan struct{}) {
+			s.handleConn(localReq, handler)
+			<-retChan
+		}(runners)
+	}
+}
+
+func (s *Server) trackListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosing() {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+// addConn counts a new connection for Shutdown to wait for. It fails once
+// the server is shutting down, so the count cannot grow from zero while
+// Shutdown waits for it.
+func (s *Server) addConn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosing() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) trackConn(conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = &connState{}
+	s.mu.Unlock()
+	s.addInFlight()
+}
+
+func (s *Server) addInFlight() {
+	n := atomic.AddInt64(&s.stats.inFlight, 1)
+	for {
+		max := atomic.LoadInt64(&s.stats.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt64(&s.stats.maxInFlight, max, n) {
+			break
+		}
+	}
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.releaseIP(remoteIP(conn))
+	atomic.AddInt64(&s.stats.inFlight, -1)
+	s.wg.Done()
+}
+
+func (s *Server) acquireIP(ip string) bool {
+	if s.PerIP <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perIP[ip] >= s.PerIP {
+		return false
+	}
+	s.perIP[ip]++
+	return true
+}
+
+func (s *Server) releaseIP(ip string) {
+	if s.PerIP <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func rejectConn(conn net.Conn) {
+	defer func(conn net.Conn) {
+		if err := conn.Close(); err != nil {
+			log.Printf("Error closing connection - %s", err.Error())
+		}
+	}(conn)
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		return
+	}
+	w := bufio.NewWriter(conn)
+	if _, err := writeResponse(w, nil, rejectResponse(), false); err != nil {
+		log.Printf("Error writing response - %s", err.Error())
+		return
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("Error writing response - %s", err.Error())
+	}
+}
+
+func rejectResponse() *Response {
+	resp := errorResponse(503)
+	resp.Header.Set("Retry-After", "1")
+	return resp
+}
+
+// setIdle marks a connection as waiting for the next request, an idle
+// connection is woken up right away when the server is shutting down.
+func (s *Server) setIdle(conn net.Conn, idle bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.conns[conn]; ok {
+		st.idle = idle
+	}
+	if idle && s.isClosing() {
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			log.Printf("Error setting deadline - %s", err.Error())
+		}
+	}
+}
+
+func (s *Server) isClosing() bool {
+	return atomic.LoadInt32(&s.closing) == 1
+}
+
+// Shutdown stops accepting, lets in-flight requests finish and closes the
+// connections that are still open when the timeout expires.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.mu.Lock()
+	atomic.StoreInt32(&s.closing, 1)
+	for listener := range s.listeners {
+		if err := listener.Close(); err != nil {
+			log.Printf("Error closing listener - %s", err.Error())
+		}
+	}
+	for conn, st := range s.conns {
+		if st.idle {
+			if err := conn.SetReadDeadline(time.Now()); err != nil {
+				log.Printf("Error setting deadline - %s", err.Error())
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("All connections drained")
+	case <-time.After(timeout):
+		s.mu.Lock()
+		atomic.StoreInt32(&s.expired, 1)
+		log.Printf("Shutdown timeout, closing %d connections", atomic.LoadInt64(&s.stats.inFlight))
+		for conn := range s.conns {
+			atomic.AddInt64(&s.stats.forced, 1)
+			if err := conn.Close(); err != nil {
+				log.Printf("Error closing connection - %s", err.Error())
+			}
+		}
+		s.mu.Unlock()
+		<-done
+	}
+}
+
+func (s *Server) logStats() {
+	mode := s.Task.String()
+	if s.Task == TaskD {
+		mode = fmt.Sprintf("%s, limit %d", mode, s.Limit)
+	}
+	log.Printf("Mode %s, uptime %v", mode, time.Since(s.started).Round(time.Millisecond))
+	log.Printf("Connections: %d accepted, %d rejected per IP, %d max in flight, %d closed on timeout, %d accept errors",
+		atomic.LoadInt64(&s.stats.accepted),
+		atomic.LoadInt64(&s.stats.rejected),
+		atomic.LoadInt64(&s.stats.maxInFlight),
+		atomic.LoadInt64(&s.stats.forced),
+		atomic.LoadInt64(&s.stats.acceptErrors))
+	log.Printf("Requests: %d served, %d connection errors",
+		atomic.LoadInt64(&s.stats.requests),
+		atomic.LoadInt64(&s.stats.errors))
+	if fileCache != nil {
+		cs := fileCache.Stats()
+		log.Printf("File cache: %d hits, %d misses, %d invalidations, %d evictions, %d files in %d bytes",
+			cs.Hits, cs.Misses, cs.Invalidations, cs.Evictions, cs.Entries, cs.Bytes)
+	}
+}
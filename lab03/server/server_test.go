@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// startServer runs s on a free port until the end of the test.
+func startServer(t testing.TB, s *Server, handler Handler) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(listener, handler)
+	}()
+	t.Cleanup(func() {
+		s.Shutdown(time.Second)
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+// setTimeouts changes the connection timeouts for the test.
+func setTimeouts(t testing.TB, header, idle time.Duration) {
+	t.Helper()
+	oldHeader, oldIdle := readHeaderTimeout, idleTimeout
+	readHeaderTimeout, idleTimeout = header, idle
+	t.Cleanup(func() {
+		readHeaderTimeout, idleTimeout = oldHeader, oldIdle
+	})
+}
+
+func okHandler(req *Request) *Response {
+	return newResponse(200, []byte("ok"))
+}
+
+func get(addr, path string, timeout time.Duration) (int, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n", path); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+// slowloris keeps a connection open by sending a header byte at a time,
+// reconnecting whenever the server drops it, until stop is closed.
+func slowloris(addr string, stop chan struct{}) {
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n")
+		for err == nil {
+			select {
+			case <-stop:
+				_ = conn.Close()
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			_, err = io.WriteString(conn, "X")
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestSlowClientsCannotExhaustPool(t *testing.T) {
+	const (
+		slowClients   = 8
+		limit         = 2
+		headerTimeout = 200 * time.Millisecond
+	)
+	setTimeouts(t, headerTimeout, time.Second)
+
+	for _, task := range []TaskType{TaskB, TaskD, TaskE} {
+		t.Run(task.String(), func(t *testing.T) {
+			addr := startServer(t, NewServer(task, limit), okHandler)
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < slowClients; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					slowloris(addr, stop)
+				}()
+			}
+			defer func() {
+				close(stop)
+				wg.Wait()
+			}()
+			// let the slow clients take every runner of the pool
+			time.Sleep(headerTimeout / 2)
+
+			// in the worst case the request waits behind every slow client,
+			// each holding a runner for the header timeout
+			limitWait := time.Duration(slowClients/limit+2) * headerTimeout
+			start := time.Now()
+			status, err := get(addr, "/", limitWait+time.Second)
+			if err != nil {
+				t.Fatalf("request failed after %v - %s", time.Since(start), err.Error())
+			}
+			if status != 200 {
+				t.Fatalf("status %d", status)
+			}
+			if elapsed := time.Since(start); elapsed > limitWait {
+				t.Errorf("served after %v, want at most %v", elapsed, limitWait)
+			}
+		})
+	}
+}
+
+func TestPerIPLimit(t *testing.T) {
+	setTimeouts(t, time.Second, time.Second)
+	for _, task := range []TaskType{TaskB, TaskE} {
+		t.Run(task.String(), func(t *testing.T) {
+			s := NewServer(task, 0)
+			s.PerIP = 2
+			addr := startServer(t, s, okHandler)
+
+			var idle []net.Conn
+			defer func() {
+				for _, conn := range idle {
+					_ = conn.Close()
+				}
+			}()
+			for i := 0; i < s.PerIP; i++ {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				idle = append(idle, conn)
+			}
+			// the accept loop has to count the idle connections first
+			time.Sleep(50 * time.Millisecond)
+
+			status, err := get(addr, "/", time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != 503 {
+				t.Errorf("status %d over the per-IP limit, want 503", status)
+			}
+			// the refused connection is not counted as accepted
+			accepted, rejected := atomic.LoadInt64(&s.stats.accepted), atomic.LoadInt64(&s.stats.rejected)
+			if accepted != int64(s.PerIP) || rejected != 1 {
+				t.Errorf("%d accepted, %d rejected, want %d and 1", accepted, rejected, s.PerIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+type ServerStatus struct {
+	Mode         string          `json:"mode"`
+	Uptime       float64         `json:"uptime_seconds"`
+	Accepted     int64           `json:"accepted"`
+	Rejected     int64           `json:"rejected"`
+	InFlight     int64           `json:"in_flight"`
+	MaxInFlight  int64           `json:"max_in_flight"`
+	Requests     int64           `json:"requests"`
+	Errors       int64           `json:"errors"`
+	AcceptErrors int64           `json:"accept_errors"`
+	ForcedCloses int64           `json:"forced_closes"`
+	FileCache    *FileCacheStats `json:"file_cache,omitempty"`
+}
+
+func (s *Server) status() ServerStatus {
+	st := ServerStatus{
+		Mode:         s.Task.String(),
+		Uptime:       time.Since(s.started).Seconds(),
+		Accepted:     atomic.LoadInt64(&s.stats.accepted),
+		Rejected:     atomic.LoadInt64(&s.stats.rejected),
+		InFlight:     atomic.LoadInt64(&s.stats.inFlight),
+		MaxInFlight:  atomic.LoadInt64(&s.stats.maxInFlight),
+		Requests:     atomic.LoadInt64(&s.stats.requests),
+		Errors:       atomic.LoadInt64(&s.stats.errors),
+		AcceptErrors: atomic.LoadInt64(&s.stats.acceptErrors),
+		ForcedCloses: atomic.LoadInt64(&s.stats.forced),
+	}
+	if fileCache != nil {
+		cs := fileCache.Stats()
+		st.FileCache = &cs
+	}
+	return st
+}
+
+// statusHandler answers GET requests for path with the server counters as
+// JSON and passes every other request on to next. The endpoint is global:
+// it is answered for every host ahead of the virtual hosts, so their
+// access rules, headers and error pages do not apply to it, and in the
+// forward proxy mode as well.
+func (s *Server) statusHandler(path string, next Handler) Handler {
+	return func(req *Request) *Response {
+		if req.URL.Path != path {
+			return next(req)
+		}
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return errorResponse(405)
+		}
+		body, err := json.MarshalIndent(s.status(), "", "  ")
+		if err != nil {
+			log.Printf("Error encoding status - %s", err.Error())
+			return errorResponse(500)
+		}
+		resp := newResponse(200, append(body, '\n'))
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Header.Set("Cache-Control", "no-store")
+		return resp
+	}
+}
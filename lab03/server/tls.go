@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// certStore picks a certificate by the SNI server name: exact name first,
+// then a wildcard for the parent domain, then the first loaded certificate.
+type certStore struct {
+	byName map[string]*tls.Certificate
+	certs  []*tls.Certificate
+}
+
+func newCertStore() *certStore {
+	return &certStore{byName: make(map[string]*tls.Certificate)}
+}
+
+func (s *certStore) add(cert tls.Certificate) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	c := &cert
+	s.certs = append(s.certs, c)
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, ok := s.byName[name]; !ok {
+			s.byName[name] = c
+		}
+	}
+	for _, ip := range cert.Leaf.IPAddresses {
+		if _, ok := s.byName[ip.String()]; !ok {
+			s.byName[ip.String()] = c
+		}
+	}
+	return nil
+}
+
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(s.certs) == 0 {
+		return nil, errors.New("no certificates configured")
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if c, ok := s.byName[name]; ok {
+		return c, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if c, ok := s.byName["*"+name[i:]]; ok {
+			return c, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// loadCertificates reads comma-separated lists of certificate and key files,
+// the i-th certificate is paired with the i-th key.
+func loadCertificates(store *certStore, certFiles, keyFiles string) error {
+	certs := strings.Split(certFiles, ",")
+	keys := strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return fmt.Errorf("got %d certificates and %d keys", len(certs), len(keys))
+	}
+	for i := range certs {
+		cert, err := tls.LoadX509KeyPair(strings.TrimSpace(certs[i]), strings.TrimSpace(keys[i]))
+		if err != nil {
+			return err
+		}
+		if err := store.add(cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateSelfSigned creates a certificate for local testing that is valid
+// for the given host names and IP addresses.
+func generateSelfSigned(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{serverName}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	)
+}
+
+func newTLSConfig(store *certStore) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.getCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+}
+
+// redirectHandler answers every request with a redirect to the same target
+// on the HTTPS port.
+func redirectHandler(tlsPort int) Handler {
+	return func(req *Request) *Response {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+
+		resp := newResponse(308, nil)
+		resp.Header.Set("Location", target.String())
+		return resp
+	}
+}
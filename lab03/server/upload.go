@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const defaultUploadMax = 10 << 20
+
+// Uploads enables PUT, multipart POST and DELETE under a host's root for
+// users authenticated with HTTP Basic auth.
+type Uploads struct {
+	Users   map[string][]byte
+	MaxSize int64
+}
+
+var (
+	errUploadTooLarge = errors.New("upload too large")
+	errConflict       = errors.New("conflict")
+)
+
+func newUploads(usersFile string, maxSize int64) (*Uploads, error) {
+	users, err := loadUsers(usersFile)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = defaultUploadMax
+	}
+	if maxSize > MaxBodySize {
+		maxSize = MaxBodySize
+	}
+	return &Uploads{Users: users, MaxSize: maxSize}, nil
+}
+
+// loadUsers reads "name:sha256hex" lines, the hash is of the password.
+func loadUsers(name string) (map[string][]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		if err := file.Close(); err != nil {
+			log.Printf("Error closing %s - %s", name, err.Error())
+		}
+	}(file)
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("malformed users line %q", line)
+		}
+		hash, err := hex.DecodeString(line[i+1:])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("user %s: password must be a sha256 hex digest", line[:i])
+		}
+		users[line[:i]] = hash
+	}
+	return users, scanner.Err()
+}
+
+func (u *Uploads) authorized(req *Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return false
+	}
+	name, password, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return false
+	}
+	want, ok := u.Users[name]
+	sum := sha256.Sum256([]byte(password))
+	return ok && subtle.ConstantTimeCompare(sum[:], want) == 1
+}
+
+func unauthorized() *Response {
+	resp := errorResponse(401)
+	resp.Header.Set("WWW-Authenticate", `Basic realm="`+serverName+`", charset="UTF-8"`)
+	return resp
+}
+
+func (u *Uploads) serve(root string, req *Request) *Response {
+	if !u.authorized(req) {
+		return unauthorized()
+	}
+	if req.ContentLength > u.MaxSize {
+		return errorResponse(413)
+	}
+
+	switch req.Method {
+	case "PUT":
+		return u.put(root, req)
+	case "POST":
+		return u.post(root, req)
+	case "DELETE":
+		return deleteFile(root, req)
+	}
+	return errorResponse(405)
+}
+
+// resolveNewPath resolves the parent directory of urlPath under root, the
+// target itself may not exist yet.
+func resolveNewPath(root, urlPath string) (string, error) {
+	clean := path.Clean("/" + urlPath)
+	if clean == "/" || strings.HasSuffix(urlPath, "/") {
+		return "", errConflict
+	}
+	dir, err := resolvePath(root, path.Dir(clean))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", errConflict
+		}
+		return "", err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", errConflict
+	}
+	name := filepath.Join(dir, path.Base(clean))
+	if info, err := os.Lstat(name); err == nil && (info.IsDir() || info.Mode()&os.ModeSymlink != 0) {
+		return "", errConflict
+	}
+	return name, nil
+}
+
+func (u *Uploads) put(root string, req *Request) *Response {
+	name, err := resolveNewPath(root, req.URL.Path)
+	if err != nil {
+		return uploadErrorResponse(err)
+	}
+	_, statErr := os.Stat(name)
+	existed := statErr == nil
+
+	if err := u.writeAtomic(name, req.Body, req.ContentLength, true); err != nil {
+		return uploadErrorResponse(err)
+	}
+	log.Printf("Stored %s", name)
+	if existed {
+		return newResponse(204, nil)
+	}
+	resp := newResponse(201, nil)
+	resp.Header.Set("Location", (&url.URL{Path: path.Clean("/" + req.URL.Path)}).String())
+	return resp
+}
+
+// post stores every file part of a multipart/form-data body in the target
+// directory, an existing file with the same name is a conflict.
+func (u *Uploads) post(root string, req *Request) *Response {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return errorResponse(415)
+	}
+	dir, err := resolvePath(root, req.URL.Path)
+	if err != nil {
+		return fileErrorResponse(err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return errorResponse(409)
+	}
+
+	limited := &limitedReader{r: req.Body, left: u.MaxSize + 1}
+	reader := multipart.NewReader(limited, params["boundary"])
+	var stored []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploadErrorResponse(limitedErr(limited, err))
+		}
+		fileName := part.FileName()
+		if fileName == "" {
+			continue
+		}
+		base := filepath.Base(filepath.FromSlash(strings.ReplaceAll(fileName, `\`, "/")))
+		if base == "." || base == ".." || base == string(filepath.Separator) || strings.HasPrefix(base, ".") {
+			return errorResponse(400)
+		}
+
+		if err := u.writeAtomic(filepath.Join(dir, base), part, -1, false); err != nil {
+			return uploadErrorResponse(limitedErr(limited, err))
+		}
+		stored = append(stored, base)
+		log.Printf("Stored %s", filepath.Join(dir, base))
+	}
+	if len(stored) == 0 {
+		return errorResponse(400)
+	}
+
+	prefix := strings.TrimSuffix(path.Clean("/"+req.URL.Path), "/") + "/"
+	var body strings.Builder
+	for _, name := range stored {
+		body.WriteString(prefix + name + "\n")
+	}
+	resp := newResponse(201, []byte(body.String()))
+	resp.Header.Set("Location", (&url.URL{Path: prefix + stored[0]}).String())
+	return resp
+}
+
+// deleteFile removes the entry named by the path. Only its directory is
+// resolved and checked against the root, so a symlink is removed itself
+// and its target is left alone.
+func deleteFile(root string, req *Request) *Response {
+	clean := path.Clean("/" + req.URL.Path)
+	if clean == "/" {
+		return errorResponse(403)
+	}
+	dir, err := resolvePath(root, path.Dir(clean))
+	if err != nil {
+		return fileErrorResponse(err)
+	}
+	name := filepath.Join(dir, path.Base(clean))
+	info, err := os.Lstat(name)
+	if err != nil {
+		return fileErrorResponse(err)
+	}
+	if err := os.Remove(name); err != nil {
+		// a non-empty directory cannot be removed
+		if info.IsDir() {
+			return errorResponse(409)
+		}
+		return fileErrorResponse(err)
+	}
+	log.Printf("Deleted %s", name)
+	return newResponse(204, nil)
+}
+
+// writeAtomic streams r into a temporary file next to name and renames it
+// into place, so readers never observe a partial upload. size is the
+// expected length or -1 if unknown, a shorter body is not committed.
+func (u *Uploads) writeAtomic(name string, r io.Reader, size int64, replace bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	n, err := io.Copy(tmp, io.LimitReader(r, u.MaxSize+1))
+	if err == nil && n > u.MaxSize {
+		err = errUploadTooLarge
+	}
+	if err == nil && size >= 0 && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if !replace {
+		// Link fails if the name exists, unlike Rename
+		if err := os.Link(tmp.Name(), name); err != nil {
+			if errors.Is(err, os.ErrExist) {
+				return errConflict
+			}
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// limitedReader caps the total size of a multipart body, reading past left
+// bytes marks it as exceeded.
+type limitedReader struct {
+	r        io.Reader
+	left     int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		l.exceeded = true
+		return 0, errUploadTooLarge
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+func limitedErr(l *limitedReader, err error) error {
+	if l.exceeded {
+		return errUploadTooLarge
+	}
+	return err
+}
+
+func uploadErrorResponse(err error) *Response {
+	log.Printf("Error storing upload - %s", err.Error())
+	var se *StatusError
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		return errorResponse(413)
+	case errors.Is(err, errConflict):
+		return errorResponse(409)
+	case errors.As(err, &se):
+		return errorResponse(se.Status)
+	case errors.Is(err, errForbidden), errors.Is(err, os.ErrPermission):
+		return errorResponse(403)
+	case errors.Is(err, io.ErrUnexpectedEOF), isTimeout(err):
+		return errorResponse(400)
+	default:
+		return errorResponse(500)
+	}
+}
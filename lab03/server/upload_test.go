@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testUploads allows the user "u" with the password "p".
+func testUploads() *Uploads {
+	sum := sha256.Sum256([]byte("p"))
+	return &Uploads{Users: map[string][]byte{"u": sum[:]}, MaxSize: 1 << 20}
+}
+
+// uploadRequest parses an authorized request, raw holds the request line,
+// the extra header lines and the body as the client sent them.
+func uploadRequest(t *testing.T, method, path, header, body string) *Request {
+	t.Helper()
+	auth := base64.StdEncoding.EncodeToString([]byte("u:p"))
+	raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: test\r\nAuthorization: Basic %s\r\n%s\r\n%s", method, path, auth, header, body)
+	req, err := readRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// dirEntries lists the names in dir, temporary files included.
+func dirEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestPutCutShort(t *testing.T) {
+	root := t.TempDir()
+	u := testUploads()
+	if err := os.WriteFile(filepath.Join(root, "old.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"new.txt", "old.txt"} {
+		req := uploadRequest(t, "PUT", "/"+name, "Content-Length: 10\r\n", "short")
+		if resp := u.serve(root, req); resp.Status != 400 {
+			t.Errorf("PUT /%s cut short - %d, want 400", name, resp.Status)
+		}
+	}
+	if got := strings.Join(dirEntries(t, root), " "); got != "old.txt" {
+		t.Errorf("root holds %s after the failed uploads", got)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "old.txt")); err != nil || string(data) != "old" {
+		t.Errorf("old.txt = %q, %v", data, err)
+	}
+}
+
+// multipartBody returns the header line and body of a form with one file
+// part per name, each file holds its own name.
+func multipartBody(t *testing.T, names ...string) (string, string) {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, name := range names {
+		part, err := w.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("Content-Type: %s\r\nContent-Length: %d\r\n", w.FormDataContentType(), body.Len()), body.String()
+}
+
+// TestUploadSemantics runs each request against a fresh root holding
+// old.txt, sub/keep.txt and a symlink link to old.txt. files lists the
+// expected contents afterwards, "" for a name that must not exist.
+func TestUploadSemantics(t *testing.T) {
+	raw := func(header, body string) func(t *testing.T) (string, string) {
+		return func(*testing.T) (string, string) {
+			return header, body
+		}
+	}
+	putBody := func(body string) func(t *testing.T) (string, string) {
+		return raw(fmt.Sprintf("Content-Length: %d\r\n", len(body)), body)
+	}
+	form := func(names ...string) func(t *testing.T) (string, string) {
+		return func(t *testing.T) (string, string) {
+			return multipartBody(t, names...)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     func(t *testing.T) (string, string)
+		status   int
+		location string
+		files    map[string]string
+	}{
+		{"put creates", "PUT", "/new.txt", putBody("new"), 201, "/new.txt", map[string]string{"new.txt": "new"}},
+		{"put replaces", "PUT", "/old.txt", putBody("new"), 204, "", map[string]string{"old.txt": "new"}},
+		{"put into subdirectory", "PUT", "/sub/new.txt", putBody("new"), 201, "/sub/new.txt", map[string]string{"sub/new.txt": "new"}},
+		{"put on directory", "PUT", "/sub", putBody("new"), 409, "", map[string]string{"sub/keep.txt": "keep"}},
+		{"put with trailing slash", "PUT", "/new/", putBody("new"), 409, "", map[string]string{"new": ""}},
+		{"put in missing directory", "PUT", "/missing/new.txt", putBody("new"), 409, "", map[string]string{"missing": ""}},
+		{"put on symlink", "PUT", "/link", putBody("new"), 409, "", map[string]string{"old.txt": "old"}},
+		{"put too large", "PUT", "/new.txt", raw("Content-Length: 2000000\r\n", ""), 413, "", map[string]string{"new.txt": ""}},
+		{"post creates", "POST", "/sub", form("a.txt", "b.txt"), 201, "/sub/a.txt", map[string]string{"sub/a.txt": "a.txt", "sub/b.txt": "b.txt"}},
+		{"post strips directories", "POST", "/", form("../x/c.txt"), 201, "/c.txt", map[string]string{"c.txt": "../x/c.txt"}},
+		{"post conflicts", "POST", "/", form("old.txt"), 409, "", map[string]string{"old.txt": "old"}},
+		{"post hidden name", "POST", "/", form(".hidden"), 400, "", map[string]string{".hidden": ""}},
+		{"post without files", "POST", "/", form(), 400, "", nil},
+		{"post not multipart", "POST", "/", putBody("new"), 415, "", nil},
+		{"post to file", "POST", "/old.txt", form("a.txt"), 409, "", map[string]string{"old.txt": "old"}},
+		{"delete file", "DELETE", "/old.txt", raw("", ""), 204, "", map[string]string{"old.txt": ""}},
+		{"delete symlink", "DELETE", "/link", raw("", ""), 204, "", map[string]string{"link": "", "old.txt": "old"}},
+		{"delete missing", "DELETE", "/missing", raw("", ""), 404, "", nil},
+		{"delete non-empty directory", "DELETE", "/sub", raw("", ""), 409, "", map[string]string{"sub/keep.txt": "keep"}},
+		{"delete root", "DELETE", "/", raw("", ""), 403, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range map[string]string{"old.txt": "old", "sub/keep.txt": "keep"} {
+				if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink("old.txt", filepath.Join(root, "link")); err != nil {
+				t.Fatal(err)
+			}
+
+			header, body := tt.body(t)
+			resp := testUploads().serve(root, uploadRequest(t, tt.method, tt.path, header, body))
+			if resp.Status != tt.status {
+				t.Errorf("%s %s - %d, want %d", tt.method, tt.path, resp.Status, tt.status)
+			}
+			if loc := resp.Header.Get("Location"); loc != tt.location {
+				t.Errorf("Location %q, want %q", loc, tt.location)
+			}
+			for name, want := range tt.files {
+				data, err := os.ReadFile(filepath.Join(root, name))
+				switch {
+				case want == "" && !os.IsNotExist(err):
+					t.Errorf("%s exists, %v", name, err)
+				case want != "" && (err != nil || string(data) != want):
+					t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+				}
+			}
+			for _, name := range append(dirEntries(t, root), dirEntries(t, filepath.Join(root, "sub"))...) {
+				if strings.HasPrefix(name, ".upload-") {
+					t.Errorf("temporary file %s left behind", name)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadUnauthorized(t *testing.T) {
+	root := t.TempDir()
+	for _, auth := range []string{"", "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("u:wrong")) + "\r\n"} {
+		raw := "PUT /new.txt HTTP/1.1\r\nHost: test\r\n" + auth + "Content-Length: 3\r\n\r\nnew"
+		req, err := readRequest(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := testUploads().serve(root, req)
+		if resp.Status != 401 || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("PUT with %q - %d, WWW-Authenticate %q", auth, resp.Status, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+	if names := dirEntries(t, root); len(names) != 0 {
+		t.Errorf("unauthorized PUT left %v", names)
+	}
+}
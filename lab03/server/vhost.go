@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type Config struct {
+	Hosts []HostConfig `json:"hosts"`
+}
+
+type HostConfig struct {
+	Names      []string          `json:"names"`
+	Default    bool              `json:"default"`
+	Root       string            `json:"root"`
+	Listing    bool              `json:"listing"`
+	ErrorPages map[string]string `json:"error_pages"`
+	Headers    map[string]string `json:"headers"`
+	Access     []AccessRule      `json:"access"`
+	Proxy      []ProxyConfig     `json:"proxy"`
+	Uploads    *UploadConfig     `json:"uploads"`
+	CGI        []CGIConfig       `json:"cgi"`
+}
+
+type UploadConfig struct {
+	Users   string `json:"users"`
+	MaxSize int64  `json:"max_size"`
+}
+
+// AccessRule applies to Path and the paths below it. An address matching Deny
+// is refused, and when Allow is not empty only matching addresses pass.
+type AccessRule struct {
+	Path  string   `json:"path"`
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type VirtualHost struct {
+	Names      []string
+	Root       string
+	Listing    bool
+	ErrorPages map[int][]byte
+	Headers    map[string]string
+	Access     []accessRule
+	Proxies    []*ProxyRoute
+	Uploads    *Uploads
+	CGI        []*CGIRoute
+}
+
+type accessRule struct {
+	prefix string
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+}
+
+type hostTable struct {
+	byName   map[string]*VirtualHost
+	wildcard map[string]*VirtualHost
+	fallback *VirtualHost
+}
+
+var hosts atomic.Value
+
+func currentHosts() *hostTable {
+	return hosts.Load().(*hostTable)
+}
+
+// defaultHosts serves the document root given by flags for every host name.
+func defaultHosts(uploads *Uploads, cgi *CGIRoute) *hostTable {
+	vh := &VirtualHost{Root: docRoot, Listing: listingDirs, Uploads: uploads}
+	if cgi != nil {
+		vh.CGI = []*CGIRoute{cgi}
+	}
+	return &hostTable{
+		byName:   map[string]*VirtualHost{},
+		wildcard: map[string]*VirtualHost{},
+		fallback: vh,
+	}
+}
+
+func loadConfig(path string) (*hostTable, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	if len(config.Hosts) == 0 {
+		return nil, fmt.Errorf("config file: no hosts defined")
+	}
+
+	base := filepath.Dir(path)
+	table := &hostTable{
+		byName:   map[string]*VirtualHost{},
+		wildcard: map[string]*VirtualHost{},
+	}
+	for i, hc := range config.Hosts {
+		vh, err := newVirtualHost(hc, base)
+		if err != nil {
+			return nil, fmt.Errorf("host #%d: %w", i, err)
+		}
+		for _, name := range vh.Names {
+			if strings.HasPrefix(name, "*.") {
+				table.wildcard[name[1:]] = vh
+			} else {
+				table.byName[name] = vh
+			}
+		}
+		if hc.Default || table.fallback == nil {
+			table.fallback = vh
+		}
+	}
+	return table, nil
+}
+
+func newVirtualHost(hc HostConfig, base string) (*VirtualHost, error) {
+	if hc.Root == "" {
+		return nil, fmt.Errorf("root is required")
+	}
+	vh := &VirtualHost{
+		Root:       resolveConfigPath(base, hc.Root),
+		Listing:    hc.Listing,
+		ErrorPages: make(map[int][]byte),
+		Headers:    hc.Headers,
+	}
+	if info, err := os.Stat(vh.Root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("root %s is not a directory", vh.Root)
+	}
+	var err error
+	for _, name := range hc.Names {
+		vh.Names = append(vh.Names, strings.ToLower(name))
+	}
+
+	for code, file := range hc.ErrorPages {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("invalid error page status %q", code)
+		}
+		page, err := os.ReadFile(resolveConfigPath(base, file))
+		if err != nil {
+			return nil, err
+		}
+		vh.ErrorPages[status] = page
+	}
+
+	for _, rule := range hc.Access {
+		r := accessRule{prefix: rule.Path}
+		if r.allow, err = parseNets(rule.Allow); err != nil {
+			return nil, err
+		}
+		if r.deny, err = parseNets(rule.Deny); err != nil {
+			return nil, err
+		}
+		vh.Access = append(vh.Access, r)
+	}
+
+	if hc.Uploads != nil {
+		if vh.Uploads, err = newUploads(resolveConfigPath(base, hc.Uploads.Users), hc.Uploads.MaxSize); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cc := range hc.CGI {
+		route, err := newCGIRoute(cc, base)
+		if err != nil {
+			return nil, err
+		}
+		vh.CGI = append(vh.CGI, route)
+	}
+
+	for _, pc := range hc.Proxy {
+		route, err := newProxyRoute(pc)
+		if err != nil {
+			return nil, err
+		}
+		vh.Proxies = append(vh.Proxies, route)
+	}
+	return vh, nil
+}
+
+func resolveConfigPath(base, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
+
+func parseNets(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (t *hostTable) lookup(host string) *VirtualHost {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if vh, ok := t.byName[host]; ok {
+		return vh
+	}
+	for rest := host; ; {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			break
+		}
+		if vh, ok := t.wildcard[rest[i:]]; ok {
+			return vh
+		}
+		rest = rest[i+1:]
+	}
+	return t.fallback
+}
+
+// allowed checks the first access rule whose path prefix matches.
+func (vh *VirtualHost) allowed(path, remoteAddr string) bool {
+	ip := net.ParseIP(remoteAddr)
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = net.ParseIP(h)
+	}
+	for _, rule := range vh.Access {
+		if !rule.matches(path) {
+			continue
+		}
+		if ip == nil {
+			return false
+		}
+		if containsIP(rule.deny, ip) {
+			return false
+		}
+		return len(rule.allow) == 0 || containsIP(rule.allow, ip)
+	}
+	return true
+}
+
+// matches compares whole path segments, a rule for /admin or /admin/
+// covers /admin and /admin/x but not /administrator.
+func (r accessRule) matches(path string) bool {
+	prefix := strings.TrimSuffix(r.prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// decorate adds the configured headers and replaces empty error bodies
+// with the host's custom error pages. A streamed response has an empty
+// Body too, an upstream's error page is passed through as it is.
+func (vh *VirtualHost) decorate(resp *Response) {
+	for key, value := range vh.Headers {
+		resp.Header.Set(key, value)
+	}
+	if page, ok := vh.ErrorPages[resp.Status]; ok && len(resp.Body) == 0 && resp.Stream == nil {
+		resp.Body = page
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+}
+
+func (vh *VirtualHost) proxyFor(path string) *ProxyRoute {
+	for _, route := range vh.Proxies {
+		if route.match(path) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (vh *VirtualHost) cgiFor(path string) *CGIRoute {
+	for _, route := range vh.CGI {
+		if route.match(path) {
+			return route
+		}
+	}
+	return nil
+}
+
+func reloadConfig(path string) {
+	table, err := loadConfig(path)
+	if err != nil {
+		log.Printf("Error reloading config, keeping the previous one - %s", err.Error())
+		return
+	}
+	hosts.Store(table)
+	log.Printf("Reloaded config %s\n", path)
+}
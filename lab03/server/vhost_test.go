@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestAllowed(t *testing.T) {
+	local, err := parseNets([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vh := &VirtualHost{Access: []accessRule{
+		{prefix: "/admin", allow: local},
+		{prefix: "/private/", allow: local},
+	}}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/admin", false},
+		{"/admin/", false},
+		{"/admin/users", false},
+		{"/administrator", true},
+		{"/admin.html", true},
+		{"/private", false},
+		{"/private/key", false},
+		{"/privatekey", true},
+		{"/", true},
+	}
+	for _, tt := range tests {
+		if got := vh.allowed(tt.path, "192.0.2.1:1234"); got != tt.want {
+			t.Errorf("allowed(%q) from 192.0.2.1 = %v, want %v", tt.path, got, tt.want)
+		}
+		if !vh.allowed(tt.path, "127.0.0.1:1234") {
+			t.Errorf("allowed(%q) from 127.0.0.1 = false", tt.path)
+		}
+	}
+}
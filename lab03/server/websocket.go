@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket (RFC 6455) endpoints on top of the Upgrade hook: <prefix>/echo
+// sends every message back, <prefix>/chat relays it to every connected
+// chat client.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	wsMaxMessage   = 1 << 20
+	wsPingInterval = 30 * time.Second
+	// wsSendQueue is how many messages a chat client may fall behind
+	// before it is disconnected
+	wsSendQueue = 64
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+const (
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseNoStatus    = 1005
+	wsCloseInvalidData = 1007
+	wsClosePolicy      = 1008
+	wsCloseTooBig      = 1009
+)
+
+// wsCloseError ends the read loop, Code is sent back in the close frame.
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("close %d %s", e.Code, e.Reason)
+}
+
+func wsProtocolError(format string, args ...interface{}) error {
+	return &wsCloseError{Code: wsCloseProtocol, Reason: fmt.Sprintf(format, args...)}
+}
+
+type wsMessage struct {
+	op   byte
+	data []byte
+}
+
+type wsConn struct {
+	s      *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	remote string
+
+	wmu       sync.Mutex
+	w         *bufio.Writer
+	closeSent bool
+
+	// send queues messages for the writer goroutine of a chat client
+	send chan wsMessage
+	done chan struct{}
+}
+
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[*wsConn]struct{}
+}
+
+var chatHub = &wsHub{clients: make(map[*wsConn]struct{})}
+
+// websocketHandler answers WebSocket handshakes for the endpoints under
+// prefix and passes every other request on to next. Like the status page
+// the endpoints are global, they are answered for every host ahead of the
+// virtual hosts and their access rules.
+func (s *Server) websocketHandler(prefix string, next Handler) Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(req *Request) *Response {
+		var chat bool
+		switch req.URL.Path {
+		case prefix + "/echo":
+		case prefix + "/chat":
+			chat = true
+		default:
+			return next(req)
+		}
+		resp, err := wsHandshake(req)
+		if err != nil {
+			log.Printf("Error in WebSocket handshake - %s", err.Error())
+			return resp
+		}
+
+		resp.Upgrade = func(conn net.Conn, rw *bufio.ReadWriter) {
+			c := &wsConn{
+				s:      s,
+				conn:   conn,
+				r:      rw.Reader,
+				w:      rw.Writer,
+				remote: req.RemoteAddr,
+				send:   make(chan wsMessage, wsSendQueue),
+				done:   make(chan struct{}),
+			}
+			log.Printf("WebSocket %s connected to %s", c.remote, req.URL.Path)
+			if chat {
+				c.serveChat()
+			} else {
+				c.serveEcho()
+			}
+			log.Printf("WebSocket %s disconnected", c.remote)
+		}
+		return resp
+	}
+}
+
+// wsHandshake validates the opening handshake (RFC 6455 4.2.1) and builds
+// the 101 response, on error resp is the response to send instead.
+func wsHandshake(req *Request) (*Response, error) {
+	if req.Method != "GET" {
+		return errorResponse(405), fmt.Errorf("method %s", req.Method)
+	}
+	if req.Proto != "HTTP/1.1" || !headerHasToken(req.Header, "Upgrade", "websocket") ||
+		!headerHasToken(req.Header, "Connection", "Upgrade") {
+		resp := errorResponse(426)
+		resp.Header.Set("Upgrade", "websocket")
+		return resp, errors.New("not an upgrade request")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		resp := errorResponse(426)
+		resp.Header["Sec-WebSocket-Version"] = []string{"13"}
+		return resp, fmt.Errorf("version %q", req.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		return errorResponse(400), fmt.Errorf("invalid key %q", key)
+	}
+
+	resp := newResponse(101, nil)
+	resp.Header.Set("Upgrade", "websocket")
+	resp.Header.Set("Connection", "Upgrade")
+	// set directly, canonicalization would spell it Sec-Websocket-Accept
+	resp.Header["Sec-WebSocket-Accept"] = []string{wsAccept(key)}
+	return resp, nil
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (c *wsConn) serveEcho() {
+	go c.pinger()
+	defer close(c.done)
+	c.readLoop(func(msg wsMessage) {
+		if err := c.writeFrame(msg.op, msg.data); err != nil {
+			c.s.connError("Error writing WebSocket message", err)
+		}
+	})
+}
+
+func (c *wsConn) serveChat() {
+	chatHub.join(c)
+	go c.writeLoop()
+	defer close(c.done)
+	defer chatHub.leave(c)
+	c.readLoop(func(msg wsMessage) {
+		if msg.op == wsOpText {
+			msg.data = []byte(fmt.Sprintf("[%s] %s", c.remote, msg.data))
+		}
+		chatHub.broadcast(msg)
+	})
+}
+
+// readLoop calls onMessage for every complete data message until the
+// connection is closed by either side, answering control frames itself.
+func (c *wsConn) readLoop(onMessage func(msg wsMessage)) {
+	for {
+		// the connection always counts as idle, so shutdown interrupts
+		// the read and the client gets a going away close frame
+		if !c.s.setDeadline(c.conn.SetReadDeadline, 2*wsPingInterval) {
+			return
+		}
+		c.s.setIdle(c.conn, true)
+		msg, err := c.readMessage()
+		if err == nil {
+			onMessage(msg)
+			continue
+		}
+
+		var ce *wsCloseError
+		switch {
+		case errors.As(err, &ce):
+			if ce.Code != wsCloseNormal {
+				log.Printf("WebSocket %s - %s", c.remote, ce.Error())
+			}
+			c.close(ce.Code, ce.Reason)
+		case isTimeout(err) && c.s.isClosing():
+			c.close(wsCloseGoingAway, "server shutting down")
+		case isTimeout(err):
+			log.Printf("WebSocket %s timed out", c.remote)
+		case err != io.EOF && !errors.Is(err, net.ErrClosed):
+			c.s.connError("Error reading WebSocket frame", err)
+		}
+		return
+	}
+}
+
+// readMessage reassembles a fragmented message, control frames may arrive
+// between its fragments.
+func (c *wsConn) readMessage() (wsMessage, error) {
+	var msg wsMessage
+	started := false
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return msg, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return msg, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			return msg, parseClose(payload)
+		case wsOpText, wsOpBinary:
+			if started {
+				return msg, wsProtocolError("new message inside a fragmented one")
+			}
+			started = true
+			msg.op = op
+		case wsOpContinuation:
+			if !started {
+				return msg, wsProtocolError("continuation without a message")
+			}
+		default:
+			return msg, wsProtocolError("unknown opcode %#x", op)
+		}
+
+		if len(msg.data)+len(payload) > wsMaxMessage {
+			return msg, &wsCloseError{Code: wsCloseTooBig, Reason: "message too big"}
+		}
+		msg.data = append(msg.data, payload...)
+		if !fin {
+			continue
+		}
+		if msg.op == wsOpText && !utf8.Valid(msg.data) {
+			return msg, &wsCloseError{Code: wsCloseInvalidData, Reason: "invalid UTF-8"}
+		}
+		return msg, nil
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.r, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	op = hdr[0] & 0x0f
+	if hdr[0]&0x70 != 0 {
+		err = wsProtocolError("reserved bits set")
+		return
+	}
+	if hdr[1]&0x80 == 0 {
+		err = wsProtocolError("unmasked client frame")
+		return
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (length > 125 || !fin) {
+		err = wsProtocolError("invalid control frame")
+		return
+	}
+	if length > uint64(wsMaxMessage) {
+		err = &wsCloseError{Code: wsCloseTooBig, Reason: "frame too big"}
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// parseClose turns a received close frame into the error that ends the
+// read loop, the status code is echoed back as required.
+func parseClose(payload []byte) error {
+	switch {
+	case len(payload) == 0:
+		return &wsCloseError{Code: wsCloseNormal}
+	case len(payload) == 1:
+		return wsProtocolError("close frame of 1 byte")
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	if !validCloseCode(code) {
+		return wsProtocolError("invalid close code %d", code)
+	}
+	if !utf8.Valid(payload[2:]) {
+		return &wsCloseError{Code: wsCloseInvalidData, Reason: "invalid UTF-8 in close reason"}
+	}
+	return &wsCloseError{Code: code}
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// writeFrame sends an unfragmented, unmasked frame, nothing is sent after
+// the close frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if op == wsOpClose {
+		c.closeSent = true
+	}
+
+	hdr := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n <= 125:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(payload); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *wsConn) close(code int, reason string) {
+	var payload []byte
+	if code != wsCloseNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	if err := c.writeFrame(wsOpClose, payload); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.s.connError("Error writing WebSocket close", err)
+	}
+}
+
+// pinger keeps idle connections alive, a client that stops answering is
+// dropped by the read deadline.
+func (c *wsConn) pinger() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeLoop sends the queued chat messages and the pings of a chat client.
+func (c *wsConn) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			err = c.writeFrame(msg.op, msg.data)
+		case <-ticker.C:
+			err = c.writeFrame(wsOpPing, nil)
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.s.connError("Error writing WebSocket message", err)
+			}
+			// unblock the read loop
+			_ = c.conn.Close()
+			return
+		}
+	}
+}
+
+func (h *wsHub) join(c *wsConn) {
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	n := len(h.clients)
+	h.mu.Unlock()
+	h.broadcast(wsMessage{op: wsOpText, data: []byte(fmt.Sprintf("* %s joined, %d online", c.remote, n))})
+}
+
+func (h *wsHub) leave(c *wsConn) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	n := len(h.clients)
+	h.mu.Unlock()
+	h.broadcast(wsMessage{op: wsOpText, data: []byte(fmt.Sprintf("* %s left, %d online", c.remote, n))})
+}
+
+// broadcast queues msg for every client, one that is too far behind is
+// disconnected instead of slowing everybody down.
+func (h *wsHub) broadcast(msg wsMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		select {
+		case c.send <- msg:
+		default:
+			delete(h.clients, c)
+			log.Printf("WebSocket %s dropped, too slow", c.remote)
+			go c.close(wsClosePolicy, "too slow")
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWsAccept(t *testing.T) {
+	// the example of RFC 6455 1.3
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("wsAccept = %q", got)
+	}
+}
+
+// wsClient is the client side of an upgraded connection.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWS(t *testing.T, addr string) *wsClient {
+	conn, r := dialKeepAlive(t, addr)
+	if _, err := io.WriteString(conn, "GET /ws/echo HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake answered %d, accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return &wsClient{t: t, conn: conn, r: r}
+}
+
+// send writes one frame, masked like a client has to unless masked is false.
+func (c *wsClient) send(fin bool, op byte, payload []byte, masked bool) {
+	c.t.Helper()
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	hdr := []byte{b0}
+	var bit byte
+	if masked {
+		bit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		hdr = append(hdr, bit|byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, bit|126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, bit|127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	data := append([]byte(nil), payload...)
+	if masked {
+		mask := []byte{0x12, 0x34, 0x56, 0x78}
+		hdr = append(hdr, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	if _, err := c.conn.Write(append(hdr, data...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// recv reads one server frame, those are never masked or fragmented.
+func (c *wsClient) recv() (op byte, payload []byte) {
+	c.t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if hdr[0]&0x80 == 0 || hdr[1]&0x80 != 0 {
+		c.t.Fatalf("server frame header %x", hdr)
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			c.t.Fatal(err)
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			c.t.Fatal(err)
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return hdr[0] & 0x0f, payload
+}
+
+func (c *wsClient) expect(op byte, payload []byte) {
+	c.t.Helper()
+	gotOp, got := c.recv()
+	if gotOp != op || !bytes.Equal(got, payload) {
+		c.t.Fatalf("got opcode %#x with %d bytes %.40q, want %#x with %d bytes %.40q", gotOp, len(got), got, op, len(payload), payload)
+	}
+}
+
+// expectClose waits for the close frame with code and then for the end of
+// the connection.
+func (c *wsClient) expectClose(code int) {
+	c.t.Helper()
+	op, payload := c.recv()
+	if op != wsOpClose || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		c.t.Fatalf("got opcode %#x with %q, want close %d", op, payload, code)
+	}
+	expectClosed(c.t, c.r)
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	setTimeouts(t, time.Second, time.Second)
+	oldMax := wsMaxMessage
+	wsMaxMessage = 100000
+	t.Cleanup(func() {
+		wsMaxMessage = oldMax
+	})
+	medium := bytes.Repeat([]byte("m"), 300)
+	large := bytes.Repeat([]byte("l"), 70000)
+
+	tests := []struct {
+		name string
+		run  func(c *wsClient)
+	}{
+		{"echo", func(c *wsClient) {
+			c.send(true, wsOpText, []byte("hello"), true)
+			c.expect(wsOpText, []byte("hello"))
+			c.send(true, wsOpBinary, medium, true)
+			c.expect(wsOpBinary, medium)
+			c.send(true, wsOpBinary, large, true)
+			c.expect(wsOpBinary, large)
+			c.send(true, wsOpText, nil, true)
+			c.expect(wsOpText, []byte{})
+		}},
+		{"fragmented with ping", func(c *wsClient) {
+			c.send(false, wsOpText, []byte("hel"), true)
+			c.send(true, wsOpPing, []byte("p"), true)
+			c.expect(wsOpPong, []byte("p"))
+			c.send(false, wsOpContinuation, []byte("lo "), true)
+			c.send(true, wsOpContinuation, []byte("world"), true)
+			c.expect(wsOpText, []byte("hello world"))
+		}},
+		{"utf-8 split across fragments", func(c *wsClient) {
+			c.send(false, wsOpText, []byte("\xc3"), true)
+			c.send(true, wsOpContinuation, []byte("\xa9"), true)
+			c.expect(wsOpText, []byte("é"))
+		}},
+		{"close handshake", func(c *wsClient) {
+			c.send(true, wsOpClose, closePayload(wsCloseNormal, "bye"), true)
+			c.expectClose(wsCloseNormal)
+		}},
+		{"close without status", func(c *wsClient) {
+			c.send(true, wsOpClose, nil, true)
+			c.expectClose(wsCloseNormal)
+		}},
+		{"close with reserved code", func(c *wsClient) {
+			c.send(true, wsOpClose, closePayload(wsCloseNoStatus, ""), true)
+			c.expectClose(wsCloseProtocol)
+		}},
+		{"unmasked", func(c *wsClient) {
+			c.send(true, wsOpText, []byte("hello"), false)
+			c.expectClose(wsCloseProtocol)
+		}},
+		{"continuation without message", func(c *wsClient) {
+			c.send(true, wsOpContinuation, []byte("x"), true)
+			c.expectClose(wsCloseProtocol)
+		}},
+		{"message inside fragmented one", func(c *wsClient) {
+			c.send(false, wsOpText, []byte("a"), true)
+			c.send(true, wsOpText, []byte("b"), true)
+			c.expectClose(wsCloseProtocol)
+		}},
+		{"fragmented control frame", func(c *wsClient) {
+			c.send(false, wsOpPing, []byte("p"), true)
+			c.expectClose(wsCloseProtocol)
+		}},
+		{"invalid utf-8", func(c *wsClient) {
+			c.send(true, wsOpText, []byte("\xff"), true)
+			c.expectClose(wsCloseInvalidData)
+		}},
+		{"message too big", func(c *wsClient) {
+			c.send(false, wsOpBinary, large, true)
+			c.send(true, wsOpContinuation, large, true)
+			c.expectClose(wsCloseTooBig)
+		}},
+	}
+	for _, task := range []TaskType{TaskB, TaskE} {
+		t.Run(task.String(), func(t *testing.T) {
+			s := NewServer(task, 4)
+			addr := startServer(t, s, s.websocketHandler("/ws", okHandler))
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					tt.run(dialWS(t, addr))
+				})
+			}
+		})
+	}
+}
+
+func TestWebSocketHandshakeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"post", "POST /ws/echo HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", 405},
+		{"no upgrade", "GET /ws/echo HTTP/1.1\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", 426},
+		{"old version", "GET /ws/echo HTTP/1.1\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", 426},
+		{"short key", "GET /ws/echo HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := readRequest(bufio.NewReader(strings.NewReader(tt.raw + "Host: test\r\n\r\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := wsHandshake(req)
+			if err == nil || resp.Status != tt.status {
+				t.Errorf("handshake - %d, %v, want %d", resp.Status, err, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+#!/bin/sh
+# Compares throughput of the reliable transfer protocols under increasing
+# packet loss. Loss is applied on the client side in both directions, the
+# server runs without impairment.
+#
+#   ./compare.sh [file] [window] [loss rates]
+#
+# CONGESTION=reno or CONGESTION=cubic turns on congestion control for gbn and sr.
+#
+set -e
+
+WINDOW=${2:-16}
+LOSSES=${3:-"0 0.05 0.1 0.2"}
+CONGESTION=${CONGESTION:-none}
+
+cd "$(dirname "$0")"
+BIN=$(mktemp -d)
+trap 'rm -rf "$BIN"' EXIT
+(cd src/server && go build -o "$BIN/server" .)
+(cd src/client && go build -o "$BIN/client" .)
+
+FILE=${1:-$BIN/payload.bin}
+[ -n "$1" ] || head -c 200000 /dev/urandom > "$FILE"
+
+"$BIN/server" -m transfer -o "$BIN/received" -loss 0 > /dev/null 2>&1 &
+pid=$!
+trap 'kill "$pid" 2>/dev/null; rm -rf "$BIN"' EXIT
+sleep 0.5
+
+for loss in $LOSSES; do
+	for proto in sw gbn sr; do
+		cc=$CONGESTION
+		[ "$proto" != sw ] || cc=none
+		"$BIN/client" -m send -f "$FILE" -p "$proto" -w "$WINDOW" -cc "$cc" -loss "$loss" \
+			-report "$BIN/report.csv" > /dev/null 2>&1 || echo "$proto failed at loss $loss" >&2
+	done
+done
+
+python3 -c '
+import csv, sys
+print("%-18s %-6s %6s %6s %10s %10s %8s" % ("protocol", "cc", "window", "loss", "KB/s", "retrans", "timeouts"))
+for r in csv.DictReader(open(sys.argv[1])):
+    print("%-18s %-6s %6s %6s %10s %10s %8s" % (r["protocol"], r["cc"], r["window"], r["loss"], r["kb_per_s"], r["retransmitted"], r["timeouts"]))
+' "$BIN/report.csv"
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"netsim"
+)
+
+// dupAckThreshold is the number of duplicate ACKs that signal a lost
+// segment and trigger a fast retransmit.
+const dupAckThreshold = 3
+
+// CongestionControl decides how many segments the sender may have in
+// flight. Windows are counted in segments.
+type CongestionControl interface {
+	Name() string
+	Cwnd() float64
+	Ssthresh() float64
+	// OnAck is called when the window slides by acked segments.
+	OnAck(acked int, srtt time.Duration)
+	// OnDupAck is called for every duplicate ACK, dups counts them since
+	// the window last moved.
+	OnDupAck(dups int, inFlight int)
+	// OnTimeout is called when the retransmission timer expires.
+	OnTimeout(inFlight int)
+}
+
+func newCongestionControl(name string) CongestionControl {
+	switch name {
+	case "reno":
+		return NewReno()
+	case "cubic":
+		return NewCubic()
+	}
+	return nil
+}
+
+const (
+	initialCwnd     = 1
+	initialSsthresh = netsim.MaxWindow
+	minSsthresh     = 2
+)
+
+// lossWindow is the window a loss is reacted to: the congestion window
+// unless the sender could not fill it.
+func lossWindow(cwnd float64, inFlight int) float64 {
+	return math.Min(cwnd, float64(inFlight))
+}
+
+// Reno is TCP Reno (RFC 5681): slow start, congestion avoidance and fast
+// recovery with window inflation.
+type Reno struct {
+	cwnd       float64
+	ssthresh   float64
+	inRecovery bool
+}
+
+func NewReno() *Reno {
+	return &Reno{cwnd: initialCwnd, ssthresh: initialSsthresh}
+}
+
+func (r *Reno) Name() string      { return "reno" }
+func (r *Reno) Cwnd() float64     { return r.cwnd }
+func (r *Reno) Ssthresh() float64 { return r.ssthresh }
+
+func (r *Reno) OnAck(acked int, _ time.Duration) {
+	if r.inRecovery {
+		// a new ACK ends fast recovery, the inflated window is deflated
+		r.inRecovery = false
+		r.cwnd = r.ssthresh
+		return
+	}
+	if r.cwnd < r.ssthresh {
+		r.cwnd += float64(acked)
+	} else {
+		r.cwnd += float64(acked) / r.cwnd
+	}
+}
+
+func (r *Reno) OnDupAck(dups int, inFlight int) {
+	switch {
+	case dups == dupAckThreshold && !r.inRecovery:
+		r.ssthresh = math.Max(lossWindow(r.cwnd, inFlight)/2, minSsthresh)
+		r.cwnd = r.ssthresh + dupAckThreshold
+		r.inRecovery = true
+	case dups > dupAckThreshold && r.inRecovery:
+		// every duplicate ACK means a segment has left the network
+		r.cwnd++
+	}
+}
+
+func (r *Reno) OnTimeout(inFlight int) {
+	r.ssthresh = math.Max(lossWindow(r.cwnd, inFlight)/2, minSsthresh)
+	r.cwnd = initialCwnd
+	r.inRecovery = false
+}
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// Cubic is CUBIC (RFC 8312): after a loss the window follows a cubic
+// function of the time since the loss, with its plateau at the window
+// where the loss happened. The TCP-friendly estimate keeps it at least as
+// fast as Reno on short RTTs.
+type Cubic struct {
+	cwnd       float64
+	ssthresh   float64
+	inRecovery bool
+
+	wMax   float64
+	k      float64
+	origin float64
+	wEst   float64
+	// epoch is the start of the current congestion avoidance period, zero
+	// until the first ACK after a loss
+	epoch time.Time
+}
+
+func NewCubic() *Cubic {
+	return &Cubic{cwnd: initialCwnd, ssthresh: initialSsthresh}
+}
+
+func (c *Cubic) Name() string      { return "cubic" }
+func (c *Cubic) Cwnd() float64     { return c.cwnd }
+func (c *Cubic) Ssthresh() float64 { return c.ssthresh }
+
+func (c *Cubic) OnAck(acked int, srtt time.Duration) {
+	if c.inRecovery {
+		c.inRecovery = false
+		c.cwnd = c.ssthresh
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd += float64(acked)
+		return
+	}
+
+	now := time.Now()
+	if c.epoch.IsZero() {
+		c.epoch = now
+		if c.cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / cubicC)
+			c.origin = c.wMax
+		} else {
+			c.k = 0
+			c.origin = c.cwnd
+		}
+		c.wEst = c.cwnd
+	}
+
+	// the target is where the window should be one RTT from now
+	t := now.Sub(c.epoch).Seconds() + srtt.Seconds()
+	target := c.origin + cubicC*math.Pow(t-c.k, 3)
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * float64(acked) / c.cwnd
+
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) / c.cwnd * float64(acked)
+	} else {
+		c.cwnd += 0.01 * float64(acked) / c.cwnd
+	}
+	if c.wEst > c.cwnd {
+		c.cwnd = c.wEst
+	}
+}
+
+func (c *Cubic) OnDupAck(dups int, inFlight int) {
+	if dups == dupAckThreshold && !c.inRecovery {
+		c.reduce(inFlight)
+		c.inRecovery = true
+	}
+}
+
+func (c *Cubic) OnTimeout(inFlight int) {
+	c.reduce(inFlight)
+	c.cwnd = initialCwnd
+	c.inRecovery = false
+}
+
+func (c *Cubic) reduce(inFlight int) {
+	w := lossWindow(c.cwnd, inFlight)
+	if w < c.wMax {
+		// fast convergence: release bandwidth to newer flows
+		c.wMax = w * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = w
+	}
+	c.ssthresh = math.Max(w*cubicBeta, minSsthresh)
+	c.cwnd = c.ssthresh
+	c.epoch = time.Time{}
+}
+
+const (
+	clockGranularity = time.Millisecond
+	minRTO           = 20 * time.Millisecond
+	maxRTO           = 60 * time.Second
+)
+
+// RTTEstimator computes the retransmission timeout as in RFC 6298. The
+// sender only samples segments that were never retransmitted (Karn's
+// algorithm). The timeout doubles on every expiry and, as in Linux, the
+// backoff is undone by the first ACK of new data, otherwise a sender that
+// retransmits a lot would get no samples to recover from it.
+type RTTEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	// backoff is the number of timeouts since the last ACK of new data
+	backoff uint
+	// sampled is false until the first measurement
+	sampled bool
+}
+
+func NewRTTEstimator(initial time.Duration) *RTTEstimator {
+	return &RTTEstimator{rto: initial}
+}
+
+func (e *RTTEstimator) Sample(r time.Duration) {
+	if !e.sampled {
+		e.srtt = r
+		e.rttvar = r / 2
+		e.sampled = true
+	} else {
+		diff := e.srtt - r
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + r) / 8
+	}
+	variance := 4 * e.rttvar
+	if variance < clockGranularity {
+		variance = clockGranularity
+	}
+	e.rto = clamp(e.srtt+variance, minRTO, maxRTO)
+}
+
+func (e *RTTEstimator) Backoff() {
+	if e.RTO() < maxRTO {
+		e.backoff++
+	}
+}
+
+func (e *RTTEstimator) ResetBackoff() {
+	e.backoff = 0
+}
+
+func (e *RTTEstimator) SRTT() time.Duration { return e.srtt }
+
+func (e *RTTEstimator) RTO() time.Duration {
+	return clamp(e.rto<<e.backoff, minRTO, maxRTO)
+}
+
+func clamp(d, lo, hi time.Duration) time.Duration {
+	if d < lo {
+		return lo
+	}
+	if d > hi {
+		return hi
+	}
+	return d
+}
+
+// TracePoint is the state of the sender after an event, At is the time
+// since the start of the transfer.
+type TracePoint struct {
+	At       time.Duration
+	Event    string
+	Cwnd     float64
+	Ssthresh float64
+	RTT      time.Duration
+	SRTT     time.Duration
+	RTO      time.Duration
+}
+
+var traceHeader = []string{"time_ms", "event", "cwnd", "ssthresh", "rtt_ms", "srtt_ms", "rto_ms"}
+
+func writeTrace(name string, points []TracePoint) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	w := csv.NewWriter(file)
+	_ = w.Write(traceHeader)
+	for _, p := range points {
+		rtt := ""
+		if p.RTT > 0 {
+			rtt = ms(p.RTT)
+		}
+		_ = w.Write([]string{
+			ms(p.At),
+			p.Event,
+			strconv.FormatFloat(p.Cwnd, 'f', 2, 64),
+			strconv.FormatFloat(p.Ssthresh, 'f', 2, 64),
+			rtt,
+			ms(p.SRTT),
+			ms(p.RTO),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
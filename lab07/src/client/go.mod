@@ -1 +1,5 @@
 module client
+
+require netsim v0.0.0
+
+replace netsim => ../netsim
@@ -5,10 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
 	"time"
+
+	"netsim"
 )
 
 type TaskType int
@@ -17,36 +20,97 @@ const (
 	serverAddr = "localhost:8080"
 	timeout    = time.Second
 	bufferSize = 1024
-	timeFormat = "15:04:05"
 	packetsCnt = 10
 
 	Ping TaskType = iota
 	Heartbeat
+	Send
 )
 
 type Options struct {
-	mode    TaskType
-	clients int
+	mode     TaskType
+	clients  int
+	binary   bool
+	transfer TransferConfig
+	impair   netsim.ImpairConfig
 }
 
 func ParseFlag() (Options, error) {
 	var options Options
 
-	modeStr := flag.String("m", "echo", "`echo` for echo server, `heartbeat` for heartbeat tracking")
+	modeStr := flag.String("m", "echo", "`echo` for echo server, `heartbeat` for heartbeat tracking, `send` for file transfer")
 	clients := flag.Int("c", 2, "number of clients -- only for `heartbeat`")
+	format := flag.String("format", "binary", "packet format of echo and heartbeat: `binary` or text (for older servers)")
+	flag.StringVar(&options.transfer.File, "f", "", "file to send -- only for `send`")
+	protoStr := flag.String("p", "sw", "transfer protocol: `sw` (stop-and-wait), gbn (Go-Back-N) or sr (Selective Repeat) -- only for `send`")
+	flag.IntVar(&options.transfer.Window, "w", 8, "window size of gbn and sr -- only for `send`")
+	ccStr := flag.String("cc", "none", "congestion control of gbn and sr: `none`, reno or cubic -- only for `send`")
+	flag.StringVar(&options.transfer.Trace, "trace", "", "CSV file for the cwnd, ssthresh and RTT trace -- only for `send`")
+	flag.StringVar(&options.transfer.Report, "report", "", "CSV file to append the transfer statistics to -- only for `send`")
+	flag.DurationVar(&options.transfer.Timeout, "rto", 200*time.Millisecond, "retransmission timeout -- only for `send`")
+	flag.IntVar(&options.transfer.SegmentSize, "mss", 1000, "payload bytes per segment -- only for `send`")
+	flag.IntVar(&options.transfer.MaxRetries, "retries", 50, "timeouts in a row before giving up -- only for `send`")
+	options.impair = netsim.ImpairConfig{BurstBadLoss: 1, ReorderDelay: 50 * time.Millisecond, Direction: "both"}
+	options.impair.RegisterFlags()
 
 	flag.Parse()
 
+	if err := options.impair.Validate(); err != nil {
+		return Options{}, err
+	}
+
 	switch *modeStr {
 	case "echo":
 		options.mode = Ping
 	case "heartbeat":
 		options.mode = Heartbeat
+	case "send":
+		options.mode = Send
+		if options.transfer.File == "" {
+			return Options{}, errors.New("no file to send, use -f")
+		}
+		if options.transfer.SegmentSize <= 0 || options.transfer.SegmentSize > netsim.MaxSegmentData {
+			return Options{}, fmt.Errorf("segment size must be in [1, %d]", netsim.MaxSegmentData)
+		}
+		if options.transfer.Timeout <= 0 {
+			return Options{}, errors.New("retransmission timeout must be positive")
+		}
+		switch *protoStr {
+		case "sw":
+			options.transfer.Proto = netsim.StopAndWait
+			options.transfer.Window = 1
+		case "gbn":
+			options.transfer.Proto = netsim.GoBackN
+		case "sr":
+			options.transfer.Proto = netsim.SelectiveRepeat
+		default:
+			return Options{}, fmt.Errorf("unknown protocol %q", *protoStr)
+		}
+		if options.transfer.Window < 1 || options.transfer.Window > netsim.MaxWindow {
+			return Options{}, fmt.Errorf("window size must be in [1, %d]", netsim.MaxWindow)
+		}
+		switch *ccStr {
+		case "none":
+		case "reno", "cubic":
+			if options.transfer.Proto == netsim.StopAndWait {
+				return Options{}, errors.New("congestion control needs a window, use -p gbn or -p sr")
+			}
+			options.transfer.CC = *ccStr
+		default:
+			return Options{}, fmt.Errorf("unknown congestion control %q", *ccStr)
+		}
 	default:
 		return Options{}, errors.New("unknown mode")
 	}
 
 	options.clients = *clients
+	switch *format {
+	case "binary":
+		options.binary = true
+	case "text":
+	default:
+		return Options{}, fmt.Errorf("unknown packet format %q", *format)
+	}
 
 	return options, nil
 }
@@ -61,18 +125,20 @@ func main() {
 
 	switch options.mode {
 	case Ping:
-		runPing(true)
+		runPing(true, options.binary, options.impair)
 	case Heartbeat:
-		runHeartbeat(options.clients)
+		runHeartbeat(options.clients, options.binary, options.impair)
+	case Send:
+		runSend(options.transfer, options.impair)
 	default:
 		log.Printf("Not implemented mod: %d\n", options.mode)
 		os.Exit(1)
 	}
 }
 
-func runPing(isEcho bool) {
+func runPing(isEcho, binaryFormat bool, impair netsim.ImpairConfig) {
 
-	conn, err := net.Dial("udp", serverAddr)
+	conn, err := dial(impair)
 	if err != nil {
 		log.Printf("Error connecting to server: %s\n", err)
 		os.Exit(1)
@@ -89,18 +155,21 @@ func runPing(isEcho bool) {
 
 	lostPackets := 0
 	var rtts []int64
-	var msgBegin string
+	typ := netsim.PktHeartbeat
 	if isEcho {
-		msgBegin = "Ping "
-	} else {
-		msgBegin = ""
+		typ = netsim.PktPing
 	}
+	clientID := rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
 
 	for i := 1; i <= packetsCnt; i++ {
-		msg := fmt.Sprintf("%s%d %s", msgBegin, i, time.Now().Format(timeFormat))
+		packet := &netsim.Packet{Type: typ, Seq: uint32(i), Time: time.Now(), ClientID: clientID}
+		msg := []byte(packet.FormatText())
+		if binaryFormat {
+			msg = packet.Encode()
+		}
 
 		start := time.Now()
-		if _, err := conn.Write([]byte(msg)); err != nil {
+		if _, err := conn.Write(msg); err != nil {
 			log.Printf("Error writing to server: %s\n", err)
 		}
 
@@ -109,8 +178,7 @@ func runPing(isEcho bool) {
 			continue
 		}
 
-		buf := make([]byte, bufferSize)
-		n, err := conn.Read(buf)
+		resp, err := readReply(conn, packet, binaryFormat)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				lostPackets++
@@ -121,29 +189,73 @@ func runPing(isEcho bool) {
 		} else {
 			rtt := time.Since(start).Microseconds()
 			rtts = append(rtts, rtt)
-			fmt.Printf("Ping %d: Response time: %dms seconds, Response: [%s]\n", i, rtt, string(buf[:n]))
+			fmt.Printf("Ping %d: Response time: %dms seconds, Response: [%s]\n", i, rtt, resp)
 		}
 
 		showStats(rtts, lostPackets, i)
 	}
 }
 
-func runHeartbeat(clients int) {
+// readReply returns the reply to packet as text. Binary replies that are
+// damaged or answer an earlier packet are skipped.
+func readReply(conn *netsim.ImpairedConn, packet *netsim.Packet, binaryFormat bool) (string, error) {
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		if !binaryFormat {
+			return string(buf[:n]), nil
+		}
+		reply, err := netsim.DecodePacket(buf[:n])
+		if err != nil {
+			log.Printf("Dropped reply: %s\n", err)
+			continue
+		}
+		if reply.Seq != packet.Seq || reply.ClientID != packet.ClientID {
+			log.Printf("Ignored late reply: %s\n", reply)
+			continue
+		}
+		return reply.String(), nil
+	}
+}
+
+func runHeartbeat(clients int, binaryFormat bool, impair netsim.ImpairConfig) {
 	fmt.Println("Heartbeat started")
 
 	wg := sync.WaitGroup{}
 	wg.Add(clients)
 
 	for i := 0; i < clients; i++ {
+		// у каждого клиента своя последовательность потерь
+		cfg := impair
+		cfg.Seed += int64(i)
 		go func() {
 			defer wg.Done()
-			runPing(false)
+			runPing(false, binaryFormat, cfg)
 		}()
 	}
 
 	wg.Wait()
 }
 
+// dial connects to the server through the simulated network.
+func dial(impair netsim.ImpairConfig) (*netsim.ImpairedConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	if impair.Active() {
+		log.Printf("Simulated network: %s", impair)
+	}
+	return netsim.NewImpairedConn(conn, impair), nil
+}
+
 func showStats(rtts []int64, lostPackets, totalPackets int) {
 	fmt.Printf("%d packets transmitted, %d received, %.2f%% packet loss\n",
 		totalPackets, totalPackets-lostPackets, float64(lostPackets)/float64(totalPackets)*100)
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"netsim"
+)
+
+type TransferConfig struct {
+	File        string
+	Proto       netsim.Protocol
+	Window      int
+	Timeout     time.Duration
+	SegmentSize int
+	// MaxRetries is how many timeouts in a row end the transfer
+	MaxRetries int
+	// CC is the congestion control of gbn and sr, empty for a fixed
+	// window and timeout
+	CC string
+	// Report is a CSV file that gets one row per transfer
+	Report string
+	// Trace is a CSV file for the congestion window and RTT over time
+	Trace string
+}
+
+type TransferStats struct {
+	Bytes         int64
+	Segments      int
+	Sent          int
+	Retransmitted int
+	Timeouts      int
+	DupAcks       int
+	// FastRetransmits are retransmissions after duplicate ACKs
+	FastRetransmits int
+	CorruptAcks     int
+	Duration        time.Duration
+}
+
+type Sender struct {
+	conn    *netsim.ImpairedConn
+	cfg     TransferConfig
+	session uint32
+	segs    []*netsim.Segment
+	wires   [][]byte
+	buf     []byte
+	stats   TransferStats
+
+	sentAt        []time.Time
+	retransmitted []bool
+
+	cc      CongestionControl
+	rtt     *RTTEstimator
+	start   time.Time
+	lastRTT time.Duration
+	points  []TracePoint
+}
+
+var errTooManyRetries = errors.New("too many retransmissions, giving up")
+
+func runSend(cfg TransferConfig, impair netsim.ImpairConfig) {
+	data, err := os.ReadFile(cfg.File)
+	if err != nil {
+		log.Printf("Error reading file: %s\n", err)
+		os.Exit(1)
+	}
+	conn, err := dial(impair)
+	if err != nil {
+		log.Printf("Error connecting to server: %s\n", err)
+		os.Exit(1)
+	}
+	defer func(conn *netsim.ImpairedConn) {
+		if err := conn.Close(); err != nil {
+			log.Printf("Error closing connection: %s\n", err)
+		}
+	}(conn)
+
+	if cfg.Proto == netsim.StopAndWait && (impair.Reorder > 0 || impair.Jitter > 0) {
+		log.Printf("Warning: the alternating bit assumes a channel that does not reorder packets\n")
+	}
+
+	s := NewSender(conn, cfg, data)
+	algorithm := "fixed window"
+	if s.cc != nil {
+		algorithm = s.cc.Name()
+	}
+	fmt.Printf("Sending %s (%d bytes) to %s with %s (%s), session %08x\n",
+		cfg.File, len(data), serverAddr, cfg.Proto, algorithm, s.session)
+	s.start = time.Now()
+	err = s.Run()
+	s.stats.Duration = time.Since(s.start)
+	showTransferStats(s.stats)
+	if cfg.Trace != "" {
+		if err := writeTrace(cfg.Trace, s.points); err != nil {
+			log.Printf("Error writing trace: %s\n", err)
+		}
+	}
+	if err != nil {
+		log.Printf("Transfer failed: %s\n", err)
+		os.Exit(1)
+	}
+	if cfg.Report != "" {
+		if err := appendReport(cfg.Report, cfg, impair, s.stats); err != nil {
+			log.Printf("Error writing report: %s\n", err)
+		}
+	}
+	fmt.Printf("sha256 %x\n", sha256.Sum256(data))
+}
+
+// NewSender splits data into the START, DATA and FIN segments of a new
+// session.
+func NewSender(conn *netsim.ImpairedConn, cfg TransferConfig, data []byte) *Sender {
+	s := &Sender{
+		conn:    conn,
+		cfg:     cfg,
+		session: rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(),
+		buf:     make([]byte, bufferSize),
+	}
+	s.add(netsim.SegStart, []byte(filepath.Base(cfg.File)))
+	for off := 0; off < len(data); off += cfg.SegmentSize {
+		end := off + cfg.SegmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		s.add(netsim.SegData, data[off:end])
+	}
+	s.add(netsim.SegFin, nil)
+	s.stats.Bytes = int64(len(data))
+	s.stats.Segments = len(s.segs)
+	s.sentAt = make([]time.Time, len(s.segs))
+	s.retransmitted = make([]bool, len(s.segs))
+	if s.cc = newCongestionControl(cfg.CC); s.cc != nil {
+		s.rtt = NewRTTEstimator(cfg.Timeout)
+	}
+	return s
+}
+
+func (s *Sender) add(typ netsim.SegmentType, payload []byte) {
+	seg := &netsim.Segment{
+		Type:    typ,
+		Proto:   s.cfg.Proto,
+		Session: s.session,
+		Seq:     uint32(len(s.segs)),
+		Payload: payload,
+	}
+	s.segs = append(s.segs, seg)
+	s.wires = append(s.wires, seg.Encode())
+}
+
+func (s *Sender) Run() error {
+	switch s.cfg.Proto {
+	case netsim.StopAndWait:
+		return s.stopAndWait()
+	case netsim.GoBackN:
+		return s.goBackN()
+	case netsim.SelectiveRepeat:
+		return s.selectiveRepeat()
+	}
+	return fmt.Errorf("unsupported %s", s.cfg.Proto)
+}
+
+// stopAndWait is the rdt3.0 sender: one segment in flight, numbered with
+// an alternating bit, retransmitted until its ACK arrives. ACKs that are
+// corrupted or for the other bit are ignored and the timer keeps running.
+func (s *Sender) stopAndWait() error {
+	for i, seg := range s.segs {
+		bit := uint32(i % 2)
+		wire := (&netsim.Segment{Type: seg.Type, Proto: seg.Proto, Session: seg.Session, Seq: bit, Payload: seg.Payload}).Encode()
+
+		for retries := 0; ; retries++ {
+			if retries > s.cfg.MaxRetries {
+				return errTooManyRetries
+			}
+			if err := s.send(wire, retries > 0); err != nil {
+				return err
+			}
+			acked, err := s.waitAck(time.Now().Add(s.cfg.Timeout), func(ack *netsim.Segment) bool {
+				return ack.Seq == bit
+			})
+			if err != nil {
+				return err
+			}
+			if acked {
+				break
+			}
+			s.stats.Timeouts++
+		}
+	}
+	return nil
+}
+
+// goBackN keeps up to Window segments in flight with a single timer for
+// the oldest one. ACKs are cumulative, on a timeout the sender goes back
+// to the oldest unacknowledged segment and sends everything again.
+func (s *Sender) goBackN() error {
+	// sent is the highest segment ever sent plus one, ACKs up to it are
+	// valid even after going back
+	base, next, sent := 0, 0, 0
+	var deadline time.Time
+	stalled, dups := 0, 0
+	for base < len(s.segs) {
+		for next < len(s.segs) && next < base+s.window() {
+			if err := s.sendSeg(next); err != nil {
+				return err
+			}
+			if base == next {
+				deadline = time.Now().Add(s.rto())
+			}
+			next++
+		}
+		if next > sent {
+			sent = next
+		}
+
+		ack, err := s.readAck(deadline)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.stats.Timeouts++
+			if stalled++; stalled > s.cfg.MaxRetries {
+				return errTooManyRetries
+			}
+			s.onTimeout(next - base)
+			next, dups = base, 0
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ack == nil {
+			continue
+		}
+		seq := int(ack.Seq)
+		if seq == base-1 && s.cc != nil {
+			s.stats.DupAcks++
+			dups++
+			if err := s.onDupAck(base, dups, next-base); err != nil {
+				return err
+			}
+			if dups == dupAckThreshold {
+				// the receiver dropped everything after the gap as well
+				next = base + 1
+				deadline = time.Now().Add(s.rto())
+			}
+			continue
+		}
+		if seq < base || seq >= sent {
+			s.stats.DupAcks++
+			continue
+		}
+		s.sample(seq)
+		acked := seq + 1 - base
+		base = seq + 1
+		if next < base {
+			next = base
+		}
+		stalled, dups = 0, 0
+		s.onAck(acked)
+		if base < next {
+			deadline = time.Now().Add(s.rto())
+		}
+	}
+	return nil
+}
+
+// selectiveRepeat keeps a timer per segment and retransmits only the ones
+// that expire. Each ACK covers a single segment, the window slides past
+// the acknowledged prefix. With congestion control an ACK beyond a gap
+// counts as a duplicate ACK for the missing segment.
+func (s *Sender) selectiveRepeat() error {
+	acked := make([]bool, len(s.segs))
+	timers := make([]time.Time, len(s.segs))
+	base, next := 0, 0
+	stalled, dups := 0, 0
+	for base < len(s.segs) {
+		for next < len(s.segs) && next < base+s.window() {
+			if err := s.sendSeg(next); err != nil {
+				return err
+			}
+			timers[next] = time.Now().Add(s.rto())
+			next++
+		}
+
+		var earliest time.Time
+		for i := base; i < next; i++ {
+			if !acked[i] && (earliest.IsZero() || timers[i].Before(earliest)) {
+				earliest = timers[i]
+			}
+		}
+		ack, err := s.readAck(earliest)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if stalled++; stalled > s.cfg.MaxRetries {
+				return errTooManyRetries
+			}
+			s.onTimeout(next - base)
+			now := time.Now()
+			for i := base; i < next; i++ {
+				if acked[i] || timers[i].After(now) {
+					continue
+				}
+				s.stats.Timeouts++
+				if err := s.sendSeg(i); err != nil {
+					return err
+				}
+				timers[i] = now.Add(s.rto())
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ack == nil {
+			continue
+		}
+		seq := int(ack.Seq)
+		if seq < base || seq >= next || acked[seq] {
+			s.stats.DupAcks++
+			continue
+		}
+		acked[seq] = true
+		stalled = 0
+		s.sample(seq)
+		if seq > base {
+			if s.cc == nil {
+				continue
+			}
+			dups++
+			if err := s.onDupAck(base, dups, next-base); err != nil {
+				return err
+			}
+			if dups == dupAckThreshold {
+				timers[base] = time.Now().Add(s.rto())
+			}
+			continue
+		}
+		from := base
+		for base < next && acked[base] {
+			base++
+		}
+		dups = 0
+		s.onAck(base - from)
+	}
+	return nil
+}
+
+// window is the number of segments the sender may have in flight: the
+// congestion window bounded by the receiver's window.
+func (s *Sender) window() int {
+	if s.cc == nil {
+		return s.cfg.Window
+	}
+	w := int(s.cc.Cwnd())
+	if w < 1 {
+		w = 1
+	}
+	if w > s.cfg.Window {
+		w = s.cfg.Window
+	}
+	return w
+}
+
+func (s *Sender) rto() time.Duration {
+	if s.rtt == nil {
+		return s.cfg.Timeout
+	}
+	return s.rtt.RTO()
+}
+
+// sample measures the RTT of an acknowledged segment unless it was
+// retransmitted, its ACK could belong to any of the copies.
+func (s *Sender) sample(seq int) {
+	if s.rtt == nil || s.retransmitted[seq] {
+		return
+	}
+	r := time.Since(s.sentAt[seq])
+	s.rtt.Sample(r)
+	s.lastRTT = r
+}
+
+func (s *Sender) onAck(acked int) {
+	if s.cc == nil {
+		return
+	}
+	s.rtt.ResetBackoff()
+	s.cc.OnAck(acked, s.rtt.SRTT())
+	s.trace("ack")
+}
+
+// onDupAck retransmits the oldest segment once enough duplicate ACKs
+// point at it.
+func (s *Sender) onDupAck(base, dups, inFlight int) error {
+	s.cc.OnDupAck(dups, inFlight)
+	if dups != dupAckThreshold {
+		s.trace("dupack")
+		return nil
+	}
+	s.stats.FastRetransmits++
+	s.trace("fast-retransmit")
+	return s.sendSeg(base)
+}
+
+func (s *Sender) onTimeout(inFlight int) {
+	if s.cc == nil {
+		return
+	}
+	s.cc.OnTimeout(inFlight)
+	s.rtt.Backoff()
+	s.trace("timeout")
+}
+
+func (s *Sender) trace(event string) {
+	if s.cfg.Trace == "" {
+		return
+	}
+	s.points = append(s.points, TracePoint{
+		At:       time.Since(s.start),
+		Event:    event,
+		Cwnd:     s.cc.Cwnd(),
+		Ssthresh: s.cc.Ssthresh(),
+		RTT:      s.lastRTT,
+		SRTT:     s.rtt.SRTT(),
+		RTO:      s.rtt.RTO(),
+	})
+	s.lastRTT = 0
+}
+
+// sendSeg sends a segment of a pipelined protocol, any copy after the
+// first one is a retransmission.
+func (s *Sender) sendSeg(i int) error {
+	retransmission := !s.sentAt[i].IsZero()
+	if err := s.send(s.wires[i], retransmission); err != nil {
+		return err
+	}
+	s.sentAt[i] = time.Now()
+	if retransmission {
+		s.retransmitted[i] = true
+	}
+	return nil
+}
+
+func (s *Sender) send(wire []byte, retransmission bool) error {
+	if _, err := s.conn.Write(wire); err != nil {
+		return err
+	}
+	s.stats.Sent++
+	if retransmission {
+		s.stats.Retransmitted++
+	}
+	return nil
+}
+
+// waitAck reads ACKs until match accepts one or the deadline passes.
+func (s *Sender) waitAck(deadline time.Time, match func(ack *netsim.Segment) bool) (bool, error) {
+	for {
+		ack, err := s.readAck(deadline)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return false, nil
+			}
+			return false, err
+		}
+		if ack != nil && match(ack) {
+			return true, nil
+		}
+	}
+}
+
+// readAck returns nil without an error for a segment that is not a valid
+// ACK of this session.
+func (s *Sender) readAck(deadline time.Time) (*netsim.Segment, error) {
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	n, err := s.conn.Read(s.buf)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, err
+		}
+		// e.g. the server is not running yet, the timer decides
+		log.Printf("Error reading from server: %s\n", err)
+		return nil, nil
+	}
+	ack, err := netsim.DecodeSegment(s.buf[:n])
+	if err != nil {
+		s.stats.CorruptAcks++
+		return nil, nil
+	}
+	if ack.Type != netsim.SegAck || ack.Session != s.session {
+		return nil, nil
+	}
+	return ack, nil
+}
+
+func showTransferStats(st TransferStats) {
+	secs := st.Duration.Seconds()
+	fmt.Printf("%d bytes in %v, %.1f KB/s\n", st.Bytes, st.Duration.Round(time.Millisecond), float64(st.Bytes)/1024/secs)
+	fmt.Printf("%d segments, %d transmitted, %d retransmitted (%.2f%%), %d timeouts, %d fast retransmits, %d duplicate ACKs, %d corrupt ACKs\n",
+		st.Segments, st.Sent, st.Retransmitted, float64(st.Retransmitted)/float64(st.Sent)*100,
+		st.Timeouts, st.FastRetransmits, st.DupAcks, st.CorruptAcks)
+}
+
+var reportHeader = []string{"protocol", "cc", "window", "rto_ms", "loss", "bytes", "seconds", "kb_per_s",
+	"segments", "sent", "retransmitted", "timeouts", "fast_retransmits", "dup_acks"}
+
+// appendReport adds a row for the transfer to a CSV file, writing the
+// header first when the file is new.
+func appendReport(name string, cfg TransferConfig, impair netsim.ImpairConfig, st TransferStats) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	ccName := cfg.CC
+	if ccName == "" {
+		ccName = "none"
+	}
+	w := csv.NewWriter(file)
+	if info.Size() == 0 {
+		_ = w.Write(reportHeader)
+	}
+	_ = w.Write([]string{
+		cfg.Proto.String(),
+		ccName,
+		strconv.Itoa(cfg.Window),
+		strconv.FormatInt(cfg.Timeout.Milliseconds(), 10),
+		strconv.FormatFloat(impair.Loss, 'f', 3, 64),
+		strconv.FormatInt(st.Bytes, 10),
+		strconv.FormatFloat(st.Duration.Seconds(), 'f', 3, 64),
+		strconv.FormatFloat(float64(st.Bytes)/1024/st.Duration.Seconds(), 'f', 1, 64),
+		strconv.Itoa(st.Segments),
+		strconv.Itoa(st.Sent),
+		strconv.Itoa(st.Retransmitted),
+		strconv.Itoa(st.Timeouts),
+		strconv.Itoa(st.FastRetransmits),
+		strconv.Itoa(st.DupAcks),
+	})
+	w.Flush()
+	if err := w.Error(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"netsim"
+)
+
+// ackPeer is a minimal receiver for the sender under test, it follows the
+// receiver rules of each protocol and reports the delivered data once the
+// FIN arrives.
+func ackPeer(t *testing.T, proto netsim.Protocol) (string, <-chan []byte) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	done := make(chan []byte, 1)
+	go func() {
+		var data []byte
+		var expected uint32
+		buffered := make(map[uint32]*netsim.Segment)
+		ack := func(seg *netsim.Segment, seq uint32, addr *net.UDPAddr) {
+			reply := &netsim.Segment{Type: netsim.SegAck, Proto: proto, Session: seg.Session, Seq: seq}
+			_, _ = conn.WriteToUDP(reply.Encode(), addr)
+		}
+		deliver := func(seg *netsim.Segment) {
+			expected++
+			switch seg.Type {
+			case netsim.SegData:
+				data = append(data, seg.Payload...)
+			case netsim.SegFin:
+				select {
+				case done <- data:
+				default:
+				}
+			}
+		}
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			seg, err := netsim.DecodeSegment(buf[:n])
+			if err != nil {
+				continue
+			}
+			switch proto {
+			case netsim.StopAndWait:
+				if seg.Seq == expected%2 {
+					deliver(seg)
+				}
+				ack(seg, seg.Seq, addr)
+			case netsim.GoBackN:
+				if seg.Seq == expected {
+					deliver(seg)
+				}
+				if expected > 0 {
+					ack(seg, expected-1, addr)
+				}
+			case netsim.SelectiveRepeat:
+				ack(seg, seg.Seq, addr)
+				if seg.Seq >= expected {
+					buffered[seg.Seq] = seg
+				}
+				for next, ok := buffered[expected]; ok; next, ok = buffered[expected] {
+					delete(buffered, expected)
+					deliver(next)
+				}
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), done
+}
+
+// dialPeer connects to addr like dial does to the server.
+func dialPeer(t *testing.T, addr string, impair netsim.ImpairConfig) *netsim.ImpairedConn {
+	if err := impair.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := netsim.NewImpairedConn(udpConn, impair)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// TestSenderLoss transfers a file over a network that loses segments and
+// ACKs. The fixed seed gives each direction the same sequence of decisions
+// on every run, only the timing decides which packet meets which.
+func TestSenderLoss(t *testing.T) {
+	data := make([]byte, 40*200)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	tests := []struct {
+		name  string
+		proto netsim.Protocol
+		cc    string
+	}{
+		{"stop-and-wait", netsim.StopAndWait, ""},
+		{"go-back-n", netsim.GoBackN, ""},
+		{"go-back-n reno", netsim.GoBackN, "reno"},
+		{"selective-repeat", netsim.SelectiveRepeat, ""},
+		{"selective-repeat cubic", netsim.SelectiveRepeat, "cubic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, done := ackPeer(t, tt.proto)
+			impair := netsim.ImpairConfig{Loss: 0.2, Duplicate: 0.05, Seed: 7, Direction: "both"}
+			if tt.proto != netsim.StopAndWait {
+				// the alternating bit cannot tell a late copy from a new one
+				impair.Reorder, impair.ReorderDelay = 0.05, 5*time.Millisecond
+			}
+			conn := dialPeer(t, addr, impair)
+
+			cfg := TransferConfig{File: "f.bin", Proto: tt.proto, Window: 8, Timeout: 20 * time.Millisecond,
+				SegmentSize: 200, MaxRetries: 50, CC: tt.cc}
+			s := NewSender(conn, cfg, data)
+			s.start = time.Now()
+			if err := s.Run(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case got := <-done:
+				if !bytes.Equal(got, data) {
+					t.Errorf("received %d bytes, not the %d sent", len(got), len(data))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("FIN never delivered")
+			}
+
+			in, out := conn.Stats()
+			if in.Dropped == 0 || out.Dropped == 0 {
+				t.Fatalf("nothing lost, in: %s, out: %s", in, out)
+			}
+			if s.stats.Retransmitted == 0 || s.stats.Timeouts == 0 && s.stats.FastRetransmits == 0 {
+				t.Errorf("losses recovered without retransmissions, %+v", s.stats)
+			}
+		})
+	}
+}
+
+func TestSenderGivesUp(t *testing.T) {
+	addr, _ := ackPeer(t, netsim.GoBackN)
+	conn := dialPeer(t, addr, netsim.ImpairConfig{Loss: 1, Seed: 7, Direction: "out"})
+
+	cfg := TransferConfig{File: "f.bin", Proto: netsim.GoBackN, Window: 4, Timeout: 5 * time.Millisecond, SegmentSize: 200, MaxRetries: 3}
+	s := NewSender(conn, cfg, make([]byte, 1000))
+	if err := s.Run(); !errors.Is(err, errTooManyRetries) {
+		t.Fatalf("Run over a dead link - %v", err)
+	}
+	if s.stats.Timeouts != cfg.MaxRetries+1 {
+		t.Errorf("%d timeouts, want %d", s.stats.Timeouts, cfg.MaxRetries+1)
+	}
+}
@@ -0,0 +1,482 @@
+package netsim
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImpairConfig describes the simulated network between client and server.
+// Every probability is per packet, Loss and the Gilbert-Elliott model can
+// be combined.
+type ImpairConfig struct {
+	Loss float64
+	// Gilbert-Elliott burst loss: BurstP is the chance to go from the good
+	// to the bad state, BurstR to come back, each state has its own loss
+	BurstP        float64
+	BurstR        float64
+	BurstGoodLoss float64
+	BurstBadLoss  float64
+
+	Delay        time.Duration
+	Jitter       time.Duration
+	Reorder      float64
+	ReorderDelay time.Duration
+	Duplicate    float64
+	Corrupt      float64
+
+	// Seed makes the decisions reproducible, 0 picks one from the clock
+	Seed      int64
+	Direction string
+	Verbose   bool
+
+	inbound, outbound bool
+}
+
+const maxDatagram = 65535
+
+// RegisterFlags adds the impairment flags to the command line, the current
+// values of c are the defaults.
+func (c *ImpairConfig) RegisterFlags() {
+	flag.Float64Var(&c.Loss, "loss", c.Loss, "probability of dropping a packet")
+	flag.Float64Var(&c.BurstP, "burst-p", c.BurstP, "Gilbert-Elliott probability of entering the bad state, 0 to disable")
+	flag.Float64Var(&c.BurstR, "burst-r", c.BurstR, "Gilbert-Elliott probability of leaving the bad state")
+	flag.Float64Var(&c.BurstGoodLoss, "burst-good-loss", c.BurstGoodLoss, "loss probability in the good state")
+	flag.Float64Var(&c.BurstBadLoss, "burst-bad-loss", c.BurstBadLoss, "loss probability in the bad state")
+	flag.DurationVar(&c.Delay, "delay", c.Delay, "fixed delay added to every packet")
+	flag.DurationVar(&c.Jitter, "jitter", c.Jitter, "random delay variation, uniform in [-jitter, jitter]")
+	flag.Float64Var(&c.Reorder, "reorder", c.Reorder, "probability of holding a packet back so later ones overtake it")
+	flag.DurationVar(&c.ReorderDelay, "reorder-delay", c.ReorderDelay, "how long a reordered packet is held back")
+	flag.Float64Var(&c.Duplicate, "dup", c.Duplicate, "probability of delivering a packet twice")
+	flag.Float64Var(&c.Corrupt, "corrupt", c.Corrupt, "probability of flipping a random bit of a packet")
+	flag.Int64Var(&c.Seed, "seed", c.Seed, "random seed of the impairments, 0 for a random one")
+	flag.StringVar(&c.Direction, "impair", c.Direction, "impaired direction: `in`, out, both or none")
+	flag.BoolVar(&c.Verbose, "impair-log", c.Verbose, "log every impaired packet")
+}
+
+// Validate checks the flag values and resolves the direction.
+func (c *ImpairConfig) Validate() error {
+	for _, p := range []float64{c.Loss, c.BurstP, c.BurstR, c.BurstGoodLoss, c.BurstBadLoss, c.Reorder, c.Duplicate, c.Corrupt} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("probability %v out of [0, 1]", p)
+		}
+	}
+	if c.Delay < 0 || c.Jitter < 0 || c.ReorderDelay < 0 {
+		return errors.New("negative delay")
+	}
+	switch strings.ToLower(c.Direction) {
+	case "in":
+		c.inbound, c.outbound = true, false
+	case "out":
+		c.inbound, c.outbound = false, true
+	case "both":
+		c.inbound, c.outbound = true, true
+	case "none", "":
+		c.inbound, c.outbound = false, false
+	default:
+		return fmt.Errorf("unknown impaired direction %q", c.Direction)
+	}
+	if c.Seed == 0 {
+		c.Seed = time.Now().UnixNano()
+	}
+	return nil
+}
+
+// Active reports whether any impairment is configured.
+func (c ImpairConfig) Active() bool {
+	return c.Loss > 0 || c.BurstP > 0 || c.Delay > 0 || c.Jitter > 0 || c.Reorder > 0 ||
+		c.Duplicate > 0 || c.Corrupt > 0
+}
+
+func (c ImpairConfig) String() string {
+	if !c.Active() || !c.inbound && !c.outbound {
+		return "no impairments"
+	}
+	return fmt.Sprintf("%s: loss %.2f, burst p=%.2f r=%.2f (%.2f/%.2f), delay %v±%v, reorder %.2f (+%v), dup %.2f, corrupt %.2f, seed %d",
+		c.Direction, c.Loss, c.BurstP, c.BurstR, c.BurstGoodLoss, c.BurstBadLoss, c.Delay, c.Jitter,
+		c.Reorder, c.ReorderDelay, c.Duplicate, c.Corrupt, c.Seed)
+}
+
+type ImpairStats struct {
+	Packets    int
+	Dropped    int
+	Duplicated int
+	Corrupted  int
+	Reordered  int
+}
+
+func (s ImpairStats) String() string {
+	return fmt.Sprintf("%d packets, %d dropped, %d duplicated, %d corrupted, %d reordered",
+		s.Packets, s.Dropped, s.Duplicated, s.Corrupted, s.Reordered)
+}
+
+// impairState is kept per direction so the burst state of one does not
+// leak into the other. Each direction draws from its own rng, the decisions
+// for one do not depend on how its packets interleave with the other's.
+type impairState struct {
+	name  string
+	rng   *rand.Rand
+	bad   bool
+	stats ImpairStats
+	line  delayLine
+}
+
+// delayLine releases delayed packets in the order of their release time,
+// packets due at the same time leave in the order they came. A timer per
+// packet would reorder them since the timers fire in separate goroutines.
+type delayLine struct {
+	mu      sync.Mutex
+	pending []delayed
+	wake    chan struct{}
+	once    sync.Once
+}
+
+type delayed struct {
+	at      time.Time
+	deliver func()
+}
+
+func (l *delayLine) push(at time.Time, deliver func(), closed <-chan struct{}) {
+	l.once.Do(func() {
+		l.wake = make(chan struct{}, 1)
+		go l.run(closed)
+	})
+
+	l.mu.Lock()
+	i := sort.Search(len(l.pending), func(i int) bool { return l.pending[i].at.After(at) })
+	l.pending = append(l.pending, delayed{})
+	copy(l.pending[i+1:], l.pending[i:])
+	l.pending[i] = delayed{at: at, deliver: deliver}
+	l.mu.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *delayLine) run(closed <-chan struct{}) {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		n := 0
+		for n < len(l.pending) && !l.pending[n].at.After(now) {
+			n++
+		}
+		due := append([]delayed(nil), l.pending[:n]...)
+		l.pending = append(l.pending[:0], l.pending[n:]...)
+		wait := time.Hour
+		if len(l.pending) > 0 {
+			wait = l.pending[0].at.Sub(now)
+		}
+		l.mu.Unlock()
+
+		if len(due) > 0 {
+			for _, d := range due {
+				d.deliver()
+			}
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-l.wake:
+		case <-closed:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
+	err  error
+}
+
+// ImpairedConn wraps a UDP socket and applies the configured impairments to
+// the enabled directions. Inbound packets are read by a goroutine and
+// queued, so delayed packets do not hold up the ones behind them.
+type ImpairedConn struct {
+	conn *net.UDPConn
+	cfg  ImpairConfig
+
+	mu       sync.Mutex
+	in, out  impairState
+	deadline time.Time
+
+	queue     chan datagram
+	readOnce  sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewImpairedConn wraps conn, cfg must have been validated.
+func NewImpairedConn(conn *net.UDPConn, cfg ImpairConfig) *ImpairedConn {
+	if !cfg.Active() {
+		cfg.inbound, cfg.outbound = false, false
+	}
+	seeds := rand.New(rand.NewSource(cfg.Seed))
+	return &ImpairedConn{
+		conn:   conn,
+		cfg:    cfg,
+		in:     impairState{name: "in", rng: rand.New(rand.NewSource(seeds.Int63()))},
+		out:    impairState{name: "out", rng: rand.New(rand.NewSource(seeds.Int63()))},
+		queue:  make(chan datagram, 1024),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *ImpairedConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFromUDP(b)
+	return n, err
+}
+
+func (c *ImpairedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.ReadFromUDP(b)
+}
+
+func (c *ImpairedConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	if !c.cfg.inbound {
+		return c.conn.ReadFromUDP(b)
+	}
+	c.readOnce.Do(func() { go c.readLoop() })
+
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case d := <-c.queue:
+		if d.err != nil {
+			return 0, nil, d.err
+		}
+		return copy(b, d.data), d.addr, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *ImpairedConn) readLoop() {
+	for {
+		buf := make([]byte, maxDatagram)
+		n, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case c.queue <- datagram{err: err}:
+			case <-c.closed:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		c.impair(buf[:n], &c.in, addr, func(p []byte) {
+			select {
+			case c.queue <- datagram{data: p, addr: addr}:
+			default:
+				// a full queue behaves like a full socket buffer
+			}
+		})
+	}
+}
+
+func (c *ImpairedConn) Write(b []byte) (int, error) {
+	if !c.cfg.outbound {
+		return c.conn.Write(b)
+	}
+	c.impair(b, &c.out, c.RemoteUDPAddr(), func(p []byte) {
+		if _, err := c.conn.Write(p); err != nil {
+			log.Printf("Impaired write error: %v", err)
+		}
+	})
+	return len(b), nil
+}
+
+func (c *ImpairedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !c.cfg.outbound {
+		return c.conn.WriteTo(b, addr)
+	}
+	udpAddr, _ := addr.(*net.UDPAddr)
+	c.impair(b, &c.out, udpAddr, func(p []byte) {
+		if _, err := c.conn.WriteTo(p, addr); err != nil {
+			log.Printf("Impaired write error: %v", err)
+		}
+	})
+	return len(b), nil
+}
+
+// impair decides the fate of one packet and hands the surviving copies to
+// deliver, either right away or after their delay. deliver gets its own
+// copy of the data.
+func (c *ImpairedConn) impair(p []byte, st *impairState, addr *net.UDPAddr, deliver func([]byte)) {
+	c.mu.Lock()
+	st.stats.Packets++
+	lost := c.lose(st)
+	var copies []time.Duration
+	var corrupt []bool
+	if !lost {
+		n := 1
+		if st.rng.Float64() < c.cfg.Duplicate {
+			n = 2
+			st.stats.Duplicated++
+		}
+		for i := 0; i < n; i++ {
+			delay := c.cfg.Delay
+			if c.cfg.Jitter > 0 {
+				delay += time.Duration(st.rng.Int63n(int64(2*c.cfg.Jitter)+1)) - c.cfg.Jitter
+			}
+			if st.rng.Float64() < c.cfg.Reorder {
+				delay += c.cfg.ReorderDelay
+				st.stats.Reordered++
+			}
+			if delay < 0 {
+				delay = 0
+			}
+			bad := st.rng.Float64() < c.cfg.Corrupt
+			if bad {
+				st.stats.Corrupted++
+			}
+			copies = append(copies, delay)
+			corrupt = append(corrupt, bad)
+		}
+	} else {
+		st.stats.Dropped++
+	}
+	// the bit to flip is drawn under the lock to keep runs reproducible
+	bits := make([]int, len(copies))
+	for i := range bits {
+		if corrupt[i] && len(p) > 0 {
+			bits[i] = st.rng.Intn(len(p) * 8)
+		}
+	}
+	c.mu.Unlock()
+
+	if lost {
+		c.logf("Simulated loss of %d bytes %s %s", len(p), st.name, addr)
+		return
+	}
+	for i, delay := range copies {
+		data := append([]byte(nil), p...)
+		if corrupt[i] && len(data) > 0 {
+			data[bits[i]/8] ^= 1 << uint(bits[i]%8)
+			c.logf("Simulated corruption of %d bytes %s %s", len(p), st.name, addr)
+		}
+		if i > 0 {
+			c.logf("Simulated duplicate of %d bytes %s %s", len(p), st.name, addr)
+		}
+		if delay == 0 {
+			deliver(data)
+			continue
+		}
+		st.line.push(time.Now().Add(delay), func() {
+			select {
+			case <-c.closed:
+			default:
+				deliver(data)
+			}
+		}, c.closed)
+	}
+}
+
+// lose must be called with c.mu held.
+func (c *ImpairedConn) lose(st *impairState) bool {
+	lost := st.rng.Float64() < c.cfg.Loss
+	if c.cfg.BurstP > 0 {
+		if st.bad {
+			st.bad = st.rng.Float64() >= c.cfg.BurstR
+		} else {
+			st.bad = st.rng.Float64() < c.cfg.BurstP
+		}
+		p := c.cfg.BurstGoodLoss
+		if st.bad {
+			p = c.cfg.BurstBadLoss
+		}
+		lost = st.rng.Float64() < p || lost
+	}
+	return lost
+}
+
+func (c *ImpairedConn) logf(format string, args ...interface{}) {
+	if c.cfg.Verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// Stats returns the counters of the inbound and outbound directions.
+func (c *ImpairedConn) Stats() (in, out ImpairStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.in.stats, c.out.stats
+}
+
+func (c *ImpairedConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline applies to the reads that start after it, like the rest
+// of the lab code expects.
+func (c *ImpairedConn) SetReadDeadline(t time.Time) error {
+	if !c.cfg.inbound {
+		return c.conn.SetReadDeadline(t)
+	}
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *ImpairedConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *ImpairedConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *ImpairedConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *ImpairedConn) RemoteUDPAddr() *net.UDPAddr {
+	addr, _ := c.conn.RemoteAddr().(*net.UDPAddr)
+	return addr
+}
+
+func (c *ImpairedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	if c.cfg.inbound || c.cfg.outbound {
+		in, out := c.Stats()
+		if c.cfg.inbound {
+			log.Printf("Impairment in: %s", in)
+		}
+		if c.cfg.outbound {
+			log.Printf("Impairment out: %s", out)
+		}
+	}
+	return c.conn.Close()
+}
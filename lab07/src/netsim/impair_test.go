@@ -0,0 +1,53 @@
+package netsim
+
+import (
+	"reflect"
+	"testing"
+)
+
+// inboundFate impairs 200 inbound packets, outbound packets are sent in
+// between every `every` of them, and returns which inbound ones survived.
+func inboundFate(t *testing.T, cfg ImpairConfig, every int) []bool {
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := NewImpairedConn(nil, cfg)
+	var fate []bool
+	for i := 0; i < 200; i++ {
+		if every > 0 && i%every == 0 {
+			c.impair([]byte("out"), &c.out, nil, func([]byte) {})
+		}
+		delivered := false
+		c.impair([]byte("in"), &c.in, nil, func([]byte) {
+			delivered = true
+		})
+		fate = append(fate, delivered)
+	}
+	return fate
+}
+
+// TestImpairSeedPerDirection checks that a seed repeats the decisions of a
+// direction no matter how much traffic goes the other way.
+func TestImpairSeedPerDirection(t *testing.T) {
+	cfg := ImpairConfig{Loss: 0.3, BurstP: 0.1, BurstR: 0.5, BurstBadLoss: 0.9, Duplicate: 0.1, Seed: 42, Direction: "both"}
+	want := inboundFate(t, cfg, 0)
+	lost := 0
+	for _, ok := range want {
+		if !ok {
+			lost++
+		}
+	}
+	if lost == 0 || lost == len(want) {
+		t.Fatalf("%d of %d packets lost", lost, len(want))
+	}
+	for _, every := range []int{1, 3, 7} {
+		if got := inboundFate(t, cfg, every); !reflect.DeepEqual(got, want) {
+			t.Errorf("outbound packet every %d inbound ones changed the inbound losses", every)
+		}
+	}
+
+	cfg.Seed++
+	if got := inboundFate(t, cfg, 0); reflect.DeepEqual(got, want) {
+		t.Error("another seed gave the same losses")
+	}
+}
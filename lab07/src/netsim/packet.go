@@ -0,0 +1,162 @@
+// Package netsim holds the wire formats and the simulated network shared by
+// the lab 7 client and server.
+package netsim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Packets of the ping and heartbeat modes.
+//
+//	0       1         2      3          4            6            8        12          16                    24
+//	+-------+---------+------+----------+------------+------------+--------+-----------+---------------------+---------
+//	| magic | version | type | reserved |  checksum  |   length   |  seq   | client id | timestamp, ns (UTC) | payload
+//	+-------+---------+------+----------+------------+------------+--------+-----------+---------------------+---------
+//
+// The checksum is the Internet checksum of the whole packet with the
+// checksum field zeroed. The magic byte is not printable, so the packets
+// cannot be confused with the text format of older clients: "Ping 12
+// 15:04:05" for echo and "12 15:04:05" for heartbeat.
+
+type PacketType uint8
+
+const (
+	PktPing PacketType = iota + 1
+	PktPong
+	PktHeartbeat
+	PktHeartbeatAck
+)
+
+func (t PacketType) String() string {
+	switch t {
+	case PktPing:
+		return "PING"
+	case PktPong:
+		return "PONG"
+	case PktHeartbeat:
+		return "HEARTBEAT"
+	case PktHeartbeatAck:
+		return "HEARTBEAT-ACK"
+	}
+	return fmt.Sprintf("type(%d)", uint8(t))
+}
+
+const (
+	packetMagic     = 0xa7
+	packetVersion   = 1
+	packetHeaderLen = 24
+	// TextVersion marks a packet parsed from the text format
+	TextVersion = 0
+	// TimeFormat is the packet time in the text format
+	TimeFormat = "15:04:05"
+)
+
+var (
+	errShortPacket  = errors.New("packet too short")
+	errNotBinary    = errors.New("not a binary packet")
+	errBadVersion   = errors.New("unsupported packet version")
+	errPacketSum    = errors.New("checksum mismatch")
+	errPacketLength = errors.New("length does not match the payload")
+	errTextFormat   = errors.New("invalid packet format")
+)
+
+type Packet struct {
+	Version  uint8
+	Type     PacketType
+	Seq      uint32
+	Time     time.Time
+	ClientID uint32
+	Payload  []byte
+}
+
+func (p *Packet) String() string {
+	return fmt.Sprintf("%s seq %d client %08x time %s len %d",
+		p.Type, p.Seq, p.ClientID, p.Time.Format(time.RFC3339Nano), len(p.Payload))
+}
+
+func (p *Packet) Encode() []byte {
+	buf := make([]byte, packetHeaderLen+len(p.Payload))
+	buf[0] = packetMagic
+	buf[1] = packetVersion
+	buf[2] = byte(p.Type)
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(p.Payload)))
+	binary.BigEndian.PutUint32(buf[8:], p.Seq)
+	binary.BigEndian.PutUint32(buf[12:], p.ClientID)
+	binary.BigEndian.PutUint64(buf[16:], uint64(p.Time.UnixNano()))
+	copy(buf[packetHeaderLen:], p.Payload)
+	binary.BigEndian.PutUint16(buf[4:], internetChecksum(buf))
+	return buf
+}
+
+// IsBinaryPacket tells the binary format from the text one by the magic byte.
+func IsBinaryPacket(buf []byte) bool {
+	return len(buf) > 0 && buf[0] == packetMagic
+}
+
+// DecodePacket checks the packet before trusting any of its fields.
+func DecodePacket(buf []byte) (*Packet, error) {
+	if !IsBinaryPacket(buf) {
+		return nil, errNotBinary
+	}
+	if len(buf) < packetHeaderLen {
+		return nil, errShortPacket
+	}
+	if buf[1] != packetVersion {
+		return nil, errBadVersion
+	}
+	if internetChecksum(buf) != 0 {
+		return nil, errPacketSum
+	}
+	if int(binary.BigEndian.Uint16(buf[6:])) != len(buf)-packetHeaderLen {
+		return nil, errPacketLength
+	}
+	return &Packet{
+		Version:  buf[1],
+		Type:     PacketType(buf[2]),
+		Seq:      binary.BigEndian.Uint32(buf[8:]),
+		ClientID: binary.BigEndian.Uint32(buf[12:]),
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(buf[16:]))),
+		Payload:  append([]byte(nil), buf[packetHeaderLen:]...),
+	}, nil
+}
+
+// ParsePacket accepts both the binary format and the text one. A text
+// packet has no date, its time is the time of day on January 1, year 0.
+func ParsePacket(buf []byte) (*Packet, error) {
+	if IsBinaryPacket(buf) {
+		return DecodePacket(buf)
+	}
+
+	parts := strings.Split(string(buf), " ")
+	typ := PktHeartbeat
+	if len(parts) == 3 && parts[0] == "Ping" {
+		typ = PktPing
+		parts = parts[1:]
+	}
+	if len(parts) != 2 {
+		return nil, errTextFormat
+	}
+
+	seq, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w - idx", errTextFormat)
+	}
+	packetTime, err := time.Parse(TimeFormat, parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w - time", errTextFormat)
+	}
+	return &Packet{Version: TextVersion, Type: typ, Seq: uint32(seq), Time: packetTime}, nil
+}
+
+// FormatText is the text form of a packet for older peers.
+func (p *Packet) FormatText() string {
+	if p.Type == PktPing {
+		return fmt.Sprintf("Ping %d %s", p.Seq, p.Time.Format(TimeFormat))
+	}
+	return fmt.Sprintf("%d %s", p.Seq, p.Time.Format(TimeFormat))
+}
@@ -0,0 +1,70 @@
+package netsim
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func samePacket(a, b *Packet) bool {
+	return a.Type == b.Type && a.Seq == b.Seq && a.ClientID == b.ClientID &&
+		a.Time.Equal(b.Time) && bytes.Equal(a.Payload, b.Payload)
+}
+
+// FuzzDecodePacket feeds arbitrary datagrams to the decoders, they must
+// reject them with an error and never panic. The other arguments build a
+// packet that has to survive Encode and DecodePacket unchanged.
+func FuzzDecodePacket(f *testing.F) {
+	ping := &Packet{Type: PktPing, Seq: 7, ClientID: 0xdeadbeef, Time: time.Unix(1700000000, 123456789)}
+	withPayload := &Packet{Type: PktHeartbeat, Seq: 1, ClientID: 1, Time: time.Unix(0, 1), Payload: []byte("odd")}
+	badSum := ping.Encode()
+	badSum[9] ^= 1
+	seeds := [][]byte{
+		ping.Encode(),
+		withPayload.Encode(),
+		badSum,
+		ping.Encode()[:packetHeaderLen-1],
+		append(withPayload.Encode(), 0),
+		{packetMagic},
+		{packetMagic, packetVersion + 1},
+		[]byte("Ping 12 15:04:05"),
+		[]byte("12 15:04:05"),
+		[]byte("Ping 99999999999 15:04:05"),
+		{},
+	}
+	for i, seed := range seeds {
+		f.Add(seed, uint8(i), uint32(i), uint32(i)*0x01010101, int64(i)*int64(time.Hour))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, typ uint8, seq, clientID uint32, ns int64) {
+		if p, err := DecodePacket(data); err == nil {
+			// a packet that passed the checks decodes the same once encoded again
+			again, err := DecodePacket(p.Encode())
+			if err != nil {
+				t.Fatalf("re-encoded %s - %v", p, err)
+			}
+			if !samePacket(p, again) {
+				t.Fatalf("re-encoded %s, decoded %s", p, again)
+			}
+		}
+		if p, err := ParsePacket(data); err == nil && p == nil {
+			t.Fatal("no packet and no error")
+		}
+
+		if len(data) > maxDatagram-packetHeaderLen {
+			data = data[:maxDatagram-packetHeaderLen]
+		}
+		p := &Packet{Type: PacketType(typ), Seq: seq, ClientID: clientID, Time: time.Unix(0, ns), Payload: data}
+		wire := p.Encode()
+		if internetChecksum(wire) != 0 {
+			t.Fatalf("encoded %s with a wrong checksum", p)
+		}
+		decoded, err := DecodePacket(wire)
+		if err != nil {
+			t.Fatalf("encoded %s - %v", p, err)
+		}
+		if decoded.Version != packetVersion || !samePacket(p, decoded) {
+			t.Fatalf("encoded %s, decoded %s", p, decoded)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package netsim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Segments of the reliable file transfer. The whole transfer is one
+// sequence of segments: START with the file name, DATA with the contents
+// and FIN, each acknowledged with an ACK carrying the same session.
+//
+//	0      1      2             4                 8                 12            14
+//	+------+------+-------------+-----------------+-----------------+-------------+---------
+//	| type | proto|  checksum   |     session     |       seq       |   length    | payload
+//	+------+------+-------------+-----------------+-----------------+-------------+---------
+//
+// The checksum is the Internet checksum (RFC 1071) of the header, with the
+// checksum field zeroed, and the payload.
+
+type SegmentType uint8
+
+const (
+	SegStart SegmentType = iota + 1
+	SegData
+	SegFin
+	SegAck
+)
+
+func (t SegmentType) String() string {
+	switch t {
+	case SegStart:
+		return "START"
+	case SegData:
+		return "DATA"
+	case SegFin:
+		return "FIN"
+	case SegAck:
+		return "ACK"
+	}
+	return fmt.Sprintf("type(%d)", uint8(t))
+}
+
+// Protocol is the reliable transfer protocol chosen by the sender.
+type Protocol uint8
+
+const (
+	StopAndWait Protocol = iota
+	GoBackN
+	SelectiveRepeat
+)
+
+// MaxWindow bounds the receive buffer of Selective Repeat. Sequence
+// numbers never wrap within a transfer, so any window up to it is safe.
+const MaxWindow = 1024
+
+func (p Protocol) String() string {
+	switch p {
+	case StopAndWait:
+		return "stop-and-wait"
+	case GoBackN:
+		return "go-back-n"
+	case SelectiveRepeat:
+		return "selective-repeat"
+	}
+	return fmt.Sprintf("protocol(%d)", uint8(p))
+}
+
+const (
+	segmentHeaderLen = 14
+	MaxSegmentData   = 1400
+)
+
+var (
+	errShortSegment = errors.New("segment too short")
+	errBadChecksum  = errors.New("checksum mismatch")
+	errBadLength    = errors.New("length does not match the payload")
+)
+
+type Segment struct {
+	Type    SegmentType
+	Proto   Protocol
+	Session uint32
+	Seq     uint32
+	Payload []byte
+}
+
+func (s *Segment) String() string {
+	return fmt.Sprintf("%s session %08x seq %d len %d", s.Type, s.Session, s.Seq, len(s.Payload))
+}
+
+func (s *Segment) Encode() []byte {
+	buf := make([]byte, segmentHeaderLen+len(s.Payload))
+	buf[0] = byte(s.Type)
+	buf[1] = byte(s.Proto)
+	binary.BigEndian.PutUint32(buf[4:], s.Session)
+	binary.BigEndian.PutUint32(buf[8:], s.Seq)
+	binary.BigEndian.PutUint16(buf[12:], uint16(len(s.Payload)))
+	copy(buf[segmentHeaderLen:], s.Payload)
+	binary.BigEndian.PutUint16(buf[2:], internetChecksum(buf))
+	return buf
+}
+
+// DecodeSegment verifies the checksum first, a corrupted segment is
+// rejected as a whole since none of its fields can be trusted.
+func DecodeSegment(buf []byte) (*Segment, error) {
+	if len(buf) < segmentHeaderLen {
+		return nil, errShortSegment
+	}
+	if internetChecksum(buf) != 0 {
+		return nil, errBadChecksum
+	}
+	if int(binary.BigEndian.Uint16(buf[12:])) != len(buf)-segmentHeaderLen {
+		return nil, errBadLength
+	}
+	return &Segment{
+		Type:    SegmentType(buf[0]),
+		Proto:   Protocol(buf[1]),
+		Session: binary.BigEndian.Uint32(buf[4:]),
+		Seq:     binary.BigEndian.Uint32(buf[8:]),
+		Payload: append([]byte(nil), buf[segmentHeaderLen:]...),
+	}, nil
+}
+
+// internetChecksum is the ones' complement of the ones' complement sum of
+// 16-bit words, an odd byte at the end is padded with zero. Summing over
+// data that contains a correct checksum gives 0.
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
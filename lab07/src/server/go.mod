@@ -1 +1,5 @@
 module server
+
+require netsim v0.0.0
+
+replace netsim => ../netsim
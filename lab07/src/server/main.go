@@ -1,54 +1,63 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"netsim"
 )
 
 type TaskType int
 
 const (
-	bufferSize    = 2048
-	packetLoss    = 5
-	defaultPort   = 8080
-	LostThreshold = 0.2
+	bufferSize  = 2048
+	defaultPort = 8080
 
 	Echo TaskType = iota
 	Heartbeat
-
-	timeFormat = "15:04:05"
+	Transfer
 )
 
 type Params struct {
 	Mode      TaskType
 	Threshold int
+	Dir       string
+	Impair    netsim.ImpairConfig
 }
 
 func ParseFlags() Params {
 
-	modeStr := flag.String("m", "echo", "`echo` for echo server, `heartbeat` for heartbeat tracking")
+	modeStr := flag.String("m", "echo", "`echo` for echo server, `heartbeat` for heartbeat tracking, `transfer` for receiving files")
 	threshold := flag.Int("t", 3, "time in seconds to consider client disconnected (only in heartbeat mode)")
+	dir := flag.String("o", "received", "directory for received files (only in transfer mode)")
+	// по умолчанию теряется 20% входящих пакетов, как требует задание
+	impair := netsim.ImpairConfig{Loss: 0.2, BurstBadLoss: 1, ReorderDelay: 50 * time.Millisecond, Direction: "in", Verbose: true}
+	impair.RegisterFlags()
 
 	flag.Parse()
 
+	if err := impair.Validate(); err != nil {
+		log.Fatalf("invalid impairment flags: %v", err)
+	}
+
 	var mode TaskType
-	if *modeStr == "heartbeat" {
+	switch *modeStr {
+	case "heartbeat":
 		mode = Heartbeat
-	} else {
+	case "transfer":
+		mode = Transfer
+	default:
 		mode = Echo
 	}
 	fmt.Printf("mode: %s\n", *modeStr)
 
-	return Params{Mode: mode, Threshold: *threshold}
+	return Params{Mode: mode, Threshold: *threshold, Dir: *dir, Impair: impair}
 }
 
 func main() {
@@ -56,11 +65,12 @@ func main() {
 	params := ParseFlags()
 
 	addr := net.UDPAddr{IP: net.ParseIP("localhost"), Port: defaultPort}
-	conn, err := net.ListenUDP("udp", &addr)
+	udpConn, err := net.ListenUDP("udp", &addr)
 	if err != nil {
 		log.Fatalf("failed to bind to %s: %v", addr.String(), err)
 	}
-	defer func(conn *net.UDPConn) {
+	conn := netsim.NewImpairedConn(udpConn, params.Impair)
+	defer func(conn *netsim.ImpairedConn) {
 		err := conn.Close()
 		if err != nil {
 			log.Printf("failed to close UDP connection: %v", err)
@@ -68,19 +78,22 @@ func main() {
 	}(conn)
 
 	log.Printf("Server running on %s", addr.String())
+	log.Printf("Simulated network: %s", params.Impair)
 
 	switch params.Mode {
 	case Heartbeat:
 		runHeartbeat(conn, params.Threshold)
 	case Echo:
 		runEcho(conn)
+	case Transfer:
+		runTransfer(conn, params.Dir)
 	default:
 		log.Println("Unsupported mode")
 		os.Exit(1)
 	}
 }
 
-func runEcho(conn *net.UDPConn) {
+func runEcho(conn *netsim.ImpairedConn) {
 	log.Println("Echo mode started")
 	buf := make([]byte, bufferSize)
 	packetCnt := 0
@@ -96,13 +109,19 @@ func runEcho(conn *net.UDPConn) {
 
 		log.Printf("[%d] Received %d bytes from %s", packetCnt, n, addr)
 
-		if packetCnt%packetLoss == 0 {
-			log.Printf("[%d] Simulated loss for %s", packetCnt, addr)
-			continue
+		var resp []byte
+		if netsim.IsBinaryPacket(buf[:n]) {
+			packet, err := netsim.DecodePacket(buf[:n])
+			if err != nil {
+				log.Printf("[%d] Dropped packet from %s: %v", packetCnt, addr, err)
+				continue
+			}
+			packet.Type = netsim.PktPong
+			resp = packet.Encode()
+		} else {
+			resp = []byte(strings.ToUpper(string(buf[:n])))
 		}
-
-		resp := strings.ToUpper(string(buf[:n]))
-		if _, err = conn.WriteTo([]byte(resp), addr); err != nil {
+		if _, err = conn.WriteTo(resp, addr); err != nil {
 			log.Printf("[%d] Write error: %v", packetCnt, err)
 		} else {
 			log.Printf("[%d] Responded to %s", packetCnt, addr)
@@ -117,11 +136,6 @@ type Client struct {
 	lostPacketsCnt int
 }
 
-type Packet struct {
-	idx  int
-	time time.Time
-}
-
 type Clients struct {
 	clients map[string]*Client
 	m       sync.Mutex
@@ -132,7 +146,7 @@ type Update struct {
 	buf  []byte
 }
 
-func runHeartbeat(conn *net.UDPConn, threshold int) {
+func runHeartbeat(conn *netsim.ImpairedConn, threshold int) {
 	log.Println("Heartbeat mode started")
 
 	clients := NewClients()
@@ -154,7 +168,7 @@ func runHeartbeat(conn *net.UDPConn, threshold int) {
 	}
 }
 
-func receiveUpdates(conn *net.UDPConn, updates chan<- Update, closed <-chan struct{}) {
+func receiveUpdates(conn *netsim.ImpairedConn, updates chan<- Update, closed <-chan struct{}) {
 	buf := make([]byte, bufferSize)
 	for {
 		// для заврешения горутины
@@ -173,53 +187,32 @@ func receiveUpdates(conn *net.UDPConn, updates chan<- Update, closed <-chan stru
 	}
 }
 
-func handleUpdate(conn *net.UDPConn, update Update, clients *Clients) {
+func handleUpdate(conn *netsim.ImpairedConn, update Update, clients *Clients) {
 
-	packet, err := parsePacket(update.buf)
+	packet, err := netsim.ParsePacket(update.buf)
 	if err != nil {
 		fmt.Printf("Error parsing packet: %s\n", err.Error())
 		return
 	}
 
-	if rand.Float32() < LostThreshold {
-		log.Printf("Lost packet from [%s] for simulation\n", update.addr)
-		return
+	// клиенты с бинарным форматом узнаются по ID, даже если сменили порт
+	key := update.addr.String()
+	if packet.Version != netsim.TextVersion {
+		key = fmt.Sprintf("%08x", packet.ClientID)
 	}
+	clients.handleUpdate(key, packet)
 
-	clients.handleUpdate(update.addr.String(), packet)
-
-	resp := fmt.Sprintf("%d %s", packet.idx, time.Now().Format(timeFormat))
+	reply := &netsim.Packet{Type: netsim.PktHeartbeatAck, Seq: packet.Seq, Time: time.Now(), ClientID: packet.ClientID}
+	resp := []byte(reply.FormatText())
+	if packet.Version != netsim.TextVersion {
+		resp = reply.Encode()
+	}
 
-	if _, err := conn.WriteTo([]byte(resp), update.addr); err != nil {
+	if _, err := conn.WriteTo(resp, update.addr); err != nil {
 		log.Printf("Write error: %v", err)
 		return
 	}
-	log.Printf("Sent response %s", resp)
-}
-
-func parsePacket(body []byte) (Packet, error) {
-	str := string(body)
-	parts := strings.Split(str, " ")
-
-	if len(parts) != 2 {
-		return Packet{}, errors.New("invalid packet format")
-	}
-
-	var packet Packet
-
-	if idx, err := strconv.Atoi(parts[0]); err != nil {
-		return Packet{}, errors.New("invalid packet format - idx")
-	} else {
-		packet.idx = idx
-	}
-
-	if packetTime, err := time.Parse(timeFormat, parts[1]); err != nil {
-		return Packet{}, errors.New("invalid packet format - time")
-	} else {
-		packet.time = packetTime
-	}
-
-	return packet, nil
+	log.Printf("Sent response %s", reply)
 }
 
 func NewClients() *Clients {
@@ -235,26 +228,27 @@ func (c *Clients) deleteDisconnected(threshold time.Duration) {
 		if time.Since(cl.lastPacketTime) > threshold {
 			delete(c.clients, addr)
 			log.Printf("Deleted connection [%s], now time: %s, last packet time: %s",
-				addr, time.Now().Format(timeFormat), cl.lastPacketTime)
+				addr, time.Now().Format(netsim.TimeFormat), cl.lastPacketTime)
 		}
 	}
 }
 
-func (c *Clients) handleUpdate(addr string, packet Packet) {
+func (c *Clients) handleUpdate(addr string, packet *netsim.Packet) {
 	c.m.Lock()
 	defer c.m.Unlock()
 
+	idx := int(packet.Seq)
 	if cl, find := c.clients[addr]; find {
-		newLost := packet.idx - cl.lastPacket - 1
-		c.clients[addr].lastPacket = packet.idx
-		c.clients[addr].lastPacketTime = packet.time
+		newLost := idx - cl.lastPacket - 1
+		c.clients[addr].lastPacket = idx
+		c.clients[addr].lastPacketTime = packet.Time
 		c.clients[addr].lostPacketsCnt += newLost
 		LogClientInfo(addr, *cl)
 	} else {
 		c.clients[addr] = &Client{
-			firstPacket:    packet.idx,
-			lastPacket:     packet.idx,
-			lastPacketTime: packet.time,
+			firstPacket:    idx,
+			lastPacket:     idx,
+			lastPacketTime: packet.Time,
 			lostPacketsCnt: 0,
 		}
 		LogClientInfo(addr, *c.clients[addr])
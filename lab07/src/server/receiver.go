@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"netsim"
+)
+
+const (
+	// sessionLinger keeps a finished session around to acknowledge
+	// retransmitted segments whose ACK was lost, an unfinished session
+	// idle for as long is abandoned
+	sessionLinger = 30 * time.Second
+	sweepInterval = time.Second
+)
+
+type transferSession struct {
+	id    uint32
+	addr  *net.UDPAddr
+	proto netsim.Protocol
+
+	name string
+	file *os.File
+	sum  hash.Hash
+
+	// expected is the number of segments delivered in order so far
+	expected uint32
+	finished bool
+	// buffered holds out-of-order segments of Selective Repeat
+	buffered map[uint32]*netsim.Segment
+
+	bytes      int64
+	segments   int
+	duplicates int
+	started    time.Time
+	lastSeen   time.Time
+}
+
+type Receiver struct {
+	conn *netsim.ImpairedConn
+	dir  string
+
+	sessions map[uint32]*transferSession
+	// byAddr is the latest session of a client, used to answer corrupted
+	// segments whose session cannot be trusted
+	byAddr  map[string]*transferSession
+	corrupt int
+}
+
+func runTransfer(conn *netsim.ImpairedConn, dir string) {
+	log.Printf("Transfer mode started, saving files to %s", dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("failed to create %s: %v", dir, err)
+	}
+
+	r := &Receiver{
+		conn:     conn,
+		dir:      dir,
+		sessions: make(map[uint32]*transferSession),
+		byAddr:   make(map[string]*transferSession),
+	}
+	buf := make([]byte, bufferSize)
+	lastSweep := time.Now()
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(sweepInterval)); err != nil {
+			log.Printf("failed to set read deadline: %v", err)
+		}
+		n, addr, err := conn.ReadFromUDP(buf)
+		if time.Since(lastSweep) >= sweepInterval {
+			r.sweep()
+			lastSweep = time.Now()
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("read error: %v", err)
+			continue
+		}
+		r.handle(buf[:n], addr)
+	}
+}
+
+func (r *Receiver) handle(buf []byte, addr *net.UDPAddr) {
+	seg, err := netsim.DecodeSegment(buf)
+	if err != nil {
+		r.corrupt++
+		log.Printf("Dropped segment from %s: %v", addr, err)
+		if s, ok := r.byAddr[addr.String()]; ok && s.expected > 0 && s.proto != netsim.SelectiveRepeat {
+			// rdt2.2 and Go-Back-N answer a damaged segment with the last
+			// ACK, Selective Repeat just waits for the retransmission
+			r.ack(s, s.lastAcked())
+		}
+		return
+	}
+
+	s, ok := r.sessions[seg.Session]
+	if !ok {
+		if seg.Type != netsim.SegStart || seg.Seq != 0 {
+			log.Printf("Ignored %s from %s: unknown session", seg, addr)
+			return
+		}
+		if s, err = r.open(seg, addr); err != nil {
+			log.Printf("Refused transfer from %s: %v", addr, err)
+			return
+		}
+	}
+	s.lastSeen = time.Now()
+	s.addr = addr
+
+	switch s.proto {
+	case netsim.StopAndWait:
+		err = r.stopAndWait(s, seg)
+	case netsim.GoBackN:
+		err = r.goBackN(s, seg)
+	case netsim.SelectiveRepeat:
+		err = r.selectiveRepeat(s, seg)
+	}
+	if err != nil {
+		log.Printf("Aborted transfer of %s from %s: %v", s.name, s.addr, err)
+		r.remove(s)
+	}
+}
+
+// stopAndWait is the rdt3.0 receiver: the expected alternating bit is
+// delivered and acknowledged, a duplicate is acknowledged again.
+func (r *Receiver) stopAndWait(s *transferSession, seg *netsim.Segment) error {
+	if seg.Seq != s.expected%2 || s.finished {
+		s.duplicates++
+		r.ack(s, seg.Seq)
+		return nil
+	}
+	if err := r.deliver(s, seg); err != nil {
+		return err
+	}
+	r.ack(s, seg.Seq)
+	return nil
+}
+
+// goBackN accepts only the next segment in order and always acknowledges
+// cumulatively, everything after a gap is discarded.
+func (r *Receiver) goBackN(s *transferSession, seg *netsim.Segment) error {
+	if seg.Seq == s.expected && !s.finished {
+		if err := r.deliver(s, seg); err != nil {
+			return err
+		}
+	} else {
+		s.duplicates++
+	}
+	if s.expected > 0 {
+		r.ack(s, s.lastAcked())
+	}
+	return nil
+}
+
+// selectiveRepeat acknowledges every segment individually, buffers the
+// ones after a gap and delivers them once the gap is filled. Segments
+// below the window are acknowledged again since their ACK may have been
+// lost.
+func (r *Receiver) selectiveRepeat(s *transferSession, seg *netsim.Segment) error {
+	switch {
+	case seg.Seq < s.expected:
+		s.duplicates++
+		r.ack(s, seg.Seq)
+		return nil
+	case seg.Seq >= s.expected+netsim.MaxWindow:
+		return nil
+	}
+	r.ack(s, seg.Seq)
+	if _, ok := s.buffered[seg.Seq]; ok {
+		s.duplicates++
+		return nil
+	}
+	s.buffered[seg.Seq] = seg
+	for {
+		next, ok := s.buffered[s.expected]
+		if !ok {
+			return nil
+		}
+		delete(s.buffered, s.expected)
+		if err := r.deliver(s, next); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *transferSession) lastAcked() uint32 {
+	switch s.proto {
+	case netsim.StopAndWait:
+		return (s.expected - 1) % 2
+	}
+	return s.expected - 1
+}
+
+func (r *Receiver) open(seg *netsim.Segment, addr *net.UDPAddr) (*transferSession, error) {
+	name := filepath.Base(string(seg.Payload))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, fmt.Errorf("invalid file name %q", seg.Payload)
+	}
+	switch seg.Proto {
+	case netsim.StopAndWait, netsim.GoBackN, netsim.SelectiveRepeat:
+	default:
+		return nil, fmt.Errorf("unsupported %s", seg.Proto)
+	}
+
+	s := &transferSession{
+		id:       seg.Session,
+		addr:     addr,
+		proto:    seg.Proto,
+		name:     name,
+		sum:      sha256.New(),
+		buffered: make(map[uint32]*netsim.Segment),
+		started:  time.Now(),
+	}
+	r.sessions[s.id] = s
+	r.byAddr[addr.String()] = s
+	log.Printf("Session %08x from %s: receiving %s with %s", s.id, addr, name, s.proto)
+	return s, nil
+}
+
+// deliver hands the next in-order segment to the file.
+func (r *Receiver) deliver(s *transferSession, seg *netsim.Segment) error {
+	s.expected++
+	s.segments++
+	switch seg.Type {
+	case netsim.SegStart:
+		file, err := os.Create(filepath.Join(r.dir, s.name))
+		if err != nil {
+			return err
+		}
+		s.file = file
+	case netsim.SegData:
+		if _, err := s.file.Write(seg.Payload); err != nil {
+			return err
+		}
+		s.sum.Write(seg.Payload)
+		s.bytes += int64(len(seg.Payload))
+	case netsim.SegFin:
+		s.finished = true
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+		elapsed := time.Since(s.started)
+		log.Printf("Session %08x: received %s, %d bytes in %v (%.1f KB/s), %d segments, %d duplicates, sha256 %x",
+			s.id, s.name, s.bytes, elapsed.Round(time.Millisecond), float64(s.bytes)/1024/elapsed.Seconds(),
+			s.segments, s.duplicates, s.sum.Sum(nil))
+	default:
+		return fmt.Errorf("unexpected %s", seg.Type)
+	}
+	return nil
+}
+
+func (r *Receiver) ack(s *transferSession, seq uint32) {
+	ack := &netsim.Segment{Type: netsim.SegAck, Proto: s.proto, Session: s.id, Seq: seq}
+	if _, err := r.conn.WriteTo(ack.Encode(), s.addr); err != nil {
+		log.Printf("Write error: %v", err)
+	}
+}
+
+func (r *Receiver) sweep() {
+	for _, s := range r.sessions {
+		if time.Since(s.lastSeen) < sessionLinger {
+			continue
+		}
+		if !s.finished {
+			log.Printf("Session %08x from %s abandoned after %d bytes of %s", s.id, s.addr, s.bytes, s.name)
+		}
+		r.remove(s)
+	}
+}
+
+func (r *Receiver) remove(s *transferSession) {
+	if s.file != nil && !s.finished {
+		if err := s.file.Close(); err != nil {
+			log.Printf("failed to close %s: %v", s.name, err)
+		}
+	}
+	delete(r.sessions, s.id)
+	if r.byAddr[s.addr.String()] == s {
+		delete(r.byAddr, s.addr.String())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"netsim"
+)
+
+func listenLocal(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// testReceiver returns a receiver saving to a temporary directory and the
+// client socket its ACKs go to.
+func testReceiver(t *testing.T) (*Receiver, *net.UDPConn) {
+	conn := netsim.NewImpairedConn(listenLocal(t), netsim.ImpairConfig{})
+	client := listenLocal(t)
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = client.Close()
+	})
+	r := &Receiver{
+		conn:     conn,
+		dir:      t.TempDir(),
+		sessions: make(map[uint32]*transferSession),
+		byAddr:   make(map[string]*transferSession),
+	}
+	return r, client
+}
+
+// step is a segment that reached the receiver and the ACK it has to answer
+// with, -1 for none. Lost segments are simply left out of the script.
+type step struct {
+	typ     netsim.SegmentType
+	seq     uint32
+	payload string
+	corrupt bool
+	ack     int
+}
+
+func TestReceiverLoss(t *testing.T) {
+	tests := []struct {
+		name  string
+		proto netsim.Protocol
+		steps []step
+		file  string
+	}{
+		{"stop-and-wait", netsim.StopAndWait, []step{
+			{typ: netsim.SegStart, seq: 0, payload: "f.txt", ack: 0},
+			{typ: netsim.SegData, seq: 1, payload: "a", ack: 1},
+			// the ACK was lost, the retransmission is acknowledged again
+			{typ: netsim.SegData, seq: 1, payload: "a", ack: 1},
+			{typ: netsim.SegData, seq: 0, payload: "b", corrupt: true, ack: 1},
+			{typ: netsim.SegData, seq: 0, payload: "b", ack: 0},
+			{typ: netsim.SegFin, seq: 1, ack: 1},
+		}, "ab"},
+		{"go-back-n", netsim.GoBackN, []step{
+			{typ: netsim.SegStart, seq: 0, payload: "f.txt", ack: 0},
+			{typ: netsim.SegData, seq: 1, payload: "a", ack: 1},
+			// 2 is lost, 3 and 4 are discarded and answered with ACK 1
+			{typ: netsim.SegData, seq: 3, payload: "c", ack: 1},
+			{typ: netsim.SegFin, seq: 4, ack: 1},
+			{typ: netsim.SegData, seq: 2, payload: "b", corrupt: true, ack: 1},
+			// the timeout sends the window again
+			{typ: netsim.SegData, seq: 2, payload: "b", ack: 2},
+			{typ: netsim.SegData, seq: 3, payload: "c", ack: 3},
+			{typ: netsim.SegFin, seq: 4, ack: 4},
+		}, "abc"},
+		{"selective-repeat", netsim.SelectiveRepeat, []step{
+			{typ: netsim.SegStart, seq: 0, payload: "f.txt", ack: 0},
+			{typ: netsim.SegData, seq: 1, payload: "a", ack: 1},
+			// 2 is lost, 3 and FIN are buffered and acknowledged one by one
+			{typ: netsim.SegData, seq: 3, payload: "c", ack: 3},
+			{typ: netsim.SegFin, seq: 4, ack: 4},
+			// a corrupted segment is not answered at all
+			{typ: netsim.SegData, seq: 2, payload: "b", corrupt: true, ack: -1},
+			{typ: netsim.SegData, seq: 2, payload: "b", ack: 2},
+			// the ACK of 1 was lost
+			{typ: netsim.SegData, seq: 1, payload: "a", ack: 1},
+			// beyond the window, dropped without an ACK
+			{typ: netsim.SegData, seq: 5 + netsim.MaxWindow, payload: "x", ack: -1},
+		}, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, client := testReceiver(t)
+			addr := client.LocalAddr().(*net.UDPAddr)
+			buf := make([]byte, bufferSize)
+			for i, st := range tt.steps {
+				seg := &netsim.Segment{Type: st.typ, Proto: tt.proto, Session: 0x1234, Seq: st.seq, Payload: []byte(st.payload)}
+				wire := seg.Encode()
+				if st.corrupt {
+					wire[len(wire)-1] ^= 0x40
+				}
+				r.handle(wire, addr)
+
+				if err := client.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+					t.Fatal(err)
+				}
+				n, err := client.Read(buf)
+				if st.ack < 0 {
+					if err == nil {
+						t.Fatalf("step %d: %s answered with %d bytes", i, seg, n)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: no ACK for %s - %v", i, seg, err)
+				}
+				ack, err := netsim.DecodeSegment(buf[:n])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ack.Type != netsim.SegAck || ack.Session != seg.Session || ack.Seq != uint32(st.ack) {
+					t.Fatalf("step %d: %s answered with %s, want ACK %d", i, seg, ack, st.ack)
+				}
+			}
+
+			s := r.sessions[0x1234]
+			if s == nil || !s.finished {
+				t.Fatal("transfer not finished")
+			}
+			data, err := os.ReadFile(filepath.Join(r.dir, "f.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.file {
+				t.Errorf("received %q, want %q", data, tt.file)
+			}
+		})
+	}
+}